@@ -0,0 +1,160 @@
+package cluster
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+)
+
+const subscriptionBufferSize = 64
+
+var (
+	ErrNoRoom    = errors.New("no such room")
+	ErrRoomTaken = errors.New("room is owned by another instance")
+	ErrCodeTaken = errors.New("room code is already used")
+)
+
+// Room is the registry entry of a running game. The owner is the only
+// instance that runs the game, the others relay their players to it.
+type Room struct {
+	ID      uint
+	Code    string
+	Owner   string
+	Players int
+	Words   int
+	Timer   int
+	Expires time.Time
+}
+
+func (r Room) Expired(now time.Time) bool {
+	return now.After(r.Expires)
+}
+
+type Registry interface {
+	NextID() (uint, error)
+	// Claim adds the room or takes it over if its lease has expired.
+	Claim(room Room) error
+	Renew(owner string, expires time.Time) error
+	Lookup(id uint) (Room, error)
+	LookupCode(code string) (Room, error)
+	Expired(now time.Time) ([]Room, error)
+	Release(id uint, owner string) error
+	// Abandon expires the leases of the owner, so other instances can take
+	// over its rooms straight away.
+	Abandon(owner string) error
+}
+
+type Bus interface {
+	Publish(topic string, payload []byte) error
+	Subscribe(topic string) (*Subscription, error)
+}
+
+// Subscription delivers the messages published on a topic. C is closed when
+// the subscription ends, either by Close or because the subscriber could not
+// keep up or the bus lost messages.
+type Subscription struct {
+	C     <-chan []byte
+	c     chan []byte
+	topic string
+	hub   *hub
+	once  *sync.Once
+}
+
+func (s *Subscription) Close() {
+	s.once.Do(func() {
+		s.hub.remove(s)
+	})
+}
+
+func NewID() string {
+	value := make([]byte, 8)
+	if _, err := rand.Read(value); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(value)
+}
+
+type hub struct {
+	topics  map[string]map[*Subscription]struct{}
+	mutex   *sync.Mutex
+	onEmpty func(topic string)
+}
+
+func newHub(onEmpty func(topic string)) *hub {
+	return &hub{
+		topics:  make(map[string]map[*Subscription]struct{}),
+		mutex:   &sync.Mutex{},
+		onEmpty: onEmpty,
+	}
+}
+
+func (h *hub) subscribe(topic string) (*Subscription, bool) {
+	c := make(chan []byte, subscriptionBufferSize)
+	sub := &Subscription{C: c, c: c, topic: topic, hub: h, once: &sync.Once{}}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	subs, ok := h.topics[topic]
+	if !ok {
+		subs = make(map[*Subscription]struct{})
+		h.topics[topic] = subs
+	}
+	subs[sub] = struct{}{}
+	return sub, !ok
+}
+
+func (h *hub) remove(sub *Subscription) {
+	h.mutex.Lock()
+	subs := h.topics[sub.topic]
+	delete(subs, sub)
+	close(sub.c)
+	empty := len(subs) == 0
+	if empty {
+		delete(h.topics, sub.topic)
+	}
+	h.mutex.Unlock()
+
+	if empty && h.onEmpty != nil {
+		h.onEmpty(sub.topic)
+	}
+}
+
+func (h *hub) empty(topic string) bool {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return len(h.topics[topic]) == 0
+}
+
+func (h *hub) dispatch(topic string, payload []byte) {
+	slow := make([]*Subscription, 0)
+	h.mutex.Lock()
+	for sub := range h.topics[topic] {
+		select {
+		case sub.c <- payload:
+		default:
+			slow = append(slow, sub)
+		}
+	}
+	h.mutex.Unlock()
+
+	for _, sub := range slow {
+		sub.Close()
+	}
+}
+
+func (h *hub) closeAll() {
+	h.mutex.Lock()
+	subs := make([]*Subscription, 0)
+	for _, topic := range h.topics {
+		for sub := range topic {
+			subs = append(subs, sub)
+		}
+	}
+	h.mutex.Unlock()
+
+	for _, sub := range subs {
+		sub.Close()
+	}
+}
@@ -0,0 +1,135 @@
+package cluster
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Local keeps the registry and the bus in memory. It is enough for a single
+// instance and for several servers in one process.
+type Local struct {
+	*hub
+	rooms  map[uint]Room
+	lastID uint
+	mutex  *sync.Mutex
+}
+
+func NewLocal() *Local {
+	return &Local{
+		hub:   newHub(nil),
+		rooms: make(map[uint]Room),
+		mutex: &sync.Mutex{},
+	}
+}
+
+func (l *Local) NextID() (uint, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.lastID++
+	return l.lastID, nil
+}
+
+func (l *Local) Claim(room Room) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if existing, ok := l.rooms[room.ID]; ok && existing.Owner != room.Owner && !existing.Expired(time.Now()) {
+		return ErrRoomTaken
+	}
+	for id, other := range l.rooms {
+		if id != room.ID && other.Code == room.Code {
+			return ErrCodeTaken
+		}
+	}
+	if room.ID > l.lastID {
+		l.lastID = room.ID
+	}
+	l.rooms[room.ID] = room
+	return nil
+}
+
+func (l *Local) Renew(owner string, expires time.Time) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for id, room := range l.rooms {
+		if room.Owner == owner {
+			room.Expires = expires
+			l.rooms[id] = room
+		}
+	}
+	return nil
+}
+
+func (l *Local) Lookup(id uint) (Room, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	room, ok := l.rooms[id]
+	if !ok {
+		return Room{}, ErrNoRoom
+	}
+	return room, nil
+}
+
+func (l *Local) LookupCode(code string) (Room, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for _, room := range l.rooms {
+		if room.Code == code {
+			return room, nil
+		}
+	}
+	return Room{}, ErrNoRoom
+}
+
+func (l *Local) Expired(now time.Time) ([]Room, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	rooms := make([]Room, 0)
+	for _, room := range l.rooms {
+		if room.Expired(now) {
+			rooms = append(rooms, room)
+		}
+	}
+	sort.Slice(rooms, func(i, j int) bool {
+		return rooms[i].ID < rooms[j].ID
+	})
+	return rooms, nil
+}
+
+func (l *Local) Release(id uint, owner string) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if room, ok := l.rooms[id]; ok && room.Owner == owner {
+		delete(l.rooms, id)
+	}
+	return nil
+}
+
+func (l *Local) Abandon(owner string) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	now := time.Now()
+	for id, room := range l.rooms {
+		if room.Owner == owner {
+			room.Expires = now
+			l.rooms[id] = room
+		}
+	}
+	return nil
+}
+
+func (l *Local) Publish(topic string, payload []byte) error {
+	l.dispatch(topic, append([]byte(nil), payload...))
+	return nil
+}
+
+func (l *Local) Subscribe(topic string) (*Subscription, error) {
+	sub, _ := l.subscribe(topic)
+	return sub, nil
+}
+
+var (
+	_ Registry = &Local{}
+	_ Bus      = &Local{}
+)
@@ -0,0 +1,197 @@
+package cluster
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/bitterfly/go-chaos/hatgame/schema"
+	"github.com/jackc/pgconn"
+	"github.com/lib/pq"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	minReconnect = 1 * time.Second
+	maxReconnect = 30 * time.Second
+	// NOTIFY payloads have to be shorter than 8000 bytes.
+	maxPayload = 7999
+
+	uniqueViolation = "23505"
+)
+
+// Postgres keeps the registry in the rooms table and uses LISTEN/NOTIFY as
+// the bus, so every instance has to use the same database.
+type Postgres struct {
+	*hub
+	db       *gorm.DB
+	listener *pq.Listener
+	mutex    *sync.Mutex
+}
+
+func NewPostgres(db *gorm.DB, dsn string) *Postgres {
+	p := &Postgres{
+		db:    db,
+		mutex: &sync.Mutex{},
+	}
+	p.hub = newHub(p.unlisten)
+	p.listener = pq.NewListener(dsn, minReconnect, maxReconnect, func(event pq.ListenerEventType, err error) {
+		if err != nil {
+			slog.Warn("Listener connection problem", "error", err)
+		}
+	})
+	go p.receive()
+	return p
+}
+
+func (p *Postgres) receive() {
+	for notification := range p.listener.Notify {
+		if notification == nil {
+			// Notifications sent while the connection was down are lost, so
+			// subscribers have to start over.
+			slog.Warn("Listener reconnected, closing all subscriptions")
+			p.closeAll()
+			continue
+		}
+		p.dispatch(notification.Channel, []byte(notification.Extra))
+	}
+}
+
+func (p *Postgres) Close() error {
+	return p.listener.Close()
+}
+
+func (p *Postgres) NextID() (uint, error) {
+	var id uint
+	if err := p.db.Raw("select nextval('room_ids')").Scan(&id).Error; err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+// Claim relies on the unique index of the codes, so that two instances can
+// not both get the same code.
+func (p *Postgres) Claim(room Room) error {
+	result := p.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"code", "owner", "expires_at", "updated_at"}),
+		Where: clause.Where{Exprs: []clause.Expression{
+			clause.Expr{SQL: "rooms.owner = excluded.owner OR rooms.expires_at < now()"},
+		}},
+	}).Create(&schema.Room{
+		ID:        room.ID,
+		Code:      room.Code,
+		Owner:     room.Owner,
+		Players:   room.Players,
+		Words:     room.Words,
+		Timer:     room.Timer,
+		ExpiresAt: room.Expires,
+	})
+	if result.Error != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(result.Error, &pgErr) && pgErr.Code == uniqueViolation && pgErr.ConstraintName == "idx_rooms_code" {
+			return ErrCodeTaken
+		}
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrRoomTaken
+	}
+	return nil
+}
+
+func (p *Postgres) Renew(owner string, expires time.Time) error {
+	return p.db.Model(&schema.Room{}).Where("owner = ?", owner).Update("expires_at", expires).Error
+}
+
+func (p *Postgres) Lookup(id uint) (Room, error) {
+	return p.find("id = ?", id)
+}
+
+func (p *Postgres) LookupCode(code string) (Room, error) {
+	return p.find("code = ?", code)
+}
+
+func (p *Postgres) find(query string, args ...interface{}) (Room, error) {
+	var row schema.Room
+	if err := p.db.Where(query, args...).First(&row).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return Room{}, ErrNoRoom
+		}
+		return Room{}, err
+	}
+	return fromRow(row), nil
+}
+
+func (p *Postgres) Expired(now time.Time) ([]Room, error) {
+	var rows []schema.Room
+	if err := p.db.Where("expires_at < ?", now).Order("id").Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	rooms := make([]Room, 0, len(rows))
+	for _, row := range rows {
+		rooms = append(rooms, fromRow(row))
+	}
+	return rooms, nil
+}
+
+func (p *Postgres) Release(id uint, owner string) error {
+	return p.db.Where("id = ? AND owner = ?", id, owner).Delete(&schema.Room{}).Error
+}
+
+func (p *Postgres) Abandon(owner string) error {
+	return p.db.Model(&schema.Room{}).Where("owner = ?", owner).Update("expires_at", time.Now()).Error
+}
+
+func fromRow(row schema.Room) Room {
+	return Room{
+		ID:      row.ID,
+		Code:    row.Code,
+		Owner:   row.Owner,
+		Players: row.Players,
+		Words:   row.Words,
+		Timer:   row.Timer,
+		Expires: row.ExpiresAt,
+	}
+}
+
+func (p *Postgres) Publish(topic string, payload []byte) error {
+	if len(payload) > maxPayload {
+		return fmt.Errorf("message of %d bytes is too long for NOTIFY", len(payload))
+	}
+	return p.db.Exec("select pg_notify(?, ?)", topic, string(payload)).Error
+}
+
+func (p *Postgres) Subscribe(topic string) (*Subscription, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	sub, first := p.subscribe(topic)
+	if first {
+		if err := p.listener.Listen(topic); err != nil && err != pq.ErrChannelAlreadyOpen {
+			go sub.Close()
+			return nil, err
+		}
+	}
+	return sub, nil
+}
+
+func (p *Postgres) unlisten(topic string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if !p.empty(topic) {
+		return
+	}
+	if err := p.listener.Unlisten(topic); err != nil && err != pq.ErrChannelNotOpen {
+		slog.Warn("Could not stop listening", "topic", topic, "error", err)
+	}
+}
+
+var (
+	_ Registry = &Postgres{}
+	_ Bus      = &Postgres{}
+)
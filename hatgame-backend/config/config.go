@@ -0,0 +1,665 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Duration struct {
+	time.Duration
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"15m\": %w", err)
+	}
+	duration, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = duration
+	return nil
+}
+
+// Rate allows Count events per Per, written as "10/1m". A zero Count turns the
+// limit off.
+type Rate struct {
+	Count int
+	Per   time.Duration
+}
+
+func ParseRate(value string) (Rate, error) {
+	count, per, ok := strings.Cut(value, "/")
+	if !ok {
+		return Rate{}, fmt.Errorf("%q is not a rate like 10/1m", value)
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(count))
+	if err != nil {
+		return Rate{}, fmt.Errorf("%q is not a rate like 10/1m", value)
+	}
+	d, err := time.ParseDuration(strings.TrimSpace(per))
+	if err != nil {
+		return Rate{}, fmt.Errorf("%q is not a rate like 10/1m: %w", value, err)
+	}
+	return Rate{Count: n, Per: d}, nil
+}
+
+func (r Rate) String() string {
+	return fmt.Sprintf("%d/%s", r.Count, r.Per)
+}
+
+func (r Rate) MarshalJSON() ([]byte, error) {
+	return json.Marshal(r.String())
+}
+
+func (r *Rate) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("rate must be a string like \"10/1m\": %w", err)
+	}
+	rate, err := ParseRate(s)
+	if err != nil {
+		return err
+	}
+	*r = rate
+	return nil
+}
+
+type Database struct {
+	DSN    string `json:"dsn"`
+	File   string `json:"file"`
+	Memory bool   `json:"memory"`
+}
+
+type Games struct {
+	MaxPlayers int `json:"maxPlayers"`
+	MaxWords   int `json:"maxWords"`
+	MinTimer   int `json:"minTimer"`
+	MaxTimer   int `json:"maxTimer"`
+	MaxRunning int `json:"maxRunning"`
+}
+
+type Cluster struct {
+	Instance string   `json:"instance"`
+	Bus      string   `json:"bus"`
+	Lease    Duration `json:"lease"`
+}
+
+type Limits struct {
+	Login        Rate     `json:"login"`
+	Register     Rate     `json:"register"`
+	LockoutAfter int      `json:"lockoutAfter"`
+	Lockout      Duration `json:"lockout"`
+	MaxLockout   Duration `json:"maxLockout"`
+	Messages     Rate     `json:"messages"`
+}
+
+type Passwords struct {
+	MinLength     int  `json:"minLength"`
+	RequireLetter bool `json:"requireLetter"`
+	RequireDigit  bool `json:"requireDigit"`
+	RequireSymbol bool `json:"requireSymbol"`
+}
+
+// MaxPasswordLength is the most bcrypt hashes, in bytes.
+const MaxPasswordLength = 72
+
+type Config struct {
+	Listen          string    `json:"listen"`
+	Database        Database  `json:"database"`
+	JWTSecret       string    `json:"jwtSecret"`
+	KeyFile         string    `json:"keyFile"`
+	TokenLifetime   Duration  `json:"tokenLifetime"`
+	RefreshLifetime Duration  `json:"refreshLifetime"`
+	AllowedOrigins  []string  `json:"allowedOrigins"`
+	Games           Games     `json:"games"`
+	LogLevel        string    `json:"logLevel"`
+	LogFormat       string    `json:"logFormat"`
+	ShutdownTimeout Duration  `json:"shutdownTimeout"`
+	Cluster         Cluster   `json:"cluster"`
+	MetricsListen   string    `json:"metricsListen"`
+	Admins          []string  `json:"admins"`
+	Limits          Limits    `json:"limits"`
+	TrustedProxies  []string  `json:"trustedProxies"`
+	Passwords       Passwords `json:"passwords"`
+}
+
+const envPrefix = "HATGAME_"
+
+var LogLevels = []string{"debug", "info", "warn", "error"}
+
+var LogFormats = []string{"text", "json"}
+
+var Buses = []string{"local", "postgres"}
+
+func Default() Config {
+	return Config{
+		Listen: "localhost:8080",
+		Database: Database{
+			File: "psqlInfo.json",
+		},
+		KeyFile:         "jwtKeys.json",
+		TokenLifetime:   Duration{15 * time.Minute},
+		RefreshLifetime: Duration{30 * 24 * time.Hour},
+		AllowedOrigins:  []string{},
+		Games: Games{
+			MaxPlayers: 20,
+			MaxWords:   20,
+			MinTimer:   10,
+			MaxTimer:   300,
+			MaxRunning: 100,
+		},
+		LogLevel:        "info",
+		LogFormat:       "text",
+		ShutdownTimeout: Duration{60 * time.Second},
+		MetricsListen:   "localhost:9100",
+		Admins:          []string{},
+		Limits: Limits{
+			Login:        Rate{Count: 10, Per: time.Minute},
+			Register:     Rate{Count: 5, Per: time.Hour},
+			LockoutAfter: 5,
+			Lockout:      Duration{time.Minute},
+			MaxLockout:   Duration{time.Hour},
+			Messages:     Rate{Count: 20, Per: time.Second},
+		},
+		TrustedProxies: []string{},
+		Passwords: Passwords{
+			MinLength: 8,
+		},
+		Cluster: Cluster{
+			Bus:   "local",
+			Lease: Duration{30 * time.Second},
+		},
+	}
+}
+
+type option struct {
+	name   string
+	usage  string
+	isBool bool
+	set    func(c *Config, value string) error
+}
+
+func setString(field func(c *Config) *string) func(*Config, string) error {
+	return func(c *Config, value string) error {
+		*field(c) = value
+		return nil
+	}
+}
+
+func setInt(field func(c *Config) *int) func(*Config, string) error {
+	return func(c *Config, value string) error {
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("%q is not a number", value)
+		}
+		*field(c) = n
+		return nil
+	}
+}
+
+func setDuration(field func(c *Config) *Duration) func(*Config, string) error {
+	return func(c *Config, value string) error {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		field(c).Duration = d
+		return nil
+	}
+}
+
+func setBool(field func(c *Config) *bool) func(*Config, string) error {
+	return func(c *Config, value string) error {
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("%q is not a boolean", value)
+		}
+		*field(c) = b
+		return nil
+	}
+}
+
+func setRate(field func(c *Config) *Rate) func(*Config, string) error {
+	return func(c *Config, value string) error {
+		rate, err := ParseRate(value)
+		if err != nil {
+			return err
+		}
+		*field(c) = rate
+		return nil
+	}
+}
+
+func setList(field func(c *Config) *[]string) func(*Config, string) error {
+	return func(c *Config, value string) error {
+		list := []string{}
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		*field(c) = list
+		return nil
+	}
+}
+
+var options = []option{
+	{
+		name:  "listen",
+		usage: "`address` to listen on",
+		set:   setString(func(c *Config) *string { return &c.Listen }),
+	},
+	{
+		name:  "db-dsn",
+		usage: "postgres connection `string`, takes precedence over -db-file",
+		set:   setString(func(c *Config) *string { return &c.Database.DSN }),
+	},
+	{
+		name:  "db-file",
+		usage: "JSON `file` with the postgres connection settings",
+		set:   setString(func(c *Config) *string { return &c.Database.File }),
+	},
+	{
+		name:   "memory",
+		usage:  "keep users and games in memory instead of postgres",
+		isBool: true,
+		set: func(c *Config, value string) error {
+			memory, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("%q is not a boolean", value)
+			}
+			c.Database.Memory = memory
+			return nil
+		},
+	},
+	{
+		name:  "jwt-secret",
+		usage: "single `secret` used to sign session tokens instead of the key file",
+		set:   setString(func(c *Config) *string { return &c.JWTSecret }),
+	},
+	{
+		name:  "key-file",
+		usage: "`file` with the session token signing keys, created if missing",
+		set:   setString(func(c *Config) *string { return &c.KeyFile }),
+	},
+	{
+		name:  "token-lifetime",
+		usage: "how long session tokens are valid (`duration`, e.g. 15m)",
+		set:   setDuration(func(c *Config) *Duration { return &c.TokenLifetime }),
+	},
+	{
+		name:  "refresh-lifetime",
+		usage: "how long a session can be refreshed without logging in again (`duration`)",
+		set:   setDuration(func(c *Config) *Duration { return &c.RefreshLifetime }),
+	},
+	{
+		name:  "allowed-origins",
+		usage: "comma separated `origins` allowed to call the API from a browser, * for any",
+		set: func(c *Config, value string) error {
+			c.AllowedOrigins = []string{}
+			for _, origin := range strings.Split(value, ",") {
+				if origin = strings.TrimSpace(origin); origin != "" {
+					c.AllowedOrigins = append(c.AllowedOrigins, origin)
+				}
+			}
+			return nil
+		},
+	},
+	{
+		name:  "max-players",
+		usage: "largest `number` of players in a game",
+		set:   setInt(func(c *Config) *int { return &c.Games.MaxPlayers }),
+	},
+	{
+		name:  "max-words",
+		usage: "largest `number` of words per player",
+		set:   setInt(func(c *Config) *int { return &c.Games.MaxWords }),
+	},
+	{
+		name:  "min-timer",
+		usage: "shortest turn in `seconds`",
+		set:   setInt(func(c *Config) *int { return &c.Games.MinTimer }),
+	},
+	{
+		name:  "max-timer",
+		usage: "longest turn in `seconds`",
+		set:   setInt(func(c *Config) *int { return &c.Games.MaxTimer }),
+	},
+	{
+		name:  "max-games",
+		usage: "largest `number` of games running at the same time",
+		set:   setInt(func(c *Config) *int { return &c.Games.MaxRunning }),
+	},
+	{
+		name:  "log-level",
+		usage: "`level`, one of " + strings.Join(LogLevels, ", "),
+		set:   setString(func(c *Config) *string { return &c.LogLevel }),
+	},
+	{
+		name:  "log-format",
+		usage: "`format` of log lines, one of " + strings.Join(LogFormats, ", "),
+		set:   setString(func(c *Config) *string { return &c.LogFormat }),
+	},
+	{
+		name:  "shutdown-timeout",
+		usage: "how long to wait for running games on shutdown (`duration`)",
+		set:   setDuration(func(c *Config) *Duration { return &c.ShutdownTimeout }),
+	},
+	{
+		name:  "metrics-listen",
+		usage: "`address` to serve /metrics on, empty to turn metrics off",
+		set:   setString(func(c *Config) *string { return &c.MetricsListen }),
+	},
+	{
+		name:  "admins",
+		usage: "comma separated `emails` of the users allowed to use the admin API",
+		set: func(c *Config, value string) error {
+			c.Admins = []string{}
+			for _, email := range strings.Split(value, ",") {
+				if email = strings.TrimSpace(email); email != "" {
+					c.Admins = append(c.Admins, email)
+				}
+			}
+			return nil
+		},
+	},
+	{
+		name:  "login-limit",
+		usage: "login attempts allowed from one address (`rate`, e.g. 10/1m)",
+		set:   setRate(func(c *Config) *Rate { return &c.Limits.Login }),
+	},
+	{
+		name:  "register-limit",
+		usage: "registrations allowed from one address (`rate`, e.g. 5/1h)",
+		set:   setRate(func(c *Config) *Rate { return &c.Limits.Register }),
+	},
+	{
+		name:  "lockout-after",
+		usage: "failed logins of an account or address before it is locked out (`number`)",
+		set:   setInt(func(c *Config) *int { return &c.Limits.LockoutAfter }),
+	},
+	{
+		name:  "lockout",
+		usage: "first lockout, doubled for every further failure (`duration`)",
+		set:   setDuration(func(c *Config) *Duration { return &c.Limits.Lockout }),
+	},
+	{
+		name:  "max-lockout",
+		usage: "longest lockout (`duration`)",
+		set:   setDuration(func(c *Config) *Duration { return &c.Limits.MaxLockout }),
+	},
+	{
+		name:  "message-limit",
+		usage: "game messages allowed from one player (`rate`, e.g. 20/1s)",
+		set:   setRate(func(c *Config) *Rate { return &c.Limits.Messages }),
+	},
+	{
+		name:  "trusted-proxies",
+		usage: "comma separated `addresses` of proxies whose X-Forwarded-For is believed",
+		set:   setList(func(c *Config) *[]string { return &c.TrustedProxies }),
+	},
+	{
+		name:  "password-min-length",
+		usage: "shortest allowed password (`characters`)",
+		set:   setInt(func(c *Config) *int { return &c.Passwords.MinLength }),
+	},
+	{
+		name:   "password-require-letter",
+		usage:  "passwords have to contain a letter",
+		isBool: true,
+		set:    setBool(func(c *Config) *bool { return &c.Passwords.RequireLetter }),
+	},
+	{
+		name:   "password-require-digit",
+		usage:  "passwords have to contain a digit",
+		isBool: true,
+		set:    setBool(func(c *Config) *bool { return &c.Passwords.RequireDigit }),
+	},
+	{
+		name:   "password-require-symbol",
+		usage:  "passwords have to contain a character that is not a letter or a digit",
+		isBool: true,
+		set:    setBool(func(c *Config) *bool { return &c.Passwords.RequireSymbol }),
+	},
+	{
+		name:  "instance",
+		usage: "`name` of this instance in the room registry, random if empty",
+		set:   setString(func(c *Config) *string { return &c.Cluster.Instance }),
+	},
+	{
+		name:  "bus",
+		usage: "`kind` of room registry and message bus, one of " + strings.Join(Buses, ", "),
+		set:   setString(func(c *Config) *string { return &c.Cluster.Bus }),
+	},
+	{
+		name:  "room-lease",
+		usage: "how long a room stays with an instance that stopped renewing it (`duration`)",
+		set:   setDuration(func(c *Config) *Duration { return &c.Cluster.Lease }),
+	},
+}
+
+func envName(name string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+type flagValue struct {
+	option option
+	value  string
+}
+
+func (f *flagValue) String() string {
+	return f.value
+}
+
+func (f *flagValue) Set(value string) error {
+	f.value = value
+	return nil
+}
+
+func (f *flagValue) IsBoolFlag() bool {
+	return f.option.isBool
+}
+
+func Load(name string, args []string) (Config, []string, error) {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	configFile := flags.String("config", os.Getenv(envPrefix+"CONFIG"), "JSON config `file` (env "+envPrefix+"CONFIG)")
+	for _, o := range options {
+		flags.Var(&flagValue{option: o}, o.name, fmt.Sprintf("%s (env %s)", o.usage, envName(o.name)))
+	}
+	if err := flags.Parse(args); err != nil {
+		return Config{}, nil, err
+	}
+
+	config := Default()
+	if *configFile != "" {
+		if err := config.loadFile(*configFile); err != nil {
+			return Config{}, nil, err
+		}
+	}
+
+	for _, o := range options {
+		value, ok := os.LookupEnv(envName(o.name))
+		if !ok {
+			continue
+		}
+		if err := o.set(&config, value); err != nil {
+			return Config{}, nil, fmt.Errorf("%s: %w", envName(o.name), err)
+		}
+	}
+
+	var err error
+	flags.Visit(func(f *flag.Flag) {
+		value, ok := f.Value.(*flagValue)
+		if !ok || err != nil {
+			return
+		}
+		if serr := value.option.set(&config, value.value); serr != nil {
+			err = fmt.Errorf("-%s: %w", f.Name, serr)
+		}
+	})
+	if err != nil {
+		return Config{}, nil, err
+	}
+
+	if err := config.Validate(); err != nil {
+		return Config{}, nil, err
+	}
+	return config, flags.Args(), nil
+}
+
+func (c *Config) loadFile(filename string) error {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return fmt.Errorf("could not read config file: %w", err)
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(c); err != nil {
+		return fmt.Errorf("could not parse config file %s: %w", filename, err)
+	}
+	return nil
+}
+
+func (c Config) Validate() error {
+	problems := make([]string, 0)
+	problem := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	if _, _, err := net.SplitHostPort(c.Listen); err != nil {
+		problem("listen: %q is not a host:port address", c.Listen)
+	}
+	if !c.Database.Memory && c.Database.DSN == "" && c.Database.File == "" {
+		problem("database: one of dsn, file or memory has to be set")
+	}
+	if c.JWTSecret != "" && len(c.JWTSecret) < 32 {
+		problem("jwtSecret: has to be at least 32 characters long")
+	}
+	if c.JWTSecret == "" && c.KeyFile == "" {
+		problem("keyFile: has to be set when there is no jwtSecret")
+	}
+	if c.TokenLifetime.Duration <= 0 {
+		problem("tokenLifetime: has to be positive")
+	}
+	if c.RefreshLifetime.Duration < c.TokenLifetime.Duration {
+		problem("refreshLifetime: has to be at least tokenLifetime")
+	}
+	for _, origin := range c.AllowedOrigins {
+		if origin == "*" {
+			continue
+		}
+		u, err := url.Parse(origin)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || (u.Path != "" && u.Path != "/") {
+			problem("allowedOrigins: %q is not an origin like https://example.com", origin)
+		}
+	}
+	if c.Games.MaxPlayers < 2 {
+		problem("games.maxPlayers: has to be at least 2")
+	}
+	if c.Games.MaxWords < 1 {
+		problem("games.maxWords: has to be at least 1")
+	}
+	if c.Games.MinTimer < 1 {
+		problem("games.minTimer: has to be at least 1 second")
+	}
+	if c.Games.MaxTimer < c.Games.MinTimer {
+		problem("games.maxTimer: has to be at least games.minTimer")
+	}
+	if c.Games.MaxRunning < 1 {
+		problem("games.maxRunning: has to be at least 1")
+	}
+	if !contains(LogLevels, c.LogLevel) {
+		problem("logLevel: %q is not one of %s", c.LogLevel, strings.Join(LogLevels, ", "))
+	}
+	if !contains(LogFormats, c.LogFormat) {
+		problem("logFormat: %q is not one of %s", c.LogFormat, strings.Join(LogFormats, ", "))
+	}
+	if c.ShutdownTimeout.Duration < 0 {
+		problem("shutdownTimeout: can not be negative")
+	}
+	if c.MetricsListen != "" {
+		if _, _, err := net.SplitHostPort(c.MetricsListen); err != nil {
+			problem("metricsListen: %q is not a host:port address", c.MetricsListen)
+		} else if c.MetricsListen == c.Listen {
+			problem("metricsListen: has to be different from listen")
+		}
+	}
+	for _, email := range c.Admins {
+		if !strings.Contains(email, "@") {
+			problem("admins: %q is not an email address", email)
+		}
+	}
+	rates := []struct {
+		name string
+		rate Rate
+	}{
+		{"limits.login", c.Limits.Login},
+		{"limits.register", c.Limits.Register},
+		{"limits.messages", c.Limits.Messages},
+	}
+	for _, r := range rates {
+		if r.rate.Count < 0 {
+			problem("%s: count can not be negative", r.name)
+		}
+		if r.rate.Count > 0 && r.rate.Per <= 0 {
+			problem("%s: period has to be positive", r.name)
+		}
+	}
+	if c.Limits.LockoutAfter < 0 {
+		problem("limits.lockoutAfter: can not be negative")
+	}
+	if c.Limits.LockoutAfter > 0 && c.Limits.Lockout.Duration <= 0 {
+		problem("limits.lockout: has to be positive")
+	}
+	if c.Limits.MaxLockout.Duration < c.Limits.Lockout.Duration {
+		problem("limits.maxLockout: has to be at least limits.lockout")
+	}
+	for _, proxy := range c.TrustedProxies {
+		if net.ParseIP(proxy) == nil {
+			if _, _, err := net.ParseCIDR(proxy); err != nil {
+				problem("trustedProxies: %q is not an address or a network like 10.0.0.0/8", proxy)
+			}
+		}
+	}
+	if c.Passwords.MinLength < 1 || c.Passwords.MinLength > MaxPasswordLength {
+		problem("passwords.minLength: has to be between 1 and %d", MaxPasswordLength)
+	}
+	if !contains(Buses, c.Cluster.Bus) {
+		problem("cluster.bus: %q is not one of %s", c.Cluster.Bus, strings.Join(Buses, ", "))
+	}
+	if c.Cluster.Bus == "postgres" && c.Database.Memory {
+		problem("cluster.bus: postgres needs a database, it can not be used with memory")
+	}
+	if c.Cluster.Lease.Duration < 3*time.Second {
+		problem("cluster.lease: has to be at least 3s")
+	}
+
+	if len(problems) > 0 {
+		return errors.New("invalid configuration:\n  " + strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,382 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// clearEnv unsets every HATGAME_ variable for the duration of the test.
+func clearEnv(t *testing.T) {
+	t.Helper()
+	for _, kv := range os.Environ() {
+		name, _, _ := strings.Cut(kv, "=")
+		if strings.HasPrefix(name, envPrefix) {
+			t.Setenv(name, "")
+			os.Unsetenv(name)
+		}
+	}
+}
+
+func writeFile(t *testing.T, content string) string {
+	t.Helper()
+	filename := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(filename, []byte(content), 0o600); err != nil {
+		t.Fatalf("could not write config file: %s", err)
+	}
+	return filename
+}
+
+func TestLoadDefaults(t *testing.T) {
+	clearEnv(t)
+	config, rest, err := Load("hat", []string{"extra"})
+	if err != nil {
+		t.Fatalf("could not load: %s", err)
+	}
+	if !reflect.DeepEqual(config, Default()) {
+		t.Errorf("got %+v, want the defaults %+v", config, Default())
+	}
+	if !reflect.DeepEqual(rest, []string{"extra"}) {
+		t.Errorf("got arguments %v, want [extra]", rest)
+	}
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	file := writeFile(t, `{
+		"listen": "file:1",
+		"logLevel": "warn",
+		"tokenLifetime": "20m",
+		"games": {"maxPlayers": 10, "maxWords": 5},
+		"limits": {"login": "3/1m"}
+	}`)
+
+	for _, test := range []struct {
+		name  string
+		env   map[string]string
+		args  []string
+		check func(t *testing.T, c Config)
+	}{
+		{
+			name: "file over defaults",
+			args: []string{"-config", file},
+			check: func(t *testing.T, c Config) {
+				if c.Listen != "file:1" || c.LogLevel != "warn" || c.TokenLifetime.Duration != 20*time.Minute {
+					t.Errorf("file values were not used: %+v", c)
+				}
+				if c.Games.MaxPlayers != 10 || c.Games.MaxWords != 5 || c.Games.MaxTimer != Default().Games.MaxTimer {
+					t.Errorf("got games %+v", c.Games)
+				}
+				if c.Limits.Login != (Rate{Count: 3, Per: time.Minute}) || c.Limits.Register != Default().Limits.Register {
+					t.Errorf("got limits %+v", c.Limits)
+				}
+			},
+		},
+		{
+			name: "config file from the environment",
+			env:  map[string]string{"HATGAME_CONFIG": file},
+			check: func(t *testing.T, c Config) {
+				if c.Listen != "file:1" {
+					t.Errorf("got listen %q, want file:1", c.Listen)
+				}
+			},
+		},
+		{
+			name: "environment over file",
+			env:  map[string]string{"HATGAME_LISTEN": "env:1", "HATGAME_MAX_PLAYERS": "7", "HATGAME_LOGIN_LIMIT": "4/1s"},
+			args: []string{"-config", file},
+			check: func(t *testing.T, c Config) {
+				if c.Listen != "env:1" || c.Games.MaxPlayers != 7 || c.Limits.Login != (Rate{Count: 4, Per: time.Second}) {
+					t.Errorf("environment values were not used: %+v", c)
+				}
+				if c.LogLevel != "warn" || c.Games.MaxWords != 5 {
+					t.Errorf("file values were lost: %+v", c)
+				}
+			},
+		},
+		{
+			name: "flags over environment",
+			env:  map[string]string{"HATGAME_LISTEN": "env:1", "HATGAME_MAX_PLAYERS": "7"},
+			args: []string{"-config", file, "-listen", "flag:1"},
+			check: func(t *testing.T, c Config) {
+				if c.Listen != "flag:1" {
+					t.Errorf("got listen %q, want flag:1", c.Listen)
+				}
+				if c.Games.MaxPlayers != 7 || c.LogLevel != "warn" {
+					t.Errorf("environment or file values were lost: %+v", c)
+				}
+			},
+		},
+		{
+			name: "lists and booleans",
+			env:  map[string]string{"HATGAME_ADMINS": " a@example.com, ,b@example.com", "HATGAME_PASSWORD_REQUIRE_DIGIT": "true"},
+			args: []string{"-memory", "-trusted-proxies", "10.0.0.0/8,::1"},
+			check: func(t *testing.T, c Config) {
+				if !reflect.DeepEqual(c.Admins, []string{"a@example.com", "b@example.com"}) {
+					t.Errorf("got admins %q", c.Admins)
+				}
+				if !reflect.DeepEqual(c.TrustedProxies, []string{"10.0.0.0/8", "::1"}) {
+					t.Errorf("got trusted proxies %q", c.TrustedProxies)
+				}
+				if !c.Database.Memory || !c.Passwords.RequireDigit {
+					t.Errorf("booleans were not set: %+v %+v", c.Database, c.Passwords)
+				}
+			},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			clearEnv(t)
+			for name, value := range test.env {
+				t.Setenv(name, value)
+			}
+			config, _, err := Load("hat", test.args)
+			if err != nil {
+				t.Fatalf("could not load: %s", err)
+			}
+			test.check(t, config)
+		})
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		file string
+		env  map[string]string
+		args []string
+		want string
+	}{
+		{
+			name: "missing file",
+			args: []string{"-config", filepath.Join(os.TempDir(), "does-not-exist.json")},
+			want: "could not read config file",
+		},
+		{
+			name: "unknown field",
+			file: `{"listen": "localhost:1", "colour": "red"}`,
+			want: `unknown field "colour"`,
+		},
+		{
+			name: "bad duration in the file",
+			file: `{"tokenLifetime": 15}`,
+			want: "duration must be a string",
+		},
+		{
+			name: "bad number in the environment",
+			env:  map[string]string{"HATGAME_MAX_WORDS": "many"},
+			want: "HATGAME_MAX_WORDS",
+		},
+		{
+			name: "bad rate flag",
+			args: []string{"-login-limit", "10 per minute"},
+			want: "-login-limit",
+		},
+		{
+			name: "unknown flag",
+			args: []string{"-colour", "red"},
+			want: "-colour",
+		},
+		{
+			name: "invalid value",
+			args: []string{"-log-level", "loud"},
+			want: `logLevel: "loud"`,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			clearEnv(t)
+			for name, value := range test.env {
+				t.Setenv(name, value)
+			}
+			args := test.args
+			if test.file != "" {
+				args = append([]string{"-config", writeFile(t, test.file)}, args...)
+			}
+			_, _, err := Load("hat", args)
+			if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Errorf("got error %v, want one containing %q", err, test.want)
+			}
+		})
+	}
+}
+
+func TestParseRate(t *testing.T) {
+	for _, test := range []struct {
+		value string
+		want  Rate
+		err   bool
+	}{
+		{value: "10/1m", want: Rate{Count: 10, Per: time.Minute}},
+		{value: " 5 / 1h ", want: Rate{Count: 5, Per: time.Hour}},
+		{value: "0/1s", want: Rate{Count: 0, Per: time.Second}},
+		{value: "20/500ms", want: Rate{Count: 20, Per: 500 * time.Millisecond}},
+		{value: "10", err: true},
+		{value: "ten/1m", err: true},
+		{value: "10/minute", err: true},
+		{value: "10/", err: true},
+		{value: "", err: true},
+	} {
+		got, err := ParseRate(test.value)
+		if (err != nil) != test.err {
+			t.Errorf("%q: got error %v", test.value, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("%q: got %+v, want %+v", test.value, got, test.want)
+		}
+		if err == nil {
+			if again, _ := ParseRate(got.String()); again != got {
+				t.Errorf("%q: %s parses to %+v", test.value, got, again)
+			}
+		}
+	}
+}
+
+func TestRateJSON(t *testing.T) {
+	var r Rate
+	if err := r.UnmarshalJSON([]byte(`"3/2s"`)); err != nil || r != (Rate{Count: 3, Per: 2 * time.Second}) {
+		t.Errorf("got %+v and %v", r, err)
+	}
+	if err := r.UnmarshalJSON([]byte(`3`)); err == nil {
+		t.Error("a number was accepted as a rate")
+	}
+	data, err := Rate{Count: 3, Per: 2 * time.Second}.MarshalJSON()
+	if err != nil || string(data) != `"3/2s"` {
+		t.Errorf("got %s and %v", data, err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		change func(c *Config)
+		want   []string
+	}{
+		{
+			name:   "defaults",
+			change: func(c *Config) {},
+		},
+		{
+			name: "addresses",
+			change: func(c *Config) {
+				c.Listen = "localhost"
+				c.MetricsListen = "nowhere"
+			},
+			want: []string{"listen:", "metricsListen:"},
+		},
+		{
+			name:   "same metrics address",
+			change: func(c *Config) { c.MetricsListen = c.Listen },
+			want:   []string{"metricsListen: has to be different"},
+		},
+		{
+			name: "database",
+			change: func(c *Config) {
+				c.Database = Database{}
+			},
+			want: []string{"database:"},
+		},
+		{
+			name: "tokens",
+			change: func(c *Config) {
+				c.JWTSecret = "short"
+				c.TokenLifetime = Duration{time.Hour}
+				c.RefreshLifetime = Duration{time.Minute}
+			},
+			want: []string{"jwtSecret:", "refreshLifetime:"},
+		},
+		{
+			name: "no keys",
+			change: func(c *Config) {
+				c.KeyFile = ""
+			},
+			want: []string{"keyFile:"},
+		},
+		{
+			name: "origins",
+			change: func(c *Config) {
+				c.AllowedOrigins = []string{"*", "https://example.com", "example.com", "https://example.com/path"}
+			},
+			want: []string{`"example.com"`, `"https://example.com/path"`},
+		},
+		{
+			name: "games",
+			change: func(c *Config) {
+				c.Games = Games{MaxPlayers: 1, MaxWords: 0, MinTimer: 10, MaxTimer: 5, MaxRunning: 0}
+			},
+			want: []string{"games.maxPlayers:", "games.maxWords:", "games.maxTimer:", "games.maxRunning:"},
+		},
+		{
+			name: "logging",
+			change: func(c *Config) {
+				c.LogLevel = "loud"
+				c.LogFormat = "xml"
+			},
+			want: []string{"logLevel:", "logFormat:"},
+		},
+		{
+			name: "limits",
+			change: func(c *Config) {
+				c.Limits.Login = Rate{Count: -1, Per: time.Second}
+				c.Limits.Register = Rate{Count: 1}
+				c.Limits.Messages = Rate{}
+				c.Limits.LockoutAfter = 3
+				c.Limits.Lockout = Duration{}
+				c.Limits.MaxLockout = Duration{-time.Second}
+			},
+			want: []string{"limits.login: count", "limits.register: period", "limits.lockout:", "limits.maxLockout:"},
+		},
+		{
+			name: "admins and proxies",
+			change: func(c *Config) {
+				c.Admins = []string{"admin"}
+				c.TrustedProxies = []string{"10.0.0.1", "10.0.0.0/8", "proxy"}
+			},
+			want: []string{`admins: "admin"`, `trustedProxies: "proxy"`},
+		},
+		{
+			name:   "passwords",
+			change: func(c *Config) { c.Passwords.MinLength = MaxPasswordLength + 1 },
+			want:   []string{"passwords.minLength:"},
+		},
+		{
+			name: "cluster",
+			change: func(c *Config) {
+				c.Cluster.Bus = "postgres"
+				c.Database.Memory = true
+				c.Cluster.Lease = Duration{time.Second}
+			},
+			want: []string{"cluster.bus: postgres needs a database", "cluster.lease:"},
+		},
+		{
+			name:   "unknown bus",
+			change: func(c *Config) { c.Cluster.Bus = "carrier pigeon" },
+			want:   []string{`cluster.bus: "carrier pigeon"`},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			config := Default()
+			test.change(&config)
+			err := config.Validate()
+			if len(test.want) == 0 {
+				if err != nil {
+					t.Errorf("got %s", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("got no error, want %q", test.want)
+			}
+			lines := strings.Split(err.Error(), "\n")[1:]
+			if len(lines) != len(test.want) {
+				t.Errorf("got %d problems, want %d:\n%s", len(lines), len(test.want), err)
+			}
+			for _, want := range test.want {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("missing %q in:\n%s", want, err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,540 @@
+package database
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bitterfly/go-chaos/hatgame/game"
+	"github.com/bitterfly/go-chaos/hatgame/schema"
+	"github.com/bitterfly/go-chaos/hatgame/server/containers"
+	"github.com/bitterfly/go-chaos/hatgame/utils"
+	"gorm.io/gorm"
+)
+
+type memoryGame struct {
+	ID      uint
+	Players []uint
+	Result  []containers.Result
+}
+
+type Memory struct {
+	mutex      *sync.Mutex
+	users      map[uint]schema.User
+	lastUserID uint
+	lastGameID uint
+	sessions   map[uint]schema.Session
+	tickets    map[string]schema.Ticket
+	games      []memoryGame
+	dictionary map[string]map[uint]struct{}
+	removed    map[string]struct{}
+	snapshots  map[uint]game.Snapshot
+	events     map[string][]game.LogEntry
+	flags      []schema.Flag
+	audit      []schema.AuditEntry
+}
+
+func NewMemory() *Memory {
+	return &Memory{
+		mutex:      &sync.Mutex{},
+		users:      make(map[uint]schema.User),
+		sessions:   make(map[uint]schema.Session),
+		tickets:    make(map[string]schema.Ticket),
+		dictionary: make(map[string]map[uint]struct{}),
+		removed:    make(map[string]struct{}),
+		snapshots:  make(map[uint]game.Snapshot),
+		events:     make(map[string][]game.LogEntry),
+	}
+}
+
+func (m *Memory) Ready() *DatabaseError {
+	return nil
+}
+
+func (m *Memory) AddUser(user *schema.User) (uint, *DatabaseError) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for _, u := range m.users {
+		if strings.EqualFold(u.Email, user.Email) {
+			return 0, newConflictError(ErrEmailTaken)
+		}
+	}
+	if m.usernameTaken(0, user.Username) {
+		return 0, newConflictError(ErrUsernameTaken)
+	}
+
+	m.lastUserID++
+	user.ID = m.lastUserID
+	user.CreatedAt = time.Now()
+	user.UpdatedAt = user.CreatedAt
+	m.users[user.ID] = *user
+	return user.ID, nil
+}
+
+func (m *Memory) GetUserByID(id uint) (*schema.User, *DatabaseError) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	user, ok := m.users[id]
+	if !ok {
+		return &schema.User{}, newQueryError(gorm.ErrRecordNotFound)
+	}
+	return &user, nil
+}
+
+func (m *Memory) GetUserByEmail(email string) (*schema.User, *DatabaseError) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for _, user := range m.users {
+		if strings.EqualFold(user.Email, email) {
+			return &user, nil
+		}
+	}
+	return &schema.User{}, newQueryError(gorm.ErrRecordNotFound)
+}
+
+func (m *Memory) updateUser(id uint, update func(user *schema.User)) *DatabaseError {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	user, ok := m.users[id]
+	if !ok {
+		return nil
+	}
+	update(&user)
+	if m.usernameTaken(id, user.Username) {
+		return newConflictError(ErrUsernameTaken)
+	}
+	user.UpdatedAt = time.Now()
+	m.users[id] = user
+	return nil
+}
+
+// usernameTaken tells whether a user other than id has the username, ignoring
+// case like the unique index of postgres.
+func (m *Memory) usernameTaken(id uint, username string) bool {
+	for _, u := range m.users {
+		if u.ID != id && strings.EqualFold(u.Username, username) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *Memory) UpdateUser(id uint, password []byte, username string) *DatabaseError {
+	return m.updateUser(id, func(user *schema.User) {
+		user.Password = password
+		user.Username = username
+	})
+}
+
+func (m *Memory) UpdateUserPassword(id uint, password []byte) *DatabaseError {
+	return m.updateUser(id, func(user *schema.User) {
+		user.Password = password
+	})
+}
+
+func (m *Memory) UpdateUserUsername(id uint, username string) *DatabaseError {
+	return m.updateUser(id, func(user *schema.User) {
+		user.Username = username
+	})
+}
+
+func (m *Memory) UpdateUserRole(id uint, role string) *DatabaseError {
+	return m.updateUser(id, func(user *schema.User) {
+		user.Role = role
+	})
+}
+
+func (m *Memory) UpdateUserStatus(id uint, status string) *DatabaseError {
+	return m.updateUser(id, func(user *schema.User) {
+		user.Status = status
+	})
+}
+
+func (m *Memory) SearchUsers(query string, limit int) ([]schema.User, *DatabaseError) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	query = strings.ToLower(query)
+	users := make([]schema.User, 0)
+	for _, user := range m.users {
+		if strings.Contains(strings.ToLower(user.Email), query) ||
+			strings.Contains(strings.ToLower(user.Username), query) {
+			users = append(users, user)
+		}
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].ID < users[j].ID
+	})
+	if len(users) > limit {
+		users = users[:limit]
+	}
+	return users, nil
+}
+
+func (m *Memory) AddSession(session *schema.Session) (uint, *DatabaseError) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	session.ID = uint(len(m.sessions) + 1)
+	session.CreatedAt = time.Now()
+	session.UpdatedAt = session.CreatedAt
+	m.sessions[session.ID] = *session
+	return session.ID, nil
+}
+
+func (m *Memory) GetSession(id uint) (*schema.Session, *DatabaseError) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	session, ok := m.sessions[id]
+	if !ok {
+		return &schema.Session{}, newQueryError(gorm.ErrRecordNotFound)
+	}
+	return &session, nil
+}
+
+func (m *Memory) FindSessionByRefreshHash(hash string) (*schema.Session, *DatabaseError) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for _, session := range m.sessions {
+		if session.RefreshHash == hash || session.PreviousHash == hash {
+			return &session, nil
+		}
+	}
+	return &schema.Session{}, newQueryError(gorm.ErrRecordNotFound)
+}
+
+func (m *Memory) RotateSession(id uint, oldHash string, newHash string, expiresAt time.Time) *DatabaseError {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	session, ok := m.sessions[id]
+	if !ok || session.RefreshHash != oldHash || session.RevokedAt != nil {
+		return newConflictError(fmt.Errorf("session %d was already refreshed or revoked", id))
+	}
+	session.PreviousHash = oldHash
+	session.RefreshHash = newHash
+	session.ExpiresAt = expiresAt
+	session.UpdatedAt = time.Now()
+	m.sessions[id] = session
+	return nil
+}
+
+func (m *Memory) RevokeSession(id uint) *DatabaseError {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.revokeSessions(func(session schema.Session) bool {
+		return session.ID == id
+	})
+	return nil
+}
+
+func (m *Memory) RevokeUserSessions(userID uint) *DatabaseError {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.revokeSessions(func(session schema.Session) bool {
+		return session.UserID == userID
+	})
+	return nil
+}
+
+func (m *Memory) revokeSessions(match func(session schema.Session) bool) {
+	now := time.Now()
+	for id, session := range m.sessions {
+		if session.RevokedAt == nil && match(session) {
+			session.RevokedAt = &now
+			m.sessions[id] = session
+		}
+	}
+}
+
+func (m *Memory) AddTicket(ticket *schema.Ticket) *DatabaseError {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	now := time.Now()
+	for hash, issued := range m.tickets {
+		if now.After(issued.ExpiresAt) {
+			delete(m.tickets, hash)
+		}
+	}
+	ticket.CreatedAt = now
+	m.tickets[ticket.Hash] = *ticket
+	return nil
+}
+
+func (m *Memory) RedeemTicket(hash string) (*schema.Ticket, *DatabaseError) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	ticket, ok := m.tickets[hash]
+	delete(m.tickets, hash)
+	if !ok || time.Now().After(ticket.ExpiresAt) {
+		return &schema.Ticket{}, newQueryError(gorm.ErrRecordNotFound)
+	}
+	return &ticket, nil
+}
+
+func (m *Memory) AddWords(id uint, words []string) *DatabaseError {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for _, word := range words {
+		m.addWord(id, word)
+	}
+	return nil
+}
+
+func (m *Memory) addWord(id uint, word string) {
+	if _, ok := m.dictionary[word]; !ok {
+		m.dictionary[word] = make(map[uint]struct{})
+	}
+	m.dictionary[word][id] = struct{}{}
+}
+
+func (m *Memory) RecommendWord(n int, id uint, seed uint64) ([]string, *DatabaseError) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	words := make([]string, 0, len(m.dictionary))
+	for word := range m.dictionary {
+		words = append(words, word)
+	}
+	sort.Strings(words)
+
+	candidates := make([]string, 0, len(words))
+	counts := make([]int, 0, len(words))
+	for _, word := range words {
+		if _, ok := m.removed[word]; ok {
+			continue
+		}
+		count := len(m.dictionary[word])
+		if _, ok := m.dictionary[word][id]; ok {
+			count--
+		}
+		if count == 0 {
+			continue
+		}
+		candidates = append(candidates, word)
+		counts = append(counts, count)
+	}
+
+	return recommend(candidates, counts, n, seed)
+}
+
+func (m *Memory) RemoveWord(word string) (bool, *DatabaseError) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	_, known := m.dictionary[word]
+	_, removed := m.removed[word]
+	if !known || removed {
+		return false, nil
+	}
+	m.removed[word] = struct{}{}
+	return true, nil
+}
+
+func (m *Memory) AddGame(game *game.Game) *DatabaseError {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.lastGameID++
+	memoryGame := memoryGame{
+		ID:     m.lastGameID,
+		Result: append([]containers.Result(nil), game.Process.Result...),
+	}
+	for id := range game.Players.IDs {
+		memoryGame.Players = append(memoryGame.Players, id)
+	}
+	m.games = append(m.games, memoryGame)
+
+	for id, words := range game.Words.ByUser {
+		for word := range words {
+			m.addWord(id, word)
+		}
+	}
+	return nil
+}
+
+func (m *Memory) GetUserStatistics(id uint) (containers.Statistics, *DatabaseError) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	words := make([]containers.Word, 0)
+	for word, authors := range m.dictionary {
+		if _, ok := authors[id]; ok {
+			words = append(words, containers.Word{Word: word, Count: 1})
+		}
+	}
+	sort.Slice(words, func(i, j int) bool {
+		return words[i].Word < words[j].Word
+	})
+	if len(words) > 5 {
+		words = words[:5]
+	}
+
+	var numGames int64
+	var numWins int64
+	var numTies int64
+	for _, g := range m.games {
+		for _, player := range g.Players {
+			if player == id {
+				numGames += 1
+			}
+		}
+
+		best := make([]containers.Result, 0)
+		for _, r := range g.Result {
+			if len(best) == 0 || r.Score > best[0].Score {
+				best = best[:0]
+			}
+			if len(best) == 0 || r.Score == best[0].Score {
+				best = append(best, r)
+			}
+		}
+		if containers.Contains(best, id) {
+			if len(best) == 1 {
+				numWins += 1
+			} else {
+				numTies += 1
+			}
+		}
+	}
+
+	return containers.Statistics{
+		GamesPlayed:  numGames,
+		NumberOfWins: numWins,
+		NumberOfTies: numTies,
+		TopWords:     words,
+	}, nil
+}
+
+func (m *Memory) SaveSnapshot(snapshot game.Snapshot) *DatabaseError {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.snapshots[snapshot.ID] = snapshot
+	return nil
+}
+
+func (m *Memory) GetSnapshots() ([]game.Snapshot, *DatabaseError) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	snapshots := make([]game.Snapshot, 0, len(m.snapshots))
+	for _, snapshot := range m.snapshots {
+		snapshots = append(snapshots, snapshot)
+	}
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].ID < snapshots[j].ID
+	})
+	return snapshots, nil
+}
+
+func (m *Memory) DeleteSnapshot(gameID uint) *DatabaseError {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	delete(m.snapshots, gameID)
+	return nil
+}
+
+func (m *Memory) AddGameEvents(entries []game.LogEntry) *DatabaseError {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for _, entry := range entries {
+		log := m.events[entry.Key]
+		if len(log) > 0 && log[len(log)-1].Seq >= entry.Seq {
+			return newInsertError(fmt.Errorf("event %d of game %s is out of order", entry.Seq, entry.Key))
+		}
+		m.events[entry.Key] = append(log, entry)
+	}
+	return nil
+}
+
+func (m *Memory) GetGameEvents(key string) ([]game.LogEntry, *DatabaseError) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return append([]game.LogEntry(nil), m.events[key]...), nil
+}
+
+func (m *Memory) GetLastGameEventSeq(key string) (int, *DatabaseError) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	log := m.events[key]
+	if len(log) == 0 {
+		return 0, nil
+	}
+	return log[len(log)-1].Seq, nil
+}
+
+func (m *Memory) AddFlag(flag *schema.Flag) (uint, *DatabaseError) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	flag.ID = uint(len(m.flags) + 1)
+	flag.CreatedAt = time.Now()
+	flag.UpdatedAt = flag.CreatedAt
+	m.flags = append(m.flags, *flag)
+	return flag.ID, nil
+}
+
+func (m *Memory) GetFlags(resolved bool, limit int) ([]schema.Flag, *DatabaseError) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	flags := make([]schema.Flag, 0)
+	for i := len(m.flags) - 1; i >= 0 && len(flags) < limit; i-- {
+		if (m.flags[i].ResolvedAt != nil) == resolved {
+			flags = append(flags, m.flags[i])
+		}
+	}
+	return flags, nil
+}
+
+func (m *Memory) ResolveFlag(id uint, adminID uint) (bool, *DatabaseError) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if id == 0 || int(id) > len(m.flags) || m.flags[id-1].ResolvedAt != nil {
+		return false, nil
+	}
+	now := time.Now()
+	m.flags[id-1].ResolvedAt = &now
+	m.flags[id-1].ResolvedBy = &adminID
+	return true, nil
+}
+
+func (m *Memory) AddAuditEntry(entry *schema.AuditEntry) *DatabaseError {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	entry.ID = uint(len(m.audit) + 1)
+	entry.CreatedAt = time.Now()
+	m.audit = append(m.audit, *entry)
+	return nil
+}
+
+func (m *Memory) GetAuditLog(limit int) ([]schema.AuditEntry, *DatabaseError) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	entries := make([]schema.AuditEntry, 0, utils.Min(limit, len(m.audit)))
+	for i := len(m.audit) - 1; i >= 0 && len(entries) < limit; i-- {
+		entries = append(entries, m.audit[i])
+	}
+	return entries, nil
+}
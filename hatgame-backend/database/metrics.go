@@ -0,0 +1,17 @@
+package database
+
+import (
+	"time"
+
+	"github.com/bitterfly/go-chaos/hatgame/metrics"
+)
+
+var queryDuration = metrics.NewHistogram(
+	"hatgame_db_query_duration_seconds",
+	"Time spent in database functions, by function.",
+	metrics.DefaultBuckets,
+	"function")
+
+func observe(function string, start time.Time) {
+	queryDuration.Since(start, function)
+}
@@ -0,0 +1,275 @@
+package database
+
+import (
+	"embed"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+type MigrationStatus struct {
+	Version   int
+	Name      string
+	AppliedAt *time.Time
+}
+
+type appliedMigration struct {
+	Version   int
+	Name      string
+	AppliedAt time.Time
+}
+
+func (appliedMigration) TableName() string {
+	return "schema_migrations"
+}
+
+func loadMigrations() ([]Migration, error) {
+	files, err := migrationFiles.ReadDir("migrations")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int]*Migration)
+	for _, file := range files {
+		name := file.Name()
+		var direction string
+		switch {
+		case strings.HasSuffix(name, ".up.sql"):
+			direction = "up"
+		case strings.HasSuffix(name, ".down.sql"):
+			direction = "down"
+		default:
+			return nil, fmt.Errorf("migration %s is neither .up.sql nor .down.sql", name)
+		}
+
+		base := strings.TrimSuffix(name, "."+direction+".sql")
+		parts := strings.SplitN(base, "_", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("migration %s is not named <version>_<name>", name)
+		}
+		version, err := strconv.Atoi(parts[0])
+		if err != nil {
+			return nil, fmt.Errorf("migration %s has a bad version: %w", name, err)
+		}
+
+		data, err := migrationFiles.ReadFile(path.Join("migrations", name))
+		if err != nil {
+			return nil, err
+		}
+
+		migration, ok := byVersion[version]
+		if !ok {
+			migration = &Migration{Version: version, Name: parts[1]}
+			byVersion[version] = migration
+		}
+		if migration.Name != parts[1] {
+			return nil, fmt.Errorf("migrations %s and %s share version %d", migration.Name, parts[1], version)
+		}
+		if direction == "up" {
+			migration.Up = string(data)
+		} else {
+			migration.Down = string(data)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, migration := range byVersion {
+		if migration.Up == "" || migration.Down == "" {
+			return nil, fmt.Errorf("migration %d_%s needs both an up and a down script", migration.Version, migration.Name)
+		}
+		migrations = append(migrations, *migration)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	return migrations, nil
+}
+
+func createMigrationsTable(db *gorm.DB) error {
+	return db.Exec(`
+		create table if not exists schema_migrations (
+			version bigint primary key,
+			name text not null,
+			applied_at timestamptz not null
+		)`).Error
+}
+
+func getAppliedMigrations(db *gorm.DB) (map[int]appliedMigration, error) {
+	var rows []appliedMigration
+	if err := db.Order("version").Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	applied := make(map[int]appliedMigration, len(rows))
+	for _, row := range rows {
+		applied[row.Version] = row
+	}
+	return applied, nil
+}
+
+func lockMigrations(tx *gorm.DB) error {
+	return tx.Exec("lock table schema_migrations in exclusive mode").Error
+}
+
+func MigrateUp(db *gorm.DB) ([]Migration, *DatabaseError) {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return nil, newMigrateError(err)
+	}
+	if err := createMigrationsTable(db); err != nil {
+		return nil, newMigrateError(err)
+	}
+
+	done := make([]Migration, 0)
+	for _, migration := range migrations {
+		migration := migration
+		applied := false
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if err := lockMigrations(tx); err != nil {
+				return err
+			}
+			appliedMigrations, err := getAppliedMigrations(tx)
+			if err != nil {
+				return err
+			}
+			if _, ok := appliedMigrations[migration.Version]; ok {
+				return nil
+			}
+
+			if err := tx.Exec(migration.Up).Error; err != nil {
+				return err
+			}
+			applied = true
+			return tx.Create(&appliedMigration{
+				Version:   migration.Version,
+				Name:      migration.Name,
+				AppliedAt: time.Now(),
+			}).Error
+		})
+		if err != nil {
+			return done, newMigrateError(fmt.Errorf("migration %d_%s, %w", migration.Version, migration.Name, err))
+		}
+		if applied {
+			done = append(done, migration)
+		}
+	}
+	return done, nil
+}
+
+func MigrateDown(db *gorm.DB, steps int) ([]Migration, *DatabaseError) {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return nil, newMigrateError(err)
+	}
+	if err := createMigrationsTable(db); err != nil {
+		return nil, newMigrateError(err)
+	}
+
+	done := make([]Migration, 0, steps)
+	for i := len(migrations) - 1; i >= 0 && len(done) < steps; i-- {
+		migration := migrations[i]
+		applied := false
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if err := lockMigrations(tx); err != nil {
+				return err
+			}
+			appliedMigrations, err := getAppliedMigrations(tx)
+			if err != nil {
+				return err
+			}
+			if _, ok := appliedMigrations[migration.Version]; !ok {
+				return nil
+			}
+
+			if err := tx.Exec(migration.Down).Error; err != nil {
+				return err
+			}
+			applied = true
+			return tx.Where("version = ?", migration.Version).Delete(&appliedMigration{}).Error
+		})
+		if err != nil {
+			return done, newMigrateError(fmt.Errorf("rollback of %d_%s, %w", migration.Version, migration.Name, err))
+		}
+		if applied {
+			done = append(done, migration)
+		}
+	}
+	return done, nil
+}
+
+func GetMigrationStatus(db *gorm.DB) ([]MigrationStatus, *DatabaseError) {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return nil, newMigrateError(err)
+	}
+	if err := createMigrationsTable(db); err != nil {
+		return nil, newMigrateError(err)
+	}
+	applied, err := getAppliedMigrations(db)
+	if err != nil {
+		return nil, newQueryError(err)
+	}
+
+	status := make([]MigrationStatus, 0, len(migrations))
+	for _, migration := range migrations {
+		state := MigrationStatus{Version: migration.Version, Name: migration.Name}
+		if row, ok := applied[migration.Version]; ok {
+			appliedAt := row.AppliedAt
+			state.AppliedAt = &appliedAt
+		}
+		status = append(status, state)
+	}
+	for version, row := range applied {
+		if _, ok := findMigration(migrations, version); !ok {
+			appliedAt := row.AppliedAt
+			status = append(status, MigrationStatus{Version: version, Name: row.Name + " (unknown)", AppliedAt: &appliedAt})
+		}
+	}
+	sort.Slice(status, func(i, j int) bool {
+		return status[i].Version < status[j].Version
+	})
+	return status, nil
+}
+
+// PendingMigrations returns the migrations that are not applied yet.
+func PendingMigrations(db *gorm.DB) ([]Migration, *DatabaseError) {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return nil, newMigrateError(err)
+	}
+	applied, err := getAppliedMigrations(db)
+	if err != nil {
+		return nil, newQueryError(err)
+	}
+
+	pending := make([]Migration, 0)
+	for _, migration := range migrations {
+		if _, ok := applied[migration.Version]; !ok {
+			pending = append(pending, migration)
+		}
+	}
+	return pending, nil
+}
+
+func findMigration(migrations []Migration, version int) (Migration, bool) {
+	for _, migration := range migrations {
+		if migration.Version == version {
+			return migration, true
+		}
+	}
+	return Migration{}, false
+}
@@ -0,0 +1,11 @@
+drop table if exists game_events;
+drop table if exists game_snapshots;
+drop table if exists player_games;
+drop table if exists game_words;
+drop table if exists user_dictionaries;
+drop table if exists words;
+drop table if exists game_results;
+drop table if exists games;
+drop table if exists results;
+drop table if exists teams;
+drop table if exists users;
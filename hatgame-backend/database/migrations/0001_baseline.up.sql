@@ -0,0 +1,132 @@
+-- Matches the schema that gorm's AutoMigrate created before migrations were
+-- introduced, so it is a no-op on databases that already have the tables.
+
+create table if not exists users (
+	id bigserial primary key,
+	created_at timestamptz,
+	updated_at timestamptz,
+	deleted_at timestamptz,
+	email text not null,
+	password bytea not null,
+	username text,
+	avatar bytea
+);
+create unique index if not exists idx_users_email on users (email);
+create index if not exists idx_users_deleted_at on users (deleted_at);
+
+create table if not exists teams (
+	id bigserial primary key,
+	created_at timestamptz,
+	updated_at timestamptz,
+	deleted_at timestamptz,
+	first_id bigint,
+	second_id bigint,
+	constraint fk_teams_first_user foreign key (first_id) references users (id),
+	constraint fk_teams_second_user foreign key (second_id) references users (id)
+);
+create unique index if not exists idx_name on teams (first_id, second_id);
+create index if not exists idx_teams_deleted_at on teams (deleted_at);
+
+create table if not exists results (
+	id bigserial primary key,
+	created_at timestamptz,
+	updated_at timestamptz,
+	deleted_at timestamptz,
+	team_id bigint,
+	score bigint
+);
+create index if not exists idx_results_deleted_at on results (deleted_at);
+
+create table if not exists games (
+	id bigserial primary key,
+	created_at timestamptz,
+	updated_at timestamptz,
+	deleted_at timestamptz,
+	user_id bigint,
+	log_key text,
+	seed bigint,
+	num_players bigint,
+	timer bigint,
+	num_words bigint
+);
+create index if not exists idx_games_log_key on games (log_key);
+create index if not exists idx_games_deleted_at on games (deleted_at);
+
+create table if not exists game_results (
+	game_id bigint,
+	result_id bigint,
+	primary key (game_id, result_id),
+	constraint fk_game_results_game foreign key (game_id) references games (id),
+	constraint fk_game_results_result foreign key (result_id) references results (id)
+);
+
+create table if not exists words (
+	id bigserial primary key,
+	created_at timestamptz,
+	updated_at timestamptz,
+	deleted_at timestamptz,
+	word text
+);
+create index if not exists idx_words_deleted_at on words (deleted_at);
+
+create table if not exists user_dictionaries (
+	id bigserial primary key,
+	created_at timestamptz,
+	updated_at timestamptz,
+	deleted_at timestamptz,
+	author_id bigint,
+	word_id bigint,
+	constraint fk_user_dictionaries_author foreign key (author_id) references users (id),
+	constraint fk_user_dictionaries_word foreign key (word_id) references words (id)
+);
+create index if not exists idx_user_dictionaries_deleted_at on user_dictionaries (deleted_at);
+
+create table if not exists game_words (
+	id bigserial primary key,
+	created_at timestamptz,
+	updated_at timestamptz,
+	deleted_at timestamptz,
+	player_word_id bigint,
+	guessed_by_id bigint,
+	game_id bigint,
+	constraint fk_game_words_user_dictionary foreign key (player_word_id) references user_dictionaries (id),
+	constraint fk_game_words_guessed_by foreign key (guessed_by_id) references users (id),
+	constraint fk_game_words_game foreign key (game_id) references games (id)
+);
+create index if not exists idx_game_words_deleted_at on game_words (deleted_at);
+
+create table if not exists player_games (
+	id bigserial primary key,
+	created_at timestamptz,
+	updated_at timestamptz,
+	deleted_at timestamptz,
+	user_id bigint,
+	game_id bigint
+);
+create index if not exists idx_player_games_deleted_at on player_games (deleted_at);
+
+create table if not exists game_snapshots (
+	id bigserial primary key,
+	created_at timestamptz,
+	updated_at timestamptz,
+	deleted_at timestamptz,
+	game_id bigint not null,
+	data bytea
+);
+create unique index if not exists idx_game_snapshots_game_id on game_snapshots (game_id);
+create index if not exists idx_game_snapshots_deleted_at on game_snapshots (deleted_at);
+
+create table if not exists game_events (
+	id bigserial primary key,
+	created_at timestamptz,
+	updated_at timestamptz,
+	deleted_at timestamptz,
+	game_key text not null,
+	seq bigint,
+	game_id bigint,
+	source text,
+	type text,
+	data bytea
+);
+create unique index if not exists idx_game_event on game_events (game_key, seq);
+create index if not exists idx_game_events_deleted_at on game_events (deleted_at);
@@ -0,0 +1,2 @@
+alter table words drop constraint if exists words_word_key;
+alter table words alter column word drop not null;
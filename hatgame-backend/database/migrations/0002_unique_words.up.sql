@@ -0,0 +1,16 @@
+-- The old `unique,notnull` tag on schema.Word was ignored, so the same word
+-- may have been inserted more than once. Point every dictionary entry at the
+-- oldest copy of its word before dropping the others.
+
+update user_dictionaries
+set word_id = keep.id
+from words, (select word, min(id) as id from words group by word) as keep
+where user_dictionaries.word_id = words.id
+	and words.word = keep.word
+	and words.id <> keep.id;
+
+delete from words
+where id not in (select min(id) from words group by word);
+
+alter table words alter column word set not null;
+alter table words add constraint words_word_key unique (word);
@@ -0,0 +1,16 @@
+create table sessions (
+	id bigserial primary key,
+	created_at timestamptz,
+	updated_at timestamptz,
+	deleted_at timestamptz,
+	user_id bigint not null,
+	refresh_hash text not null,
+	previous_hash text,
+	expires_at timestamptz,
+	revoked_at timestamptz,
+	constraint fk_sessions_user foreign key (user_id) references users (id)
+);
+create index idx_sessions_user_id on sessions (user_id);
+create unique index idx_sessions_refresh_hash on sessions (refresh_hash);
+create index idx_sessions_previous_hash on sessions (previous_hash);
+create index idx_sessions_deleted_at on sessions (deleted_at);
@@ -0,0 +1,2 @@
+drop table if exists rooms;
+drop sequence if exists room_ids;
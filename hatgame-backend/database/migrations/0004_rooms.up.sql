@@ -0,0 +1,17 @@
+create sequence room_ids;
+select setval('room_ids', coalesce((select max(game_id) from game_snapshots), 0) + 1, false);
+
+create table rooms (
+	id bigint primary key,
+	code text not null,
+	owner text not null,
+	players bigint,
+	words bigint,
+	timer bigint,
+	expires_at timestamptz not null,
+	created_at timestamptz,
+	updated_at timestamptz
+);
+create unique index idx_rooms_code on rooms (code);
+create index idx_rooms_owner on rooms (owner);
+create index idx_rooms_expires_at on rooms (expires_at);
@@ -0,0 +1,4 @@
+drop table if exists audit_log;
+drop table if exists flags;
+alter table users drop column if exists status;
+alter table users drop column if exists role;
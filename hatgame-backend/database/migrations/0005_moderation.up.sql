@@ -0,0 +1,32 @@
+alter table users add column role text not null default 'user';
+alter table users add column status text not null default 'active';
+
+create table flags (
+	id bigserial primary key,
+	created_at timestamptz,
+	updated_at timestamptz,
+	deleted_at timestamptz,
+	reporter_id bigint not null,
+	kind text not null,
+	target text not null,
+	reason text,
+	resolved_at timestamptz,
+	resolved_by bigint,
+	constraint fk_flags_reporter foreign key (reporter_id) references users (id),
+	constraint fk_flags_resolved_by foreign key (resolved_by) references users (id)
+);
+create index idx_flags_reporter_id on flags (reporter_id);
+create index idx_flags_resolved_at on flags (resolved_at);
+create index idx_flags_deleted_at on flags (deleted_at);
+
+create table audit_log (
+	id bigserial primary key,
+	created_at timestamptz,
+	admin_id bigint not null,
+	action text not null,
+	target text,
+	details text,
+	constraint fk_audit_log_admin foreign key (admin_id) references users (id)
+);
+create index idx_audit_log_created_at on audit_log (created_at);
+create index idx_audit_log_admin_id on audit_log (admin_id);
@@ -0,0 +1,8 @@
+drop index if exists idx_users_username;
+alter table users alter column username drop not null;
+
+update users
+set username = backup.username
+from users_username_backup as backup
+where users.id = backup.user_id;
+drop table if exists users_username_backup;
@@ -0,0 +1,23 @@
+-- Usernames have to be unique regardless of case. Empty usernames and all but
+-- the oldest of the same name become player<id>, the same name admins reset
+-- usernames to. The old names are kept for the down migration.
+
+create table users_username_backup (
+	user_id bigint primary key,
+	username text
+);
+insert into users_username_backup (user_id, username)
+select id, username from users
+where username is null
+	or btrim(username) = ''
+	or (deleted_at is null and id not in (
+		select min(id) from users
+		where deleted_at is null
+		group by lower(username)));
+
+update users
+set username = 'player' || id
+where id in (select user_id from users_username_backup);
+
+alter table users alter column username set not null;
+create unique index idx_users_username on users (lower(username)) where deleted_at is null;
@@ -0,0 +1,9 @@
+drop index if exists idx_users_email;
+
+update users
+set email = backup.email
+from users_email_backup as backup
+where users.id = backup.user_id;
+drop table if exists users_email_backup;
+
+create unique index idx_users_email on users (email);
@@ -0,0 +1,35 @@
+-- Emails are stored lowercased and have to be unique regardless of case.
+-- Accounts whose emails only differ in case can not be told apart any more,
+-- so the migration stops and lists them for an operator to resolve first.
+
+do $$
+declare
+	collisions text;
+begin
+	select string_agg(format('%s (users %s)', email, ids), '; ')
+	into collisions
+	from (
+		select lower(email) as email, string_agg(id::text, ', ' order by id) as ids
+		from users
+		group by lower(email)
+		having count(*) > 1) as duplicates;
+	if collisions is not null then
+		raise exception 'emails that only differ in case: %', collisions;
+	end if;
+end
+$$;
+
+-- The emails as they were, for the down migration.
+create table users_email_backup (
+	user_id bigint primary key,
+	email text not null
+);
+insert into users_email_backup (user_id, email)
+select id, email from users where email <> lower(email);
+
+update users
+set email = lower(email)
+where email <> lower(email);
+
+drop index if exists idx_users_email;
+create unique index idx_users_email on users (lower(email));
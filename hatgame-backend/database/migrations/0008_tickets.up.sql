@@ -0,0 +1,11 @@
+-- Tickets are shared by all instances, a ticket issued by one can be redeemed
+-- on another.
+
+create table tickets (
+	hash text primary key,
+	user_id bigint not null,
+	session_id bigint not null,
+	expires_at timestamptz not null,
+	created_at timestamptz
+);
+create index idx_tickets_expires_at on tickets (expires_at);
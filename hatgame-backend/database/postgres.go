@@ -0,0 +1,582 @@
+package database
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/bitterfly/go-chaos/hatgame/game"
+	"github.com/bitterfly/go-chaos/hatgame/schema"
+	"github.com/bitterfly/go-chaos/hatgame/server/containers"
+	"github.com/jackc/pgconn"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const readyTimeout = 2 * time.Second
+
+type Postgres struct {
+	db *gorm.DB
+}
+
+func NewPostgres(db *gorm.DB) *Postgres {
+	return &Postgres{db: db}
+}
+
+func (p *Postgres) Ready() *DatabaseError {
+	defer observe("Ready", time.Now())
+	ctx, cancel := context.WithTimeout(context.Background(), readyTimeout)
+	defer cancel()
+
+	sqlDB, err := p.db.DB()
+	if err != nil {
+		return newOpenError(err)
+	}
+	if err := sqlDB.PingContext(ctx); err != nil {
+		return newOpenError(err)
+	}
+	pending, derr := PendingMigrations(p.db.WithContext(ctx))
+	if derr != nil {
+		return derr
+	}
+	if len(pending) > 0 {
+		return newMigrateError(fmt.Errorf("%d migrations are not applied, starting with %d_%s",
+			len(pending), pending[0].Version, pending[0].Name))
+	}
+	return nil
+}
+
+const uniqueViolation = "23505"
+
+// userConflict tells which unique index of users err violates, if any.
+func userConflict(err error) *DatabaseError {
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) || pgErr.Code != uniqueViolation {
+		return nil
+	}
+	switch pgErr.ConstraintName {
+	case "idx_users_email":
+		return newConflictError(ErrEmailTaken)
+	case "idx_users_username":
+		return newConflictError(ErrUsernameTaken)
+	}
+	return newConflictError(err)
+}
+
+func (p *Postgres) AddUser(user *schema.User) (uint, *DatabaseError) {
+	defer observe("AddUser", time.Now())
+	if err := p.db.Create(user).Error; err != nil {
+		if derr := userConflict(err); derr != nil {
+			return 0, derr
+		}
+		return 0, newInsertError(err)
+	}
+	return user.ID, nil
+}
+
+func (p *Postgres) GetUserByID(id uint) (*schema.User, *DatabaseError) {
+	defer observe("GetUserByID", time.Now())
+	var user schema.User
+	err := p.db.First(&user, id).Error
+	return &user, newQueryError(err)
+}
+
+func (p *Postgres) GetUserByEmail(email string) (*schema.User, *DatabaseError) {
+	defer observe("GetUserByEmail", time.Now())
+	var user schema.User
+	err := p.db.Where("lower(email) = lower(?)", email).First(&user).Error
+	return &user, newQueryError(err)
+}
+
+func (p *Postgres) UpdateUser(id uint, password []byte, username string) *DatabaseError {
+	defer observe("UpdateUser", time.Now())
+	err := p.db.Model(&schema.User{}).
+		Where("id = ?", id).
+		Updates(map[string]interface{}{"password": password, "username": username}).Error
+	if derr := userConflict(err); derr != nil {
+		return derr
+	}
+	return newUpdateError(err)
+}
+
+func (p *Postgres) UpdateUserPassword(id uint, password []byte) *DatabaseError {
+	defer observe("UpdateUserPassword", time.Now())
+	return newUpdateError(p.db.Model(&schema.User{}).
+		Where("id = ?", id).
+		Update("password", password).Error)
+}
+
+func (p *Postgres) UpdateUserUsername(id uint, username string) *DatabaseError {
+	defer observe("UpdateUserUsername", time.Now())
+	err := p.db.Model(&schema.User{}).
+		Where("id = ?", id).
+		Update("username", username).Error
+	if derr := userConflict(err); derr != nil {
+		return derr
+	}
+	return newUpdateError(err)
+}
+
+func (p *Postgres) UpdateUserRole(id uint, role string) *DatabaseError {
+	defer observe("UpdateUserRole", time.Now())
+	return newUpdateError(
+		p.db.Model(&schema.User{}).
+			Where("id = ?", id).
+			Update("role", role).Error)
+}
+
+func (p *Postgres) UpdateUserStatus(id uint, status string) *DatabaseError {
+	defer observe("UpdateUserStatus", time.Now())
+	return newUpdateError(
+		p.db.Model(&schema.User{}).
+			Where("id = ?", id).
+			Update("status", status).Error)
+}
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+func (p *Postgres) SearchUsers(query string, limit int) ([]schema.User, *DatabaseError) {
+	defer observe("SearchUsers", time.Now())
+	pattern := "%" + likeEscaper.Replace(query) + "%"
+	var users []schema.User
+	err := p.db.Where("email ilike ? or username ilike ?", pattern, pattern).
+		Order("id").
+		Limit(limit).
+		Find(&users).Error
+	return users, newQueryError(err)
+}
+
+func (p *Postgres) AddSession(session *schema.Session) (uint, *DatabaseError) {
+	defer observe("AddSession", time.Now())
+	if err := p.db.Create(session).Error; err != nil {
+		return 0, newInsertError(err)
+	}
+	return session.ID, nil
+}
+
+func (p *Postgres) GetSession(id uint) (*schema.Session, *DatabaseError) {
+	defer observe("GetSession", time.Now())
+	var session schema.Session
+	err := p.db.First(&session, id).Error
+	return &session, newQueryError(err)
+}
+
+func (p *Postgres) FindSessionByRefreshHash(hash string) (*schema.Session, *DatabaseError) {
+	defer observe("FindSessionByRefreshHash", time.Now())
+	var session schema.Session
+	err := p.db.Where("refresh_hash = ? OR previous_hash = ?", hash, hash).First(&session).Error
+	return &session, newQueryError(err)
+}
+
+func (p *Postgres) RotateSession(id uint, oldHash string, newHash string, expiresAt time.Time) *DatabaseError {
+	defer observe("RotateSession", time.Now())
+	result := p.db.Model(&schema.Session{}).
+		Where("id = ? AND refresh_hash = ? AND revoked_at IS NULL", id, oldHash).
+		Updates(map[string]interface{}{
+			"refresh_hash":  newHash,
+			"previous_hash": oldHash,
+			"expires_at":    expiresAt,
+		})
+	if result.Error != nil {
+		return newUpdateError(result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return newConflictError(fmt.Errorf("session %d was already refreshed or revoked", id))
+	}
+	return nil
+}
+
+func (p *Postgres) RevokeSession(id uint) *DatabaseError {
+	defer observe("RevokeSession", time.Now())
+	return newUpdateError(p.db.Model(&schema.Session{}).
+		Where("id = ? AND revoked_at IS NULL", id).
+		Update("revoked_at", time.Now()).Error)
+}
+
+func (p *Postgres) RevokeUserSessions(userID uint) *DatabaseError {
+	defer observe("RevokeUserSessions", time.Now())
+	return newUpdateError(p.db.Model(&schema.Session{}).
+		Where("user_id = ? AND revoked_at IS NULL", userID).
+		Update("revoked_at", time.Now()).Error)
+}
+
+func (p *Postgres) AddTicket(ticket *schema.Ticket) *DatabaseError {
+	defer observe("AddTicket", time.Now())
+	if err := p.db.Where("expires_at < ?", time.Now()).Delete(&schema.Ticket{}).Error; err != nil {
+		return newUpdateError(err)
+	}
+	return newInsertError(p.db.Create(ticket).Error)
+}
+
+func (p *Postgres) RedeemTicket(hash string) (*schema.Ticket, *DatabaseError) {
+	defer observe("RedeemTicket", time.Now())
+	var tickets []schema.Ticket
+	// Deleting and returning in one statement lets only one instance redeem
+	// the ticket.
+	if err := p.db.Raw("delete from tickets where hash = ? returning *", hash).Scan(&tickets).Error; err != nil {
+		return &schema.Ticket{}, newQueryError(err)
+	}
+	if len(tickets) == 0 || time.Now().After(tickets[0].ExpiresAt) {
+		return &schema.Ticket{}, newQueryError(gorm.ErrRecordNotFound)
+	}
+	return &tickets[0], nil
+}
+
+func (p *Postgres) AddWords(id uint, words []string) *DatabaseError {
+	defer observe("AddWords", time.Now())
+	return newQueryError(p.db.Transaction(func(tx *gorm.DB) error {
+		schemaWords := make([]schema.Word, len(words))
+		for i, w := range words {
+			schemaWords[i] = schema.Word{
+				Word: w,
+			}
+		}
+
+		return nil
+	}))
+}
+
+func (p *Postgres) RecommendWord(n int, id uint, seed uint64) ([]string, *DatabaseError) {
+	defer observe("RecommendWord", time.Now())
+	rows, err := p.db.Raw(`
+		select word, count(*) from words
+		left join user_dictionaries on words.id = user_dictionaries.word_id
+		where words.deleted_at is null
+			and (user_dictionaries.author_id <> ? or user_dictionaries.author_id is null)
+		group by words.id`, id).Rows()
+	if err != nil {
+		return nil, newQueryError(err)
+	}
+
+	words := make([]string, 0)
+	counts := make([]int, 0)
+	var word string
+	var count int
+	for rows.Next() {
+		err = rows.Scan(&word, &count)
+		if err != nil {
+			return nil, newQueryError(err)
+		}
+		words = append(words, word)
+		counts = append(counts, count)
+	}
+
+	return recommend(words, counts, n, seed)
+}
+
+func (p *Postgres) RemoveWord(word string) (bool, *DatabaseError) {
+	defer observe("RemoveWord", time.Now())
+	result := p.db.Where("word = ?", word).Delete(&schema.Word{})
+	return result.RowsAffected > 0, newUpdateError(result.Error)
+}
+
+func (p *Postgres) AddGame(game *game.Game) *DatabaseError {
+	defer observe("AddGame", time.Now())
+	return newQueryError(p.db.Transaction(func(tx *gorm.DB) error {
+		numTeams := int(float64(game.NumPlayers) / 2)
+		schemaResults := make([]schema.Result, 0, numTeams)
+		for _, r := range game.Process.Result {
+			schemaTeam := schema.Team{
+				FirstID:  r.FirstID,
+				SecondID: r.SecondID,
+			}
+			if err := tx.Where(
+				"first_id = ? AND second_id = ?",
+				schemaTeam.FirstID,
+				schemaTeam.SecondID).FirstOrCreate(&schemaTeam).Error; err != nil {
+				return err
+			}
+
+			schemaResult := schema.Result{TeamID: schemaTeam.ID, Score: r.Score}
+
+			schemaResults = append(schemaResults, schemaResult)
+		}
+
+		schemaGame := &schema.Game{
+			UserID:     game.Host,
+			LogKey:     game.Key,
+			Seed:       game.Seed,
+			NumPlayers: game.NumPlayers,
+			Timer:      game.Timer,
+			NumWords:   game.NumWords,
+			Result:     schemaResults,
+		}
+
+		if err := tx.Create(schemaGame).Error; err != nil {
+			return err
+		}
+		for userID := range game.Players.IDs {
+			if err := tx.Create(&schema.PlayerGame{
+				UserID: userID,
+				GameID: schemaGame.ID,
+			}).Error; err != nil {
+				return err
+			}
+		}
+
+		gameWords := make([]schema.GameWord, 0, len(game.Words.All))
+		for userID, words := range game.Words.ByUser {
+			for word := range words {
+				// Removed words are still found, so they stay removed.
+				schemaWord := schema.Word{Word: word}
+				if err := tx.Unscoped().Where("word = ?", word).
+					FirstOrCreate(&schemaWord).Error; err != nil {
+					return err
+				}
+				userDictionary := schema.UserDictionary{
+					AuthorID: userID,
+					WordID:   schemaWord.ID,
+				}
+				if err := tx.Where("author_id = ? AND word_id = ?", userID, schemaWord.ID).
+					FirstOrCreate(&userDictionary).Error; err != nil {
+					return err
+				}
+
+				gameWords = append(gameWords, schema.GameWord{
+					PlayerWordID: userDictionary.ID,
+					GuessedByID:  game.Process.GuessedWords[word],
+					GameID:       schemaGame.ID,
+				})
+
+			}
+		}
+
+		if err := tx.Create(gameWords).Error; err != nil {
+			return err
+		}
+
+		return nil
+	}))
+}
+
+func (p *Postgres) GetUserStatistics(id uint) (containers.Statistics, *DatabaseError) {
+	defer observe("GetUserStatistics", time.Now())
+	type Result struct {
+		FirstID  uint
+		SecondID uint
+		Score    int
+		ID       uint
+	}
+
+	words := make([]containers.Word, 0)
+	var numGames int64
+	var numWins int64
+	var numTies int64
+	var res Result
+	err := p.db.Transaction(func(tx *gorm.DB) error {
+		rows, err := tx.Model(&schema.UserDictionary{}).
+			Limit(5).
+			Select("words.word, count(words.word) as count").
+			Joins("left join words on user_dictionaries.word_id = words.id").
+			Where("author_id = ?", id).Group("words.word").
+			Order("count(words.word) desc").Rows()
+		if err != nil {
+			return err
+		}
+
+		var word string
+		var count int
+		for rows.Next() {
+			err = rows.Scan(&word, &count)
+			if err != nil {
+				return err
+			}
+			words = append(words, containers.Word{Word: word, Count: count})
+		}
+
+		if err := tx.Model(&schema.PlayerGame{}).
+			Select("game_id").Where("user_id = ?", id).
+			Count(&numGames).Error; err != nil {
+			return err
+		}
+
+		rows, err = tx.Raw(`
+			select teams.first_id, teams.second_id, results.score, games.id
+			from game_results
+			left join games on game_results.game_id = games.id
+			left join results on results.id = game_results.result_id
+			left join teams on teams.id = results.team_id
+			where results.score = (
+				select max(results2.score) from game_results as game_results2
+				left join results as results2 on game_results2.result_id = results2.id
+				where game_results2.game_id = games.id);`).Rows()
+		if err != nil {
+			return err
+		}
+
+		results := make(map[uint][]containers.Result)
+		for rows.Next() {
+			if err := tx.ScanRows(rows, &res); err != nil {
+				return err
+			}
+			results[res.ID] = append(
+				results[res.ID],
+				containers.Result{
+					FirstID:  res.FirstID,
+					SecondID: res.SecondID, Score: res.Score,
+				})
+		}
+
+		for _, res := range results {
+			if containers.Contains(res, id) {
+				if len(res) == 1 {
+					numWins += 1
+				} else {
+					numTies += 1
+				}
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return containers.Statistics{}, newQueryError(err)
+	}
+	return containers.Statistics{
+		GamesPlayed:  numGames,
+		NumberOfWins: numWins,
+		NumberOfTies: numTies,
+		TopWords:     words,
+	}, nil
+}
+
+func (p *Postgres) SaveSnapshot(snapshot game.Snapshot) *DatabaseError {
+	defer observe("SaveSnapshot", time.Now())
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return newInsertError(err)
+	}
+	return newInsertError(p.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "game_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"data", "updated_at"}),
+	}).Create(&schema.GameSnapshot{GameID: snapshot.ID, Data: data}).Error)
+}
+
+func (p *Postgres) GetSnapshots() ([]game.Snapshot, *DatabaseError) {
+	defer observe("GetSnapshots", time.Now())
+	var rows []schema.GameSnapshot
+	if err := p.db.Order("game_id").Find(&rows).Error; err != nil {
+		return nil, newQueryError(err)
+	}
+
+	snapshots := make([]game.Snapshot, 0, len(rows))
+	for _, row := range rows {
+		var snapshot game.Snapshot
+		if err := json.Unmarshal(row.Data, &snapshot); err != nil {
+			return nil, newQueryError(fmt.Errorf("snapshot for game %d: %w", row.GameID, err))
+		}
+		snapshots = append(snapshots, snapshot)
+	}
+	return snapshots, nil
+}
+
+func (p *Postgres) DeleteSnapshot(gameID uint) *DatabaseError {
+	defer observe("DeleteSnapshot", time.Now())
+	return newQueryError(
+		p.db.Unscoped().Where("game_id = ?", gameID).Delete(&schema.GameSnapshot{}).Error)
+}
+
+func (p *Postgres) AddGameEvents(entries []game.LogEntry) *DatabaseError {
+	defer observe("AddGameEvents", time.Now())
+	if len(entries) == 0 {
+		return nil
+	}
+
+	rows := make([]schema.GameEvent, 0, len(entries))
+	for _, entry := range entries {
+		data, err := json.Marshal(entry)
+		if err != nil {
+			return newInsertError(err)
+		}
+		row := schema.GameEvent{
+			GameKey: entry.Key,
+			Seq:     entry.Seq,
+			GameID:  entry.GameID,
+			Source:  string(entry.Source),
+			Data:    data,
+		}
+		if entry.Command != nil {
+			row.Type = string(entry.Command.Type)
+		}
+		if entry.Event != nil {
+			row.Type = string(entry.Event.Type)
+		}
+		rows = append(rows, row)
+	}
+	return newInsertError(p.db.Create(&rows).Error)
+}
+
+func (p *Postgres) GetGameEvents(key string) ([]game.LogEntry, *DatabaseError) {
+	defer observe("GetGameEvents", time.Now())
+	var rows []schema.GameEvent
+	if err := p.db.Where("game_key = ?", key).Order("seq").Find(&rows).Error; err != nil {
+		return nil, newQueryError(err)
+	}
+
+	entries := make([]game.LogEntry, 0, len(rows))
+	for _, row := range rows {
+		var entry game.LogEntry
+		if err := json.Unmarshal(row.Data, &entry); err != nil {
+			return nil, newQueryError(fmt.Errorf("event %d of game %s: %w", row.Seq, key, err))
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func (p *Postgres) GetLastGameEventSeq(key string) (int, *DatabaseError) {
+	defer observe("GetLastGameEventSeq", time.Now())
+	var seq int
+	err := p.db.Model(&schema.GameEvent{}).
+		Select("coalesce(max(seq), 0)").
+		Where("game_key = ?", key).
+		Scan(&seq).Error
+	return seq, newQueryError(err)
+}
+
+func (p *Postgres) AddFlag(flag *schema.Flag) (uint, *DatabaseError) {
+	defer observe("AddFlag", time.Now())
+	if err := p.db.Create(flag).Error; err != nil {
+		return 0, newInsertError(err)
+	}
+	return flag.ID, nil
+}
+
+func (p *Postgres) GetFlags(resolved bool, limit int) ([]schema.Flag, *DatabaseError) {
+	defer observe("GetFlags", time.Now())
+	query := p.db.Order("id desc").Limit(limit)
+	if resolved {
+		query = query.Where("resolved_at is not null")
+	} else {
+		query = query.Where("resolved_at is null")
+	}
+	var flags []schema.Flag
+	err := query.Find(&flags).Error
+	return flags, newQueryError(err)
+}
+
+func (p *Postgres) ResolveFlag(id uint, adminID uint) (bool, *DatabaseError) {
+	defer observe("ResolveFlag", time.Now())
+	result := p.db.Model(&schema.Flag{}).
+		Where("id = ? and resolved_at is null", id).
+		Updates(map[string]interface{}{
+			"resolved_at": time.Now(),
+			"resolved_by": adminID,
+		})
+	return result.RowsAffected > 0, newUpdateError(result.Error)
+}
+
+func (p *Postgres) AddAuditEntry(entry *schema.AuditEntry) *DatabaseError {
+	defer observe("AddAuditEntry", time.Now())
+	return newInsertError(p.db.Create(entry).Error)
+}
+
+func (p *Postgres) GetAuditLog(limit int) ([]schema.AuditEntry, *DatabaseError) {
+	defer observe("GetAuditLog", time.Now())
+	var entries []schema.AuditEntry
+	err := p.db.Order("id desc").Limit(limit).Find(&entries).Error
+	return entries, newQueryError(err)
+}
@@ -0,0 +1,66 @@
+package database
+
+import (
+	"time"
+
+	"github.com/bitterfly/go-chaos/hatgame/game"
+	"github.com/bitterfly/go-chaos/hatgame/schema"
+	"github.com/bitterfly/go-chaos/hatgame/server/containers"
+)
+
+type Store interface {
+	// Ready checks that the store can be used, for postgres that it is
+	// reachable and all migrations are applied.
+	Ready() *DatabaseError
+
+	AddUser(user *schema.User) (uint, *DatabaseError)
+	GetUserByID(id uint) (*schema.User, *DatabaseError)
+	GetUserByEmail(email string) (*schema.User, *DatabaseError)
+	UpdateUser(id uint, password []byte, username string) *DatabaseError
+	UpdateUserPassword(id uint, password []byte) *DatabaseError
+	UpdateUserUsername(id uint, username string) *DatabaseError
+	UpdateUserRole(id uint, role string) *DatabaseError
+	UpdateUserStatus(id uint, status string) *DatabaseError
+	SearchUsers(query string, limit int) ([]schema.User, *DatabaseError)
+
+	AddSession(session *schema.Session) (uint, *DatabaseError)
+	GetSession(id uint) (*schema.Session, *DatabaseError)
+	FindSessionByRefreshHash(hash string) (*schema.Session, *DatabaseError)
+	RotateSession(id uint, oldHash string, newHash string, expiresAt time.Time) *DatabaseError
+	RevokeSession(id uint) *DatabaseError
+	RevokeUserSessions(userID uint) *DatabaseError
+
+	// AddTicket also drops the tickets that have expired.
+	AddTicket(ticket *schema.Ticket) *DatabaseError
+	// RedeemTicket deletes the ticket and returns it if it has not expired.
+	RedeemTicket(hash string) (*schema.Ticket, *DatabaseError)
+
+	AddWords(id uint, words []string) *DatabaseError
+	RecommendWord(n int, id uint, seed uint64) ([]string, *DatabaseError)
+	// RemoveWord takes the word out of the recommendations for good and
+	// reports whether it was there.
+	RemoveWord(word string) (bool, *DatabaseError)
+
+	AddGame(game *game.Game) *DatabaseError
+	GetUserStatistics(id uint) (containers.Statistics, *DatabaseError)
+
+	SaveSnapshot(snapshot game.Snapshot) *DatabaseError
+	GetSnapshots() ([]game.Snapshot, *DatabaseError)
+	DeleteSnapshot(gameID uint) *DatabaseError
+
+	AddGameEvents(entries []game.LogEntry) *DatabaseError
+	GetGameEvents(key string) ([]game.LogEntry, *DatabaseError)
+	GetLastGameEventSeq(key string) (int, *DatabaseError)
+
+	AddFlag(flag *schema.Flag) (uint, *DatabaseError)
+	GetFlags(resolved bool, limit int) ([]schema.Flag, *DatabaseError)
+	ResolveFlag(id uint, adminID uint) (bool, *DatabaseError)
+
+	AddAuditEntry(entry *schema.AuditEntry) *DatabaseError
+	GetAuditLog(limit int) ([]schema.AuditEntry, *DatabaseError)
+}
+
+var (
+	_ Store = &Postgres{}
+	_ Store = &Memory{}
+)
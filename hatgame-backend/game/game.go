@@ -1,11 +1,13 @@
 package game
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
-	"math/rand"
+	mathrand "math/rand"
 	"sort"
-	"sync"
 	"time"
 
 	"github.com/bitterfly/go-chaos/hatgame/server/containers"
@@ -28,8 +30,32 @@ const (
 	EventAddWord          EventType = "add_word"
 	EventReadyStoryteller EventType = "ready_storyteller"
 	EventGuess            EventType = "guess"
+	EventDisconnected     EventType = "player_disconnected"
+	EventAbort            EventType = "abort"
+	EventAborted          EventType = "aborted"
+	EventServerShutdown   EventType = "server_shutdown"
+	EventReconnected      EventType = "player_reconnected"
+	EventJoin             EventType = "join"
+	EventJoined           EventType = "joined"
+	EventAbandon          EventType = "abandon"
+	EventAuth             EventType = "auth"
+	EventAck              EventType = "ack"
+	EventConnected        EventType = "connected"
+	EventClose            EventType = "close"
+	EventClosed           EventType = "closed"
 )
 
+type Phase string
+
+const (
+	PhaseLobby Phase = "lobby"
+	PhaseWords Phase = "words"
+	PhaseGuess Phase = "guess"
+	PhaseEnded Phase = "ended"
+)
+
+const eventsBufferSize = 64
+
 type Event struct {
 	Type      EventType
 	Msg       interface{}
@@ -37,51 +63,334 @@ type Event struct {
 	GameID    uint
 }
 
+type Command struct {
+	Type   EventType
+	Player uint
+	Word   string           `json:",omitempty"`
+	User   *containers.User `json:",omitempty"`
+}
+
 type Game struct {
 	ID         uint
+	Key        string
 	Host       uint
 	NumPlayers int
 	Timer      int
 	NumWords   int
 	Players    Players
-	Words      Words      `json:"-"`
-	Process    Process    `json:"-"`
-	Events     chan Event `json:"-"`
+	Words      Words          `json:"-"`
+	Process    Process        `json:"-"`
+	Events     chan Event     `json:"-"`
+	Persist    func(Snapshot) `json:"-"`
+	Record     func(LogEntry) `json:"-"`
+	Seq        int            `json:"-"`
+	Seed       int64          `json:"-"`
+	source     *countingSource
+	rand       *mathrand.Rand
+	commands   chan func()
+	ticker     *time.Ticker
+	ctx        context.Context
+	cancel     context.CancelFunc
+	stopped    chan struct{}
+	dirty      bool
+	replaying  bool
+}
+
+type Info struct {
+	ID         uint
+	Host       uint
+	NumPlayers int
+	Timer      int
+	NumWords   int
+	Players    []containers.User
 }
 
 type Players struct {
-	IDs   map[uint]struct{}
-	Users map[containers.User]struct{}
+	IDs          map[uint]struct{}
+	Users        map[containers.User]struct{}
+	Disconnected map[uint]struct{}
 }
 
 func (p Players) MarshalJSON() ([]byte, error) {
-	Players := make([]containers.User, 0, len(p.Users))
+	return json.Marshal(p.list())
+}
+
+func (p Players) list() []containers.User {
+	players := make([]containers.User, 0, len(p.Users))
 	for v := range p.Users {
-		Players = append(Players, v)
+		players = append(players, v)
 	}
-	return json.Marshal(Players)
+	sort.Slice(players, func(i, j int) bool {
+		return players[i].ID < players[j].ID
+	})
+	return players
 }
 
 type Words struct {
 	ByUser map[uint]map[string]struct{}
 	All    map[string]struct{}
-	Mutex  *sync.RWMutex
 }
 
 type Process struct {
+	Phase        Phase
 	WordID       int
 	Storyteller  int
 	Teams        []uint
 	Result       []containers.Result
 	GuessedWords map[string]uint
-	Mutex        *sync.RWMutex
-	GameEnd      chan struct{}
+	InTurn       bool
+	Remaining    int
+	Story        string
+	Finished     bool
+	Aborted      bool
 }
 
-func (g *Game) GuessWord(word string) {
-	g.Process.Mutex.Lock()
-	defer g.Process.Mutex.Unlock()
-	g.Process.GuessedWords[word] = g.Process.Teams[g.Process.Storyteller]
+func NewGame(
+	ctx context.Context,
+	gameID uint,
+	host containers.User,
+	numPlayers, numWords, timer int,
+	seed int64,
+) *Game {
+	ctx, cancel := context.WithCancel(ctx)
+	wordsByUser := make(map[uint]map[string]struct{})
+	wordsByUser[host.ID] = make(map[string]struct{})
+	words := make(map[string]struct{})
+	source := newSource(seed, 0)
+
+	return &Game{
+		ID:     gameID,
+		Key:    newKey(),
+		Seed:   seed,
+		source: source,
+		rand:   mathrand.New(source),
+		Words: Words{
+			ByUser: wordsByUser,
+			All:    words,
+		},
+		Process: Process{
+			Phase:        PhaseLobby,
+			Teams:        make([]uint, 0, numPlayers),
+			GuessedWords: make(map[string]uint),
+			Storyteller:  0,
+			WordID:       0,
+		},
+		NumPlayers: numPlayers,
+		NumWords:   numWords,
+		Timer:      timer,
+		Host:       host.ID,
+		Events:     make(chan Event, eventsBufferSize),
+		commands:   make(chan func()),
+		ctx:        ctx,
+		cancel:     cancel,
+		stopped:    make(chan struct{}),
+		Players: Players{
+			IDs:          map[uint]struct{}{host.ID: {}},
+			Users:        map[containers.User]struct{}{host: {}},
+			Disconnected: make(map[uint]struct{}),
+		},
+	}
+}
+
+func newKey() string {
+	key := make([]byte, 16)
+	if _, err := rand.Read(key); err != nil {
+		panic(fmt.Sprintf("could not generate game key: %s", err))
+	}
+	return hex.EncodeToString(key)
+}
+
+func (g *Game) Run() {
+	defer close(g.stopped)
+	defer close(g.Events)
+	defer g.stopTurn()
+	defer g.cancel()
+
+	var persist *persister
+	if g.Persist != nil {
+		persist = newPersister(g.Persist)
+		// The last snapshot is saved before the events are closed, so it can
+		// not undo what the server does with a game that has stopped.
+		defer persist.close()
+	}
+
+	snapshot := g.snapshot()
+	g.record(LogEntry{Source: SourceStart, Snapshot: &snapshot})
+
+	// A game restored in the middle of a turn goes on with the time it had left.
+	if g.Process.InTurn && g.ticker == nil {
+		g.ticker = time.NewTicker(1 * time.Second)
+	}
+
+	for {
+		var tick <-chan time.Time
+		if g.ticker != nil {
+			tick = g.ticker.C
+		}
+
+		select {
+		case <-g.ctx.Done():
+			return
+		case command := <-g.commands:
+			command()
+		case <-tick:
+			g.record(LogEntry{Source: SourceTick})
+			g.tick()
+		}
+
+		if g.dirty {
+			g.dirty = false
+			if persist != nil {
+				persist.put(g.snapshot())
+			}
+		}
+	}
+}
+
+func (g *Game) Done() <-chan struct{} {
+	return g.stopped
+}
+
+func (g *Game) Stop() {
+	g.cancel()
+}
+
+func (g *Game) do(command func()) bool {
+	done := make(chan struct{})
+	select {
+	case g.commands <- func() {
+		defer close(done)
+		command()
+	}:
+		<-done
+		return true
+	case <-g.ctx.Done():
+		return false
+	}
+}
+
+func (g *Game) Handle(command Command) error {
+	err := fmt.Errorf("game has ended")
+	g.do(func() {
+		g.record(LogEntry{Source: SourceCommand, Command: &command})
+		err = g.apply(command)
+	})
+	return err
+}
+
+func (g *Game) apply(command Command) error {
+	switch command.Type {
+	case EventJoin:
+		if command.User == nil {
+			return fmt.Errorf("missing user for join command")
+		}
+		return g.addPlayer(*command.User)
+	case EventJoined:
+		g.notifyJoined(command.Player)
+	case EventDisconnected:
+		g.disconnectPlayer(command.Player)
+	case EventAbandon:
+		g.abandonIfEmpty()
+	case EventAddWord:
+		g.addWord(command.Player, command.Word)
+	case EventRequestToStart:
+		g.startWordPhase()
+	case EventReadyStoryteller:
+		g.makeTurn(command.Player)
+	case EventGuess:
+		g.guessWord(command.Word)
+	case EventAbort:
+		g.abort(command.Player)
+	case EventClose:
+		g.close()
+	default:
+		return fmt.Errorf("unknown command %q", command.Type)
+	}
+	return nil
+}
+
+func (g *Game) end() {
+	g.stopTurn()
+	NotifyGameEnded(g)
+	g.Process.Phase = PhaseEnded
+	g.Process.Finished = true
+	g.dirty = true
+	g.cancel()
+}
+
+func (g *Game) receivers() map[uint]struct{} {
+	receivers := make(map[uint]struct{}, len(g.Players.IDs))
+	for id := range g.Players.IDs {
+		receivers[id] = struct{}{}
+	}
+	return receivers
+}
+
+func (g *Game) connected(except uint) map[uint]struct{} {
+	receivers := make(map[uint]struct{})
+	for id := range g.Players.IDs {
+		if _, ok := g.Players.Disconnected[id]; !ok && id != except {
+			receivers[id] = struct{}{}
+		}
+	}
+	return receivers
+}
+
+func (g *Game) emit(eventType EventType, msg interface{}, receivers map[uint]struct{}) {
+	event := Event{
+		GameID:    g.ID,
+		Type:      eventType,
+		Msg:       msg,
+		Receivers: receivers,
+	}
+	g.record(LogEntry{Source: SourceEvent, Event: &event})
+	if g.replaying {
+		return
+	}
+
+	select {
+	case g.Events <- event:
+	case <-g.ctx.Done():
+	}
+}
+
+func (g *Game) emitError(id uint, err error) {
+	g.emit(EventError, err.Error(), map[uint]struct{}{id: {}})
+}
+
+func (g *Game) Info() Info {
+	var info Info
+	g.do(func() {
+		info = g.info()
+	})
+	return info
+}
+
+func (g *Game) info() Info {
+	return Info{
+		ID:         g.ID,
+		Host:       g.Host,
+		NumPlayers: g.NumPlayers,
+		Timer:      g.Timer,
+		NumWords:   g.NumWords,
+		Players:    g.Players.list(),
+	}
+}
+
+func (g *Game) Phase() Phase {
+	phase := PhaseEnded
+	g.do(func() {
+		phase = g.Process.Phase
+	})
+	return phase
+}
+
+func (g *Game) IsPlayer(id uint) bool {
+	var ok bool
+	g.do(func() {
+		_, ok = g.Players.IDs[id]
+	})
+	return ok
 }
 
 func (g *Game) GetResults() {
@@ -108,23 +417,7 @@ func (g *Game) GetResults() {
 	})
 }
 
-func (g *Game) GetNextWord() {
-	word, found := g.nextWord()
-	if !found {
-		NotifyGameEnded(g)
-		close(g.Process.GameEnd)
-		close(g.Events)
-		return
-	}
-	NotifyWord(g, word)
-}
-
 func (g *Game) nextWord() (string, bool) {
-	g.Process.Mutex.RLock()
-	defer g.Process.Mutex.RUnlock()
-	g.Words.Mutex.RLock()
-	defer g.Words.Mutex.RUnlock()
-
 	if len(g.Words.All) == len(g.Process.GuessedWords) {
 		return "", false
 	}
@@ -135,73 +428,125 @@ func (g *Game) nextWord() (string, bool) {
 			unguessed = append(unguessed, word)
 		}
 	}
+	sort.Strings(unguessed)
 
-	return unguessed[rand.Intn(len(unguessed))], true
+	return unguessed[g.rand.Intn(len(unguessed))], true
 }
 
-func NewGame(gameID uint, host containers.User, numPlayers, numWords, timer int) *Game {
-	wordsByUser := make(map[uint]map[string]struct{})
-	wordsByUser[host.ID] = make(map[string]struct{})
-	words := make(map[string]struct{})
-	rand.Seed(time.Now().UnixNano())
-
-	return &Game{
-		ID: gameID,
-		Words: Words{
-			ByUser: wordsByUser,
-			All:    words,
-			Mutex:  &sync.RWMutex{},
-		},
-		Process: Process{
-			Teams:        make([]uint, 0, numPlayers),
-			GuessedWords: make(map[string]uint),
-			Mutex:        &sync.RWMutex{},
-			GameEnd:      make(chan struct{}),
-			Storyteller:  0,
-			WordID:       0,
-		},
-		NumPlayers: numPlayers,
-		NumWords:   numWords,
-		Timer:      timer,
-		Host:       host.ID,
-		Events:     make(chan Event),
-		Players: Players{
-			IDs:   map[uint]struct{}{host.ID: {}},
-			Users: map[containers.User]struct{}{host: {}},
-		},
-	}
+func (g *Game) AddPlayer(user containers.User) error {
+	return g.Handle(Command{Type: EventJoin, Player: user.ID, User: &user})
 }
 
-func (g *Game) AddPlayer(user containers.User) bool {
+func (g *Game) addPlayer(user containers.User) error {
+	if _, ok := g.Players.Disconnected[user.ID]; ok {
+		delete(g.Players.Disconnected, user.ID)
+		g.dirty = true
+		g.emit(EventReconnected, user.ID, g.connected(user.ID))
+		return nil
+	}
+	if g.Process.Phase != PhaseLobby {
+		return fmt.Errorf("game has already started")
+	}
 	if len(g.Players.IDs) == g.NumPlayers {
-		g.Events <- Event{
-			GameID:    g.ID,
-			Type:      EventError,
-			Msg:       "too many players",
-			Receivers: map[uint]struct{}{user.ID: {}},
-		}
-		return false
+		return fmt.Errorf("too many players")
 	}
 	if _, ok := g.Players.IDs[user.ID]; ok {
-		g.Events <- Event{
-			GameID:    g.ID,
-			Type:      EventError,
-			Msg:       "player already in game",
-			Receivers: map[uint]struct{}{user.ID: {}},
-		}
-		return false
+		return fmt.Errorf("player already in game")
 	}
-	g.Words.Mutex.Lock()
-	defer g.Words.Mutex.Unlock()
 	g.Words.ByUser[user.ID] = make(map[string]struct{})
 	g.Players.IDs[user.ID] = struct{}{}
 	g.Players.Users[user] = struct{}{}
-	return true
+	g.dirty = true
+	return nil
+}
+
+func (g *Game) NotifyJoined(id uint) {
+	g.Handle(Command{Type: EventJoined, Player: id})
+}
+
+func (g *Game) notifyJoined(id uint) {
+	g.emit(EventGameInfo, g.info(), g.receivers())
+	switch g.Process.Phase {
+	case PhaseLobby:
+		if len(g.Players.IDs) == g.NumPlayers {
+			g.emit(EventReadyToStart, nil, map[uint]struct{}{g.Host: {}})
+		}
+	case PhaseWords:
+		player := map[uint]struct{}{id: {}}
+		g.emit(EventWordPhaseStart, nil, player)
+		for word := range g.Words.ByUser[id] {
+			g.emit(EventAddWord, word, player)
+		}
+	case PhaseGuess:
+		player := map[uint]struct{}{id: {}}
+		for i, teammate := range g.Process.Teams {
+			if teammate == id {
+				g.emit(EventTeam, g.teammate(i), player)
+			}
+		}
+		g.emit(EventGuessPhaseStart, g.Process.Teams[g.Process.Storyteller], player)
+		if g.Process.InTurn && g.Process.Teams[g.Process.Storyteller] == id {
+			g.emit(EventStory, g.Process.Story, player)
+		}
+	}
+}
+
+func (g *Game) DisconnectPlayer(id uint) {
+	g.Handle(Command{Type: EventDisconnected, Player: id})
+}
+
+func (g *Game) disconnectPlayer(id uint) {
+	if _, ok := g.Players.Disconnected[id]; ok {
+		return
+	}
+	g.Players.Disconnected[id] = struct{}{}
+	g.dirty = true
+	receivers := g.connected(id)
+	if len(receivers) == 0 {
+		g.Process.Aborted = true
+		g.cancel()
+		return
+	}
+	g.emit(EventDisconnected, id, receivers)
+}
+
+func (g *Game) AbandonIfEmpty() {
+	g.Handle(Command{Type: EventAbandon})
+}
+
+func (g *Game) abandonIfEmpty() {
+	if len(g.connected(0)) == 0 {
+		g.Process.Aborted = true
+		g.cancel()
+	}
 }
 
-func (g *Game) addWord(id uint, word string) error {
-	g.Words.Mutex.Lock()
-	defer g.Words.Mutex.Unlock()
+func (g *Game) Abort(id uint) error {
+	return g.Handle(Command{Type: EventAbort, Player: id})
+}
+
+func (g *Game) abort(id uint) {
+	if id != g.Host {
+		g.emitError(id, fmt.Errorf("only the host can abort the game"))
+		return
+	}
+	g.emit(EventAborted, id, g.receivers())
+	g.Process.Aborted = true
+	g.cancel()
+}
+
+// Close ends the game for everyone, it is not played to the end.
+func (g *Game) Close() error {
+	return g.Handle(Command{Type: EventClose})
+}
+
+func (g *Game) close() {
+	g.emit(EventClosed, nil, g.receivers())
+	g.Process.Aborted = true
+	g.cancel()
+}
+
+func (g *Game) checkWord(id uint, word string) error {
 	if _, ok := g.Players.IDs[id]; !ok {
 		return fmt.Errorf("no player with id %d", id)
 	}
@@ -211,52 +556,45 @@ func (g *Game) addWord(id uint, word string) error {
 	if _, ok := g.Words.All[word]; ok {
 		return fmt.Errorf("already used this word")
 	}
-	g.Words.ByUser[id][word] = struct{}{}
-	g.Words.All[word] = struct{}{}
 	return nil
 }
 
-func (g *Game) AddWord(id uint, word string) {
-	err := g.addWord(id, word)
+func (g *Game) AddWord(id uint, word string) error {
+	return g.Handle(Command{Type: EventAddWord, Player: id, Word: word})
+}
 
-	if err != nil {
-		g.Events <- Event{
-			GameID:    g.ID,
-			Type:      EventError,
-			Msg:       err.Error(),
-			Receivers: map[uint]struct{}{id: {}},
-		}
+func (g *Game) addWord(id uint, word string) {
+	if err := g.checkWord(id, word); err != nil {
+		g.emitError(id, err)
 		return
 	}
 
-	g.Events <- Event{
-		GameID:    g.ID,
-		Type:      EventAddWord,
-		Msg:       word,
-		Receivers: map[uint]struct{}{id: {}},
-	}
+	g.Words.ByUser[id][word] = struct{}{}
+	g.Words.All[word] = struct{}{}
+	g.dirty = true
+	g.emit(EventAddWord, word, map[uint]struct{}{id: {}})
 
-	if g.CheckWordsFinished() {
-		g.MakeTeams()
+	if g.wordsFinished() {
+		g.Process.Phase = PhaseGuess
+		g.makeTeams()
 		NotifyGuessPhaseStart(g)
 		NotifyStoryteller(g)
 	}
 }
 
-func (g *Game) CheckWordsFinished() bool {
-	g.Words.Mutex.RLock()
-	defer g.Words.Mutex.RUnlock()
+func (g *Game) wordsFinished() bool {
 	return len(g.Words.All) == g.NumPlayers*g.NumWords
 }
 
-func (g *Game) MakeTeams() {
-	g.Words.Mutex.RLock()
+func (g *Game) makeTeams() {
 	for id := range g.Words.ByUser {
 		g.Process.Teams = append(g.Process.Teams, id)
 	}
-	g.Words.Mutex.RUnlock()
+	sort.Slice(g.Process.Teams, func(i, j int) bool {
+		return g.Process.Teams[i] < g.Process.Teams[j]
+	})
 
-	rand.Shuffle(
+	g.rand.Shuffle(
 		len(g.Process.Teams),
 		func(i, j int) {
 			g.Process.Teams[i], g.Process.Teams[j] = g.Process.Teams[j], g.Process.Teams[i]
@@ -264,92 +602,120 @@ func (g *Game) MakeTeams() {
 	)
 }
 
-func (g *Game) StartWordPhase() {
-	g.Events <- Event{
-		GameID:    g.ID,
-		Type:      EventWordPhaseStart,
-		Receivers: g.Players.IDs,
-	}
+func (g *Game) StartWordPhase(id uint) error {
+	return g.Handle(Command{Type: EventRequestToStart, Player: id})
 }
 
-func NotifyGuessPhaseStart(g *Game) {
-	for i, id := range g.Process.Teams {
-		g.Events <- Event{
-			GameID:    g.ID,
-			Type:      EventTeam,
-			Msg:       g.Process.Teams[(i+int(float64(g.NumPlayers)/2))%g.NumPlayers],
-			Receivers: map[uint]struct{}{id: {}},
-		}
+func (g *Game) startWordPhase() {
+	if g.Process.Phase == PhaseLobby {
+		g.Process.Phase = PhaseWords
+		g.dirty = true
 	}
+	g.emit(EventWordPhaseStart, nil, g.receivers())
 }
 
-func NotifyGameEnded(game *Game) {
-	game.GetResults()
-	game.Events <- Event{
-		GameID:    game.ID,
-		Receivers: game.Players.IDs,
-		Type:      EventEnd,
-		Msg:       game.Process.Result,
-	}
+func (g *Game) GuessWord(id uint, word string) error {
+	return g.Handle(Command{Type: EventGuess, Player: id, Word: word})
 }
 
-func NotifyStoryteller(game *Game) {
-	game.Events <- Event{
-		GameID:    game.ID,
-		Type:      EventGuessPhaseStart,
-		Msg:       game.Process.Teams[game.Process.Storyteller],
-		Receivers: game.Players.IDs,
+func (g *Game) guessWord(word string) {
+	if len(g.Process.Teams) == 0 {
+		return
 	}
-}
+	if _, ok := g.Words.All[word]; !ok {
+		return
+	}
+	if _, ok := g.Process.GuessedWords[word]; ok {
+		return
+	}
+	g.Process.GuessedWords[word] = g.Process.Teams[g.Process.Storyteller]
+	g.dirty = true
 
-func NotifyWord(game *Game, story string) {
-	game.Events <- Event{
-		GameID: game.ID,
-		Receivers: map[uint]struct{}{
-			game.Process.Teams[game.Process.Storyteller]: {}},
-		Type: EventStory,
-		Msg:  story,
+	next, found := g.nextWord()
+	if !found {
+		g.end()
+		return
 	}
+	NotifyWord(g, next)
 }
 
-func (g *Game) MakeTurn(id uint) {
-	story, found := g.nextWord()
+func (g *Game) MakeTurn(id uint) error {
+	return g.Handle(Command{Type: EventReadyStoryteller, Player: id})
+}
 
+func (g *Game) makeTurn(id uint) {
+	if g.Process.InTurn || len(g.Process.Teams) == 0 {
+		return
+	}
+
+	story, found := g.nextWord()
 	if !found {
-		NotifyGameEnded(g)
+		g.end()
 		return
 	}
 
 	NotifyWord(g, story)
+	g.Process.InTurn = true
+	g.Process.Remaining = g.Timer
+	g.dirty = true
+	if !g.replaying {
+		g.ticker = time.NewTicker(1 * time.Second)
+	}
+}
 
-	timer := time.NewTicker(1 * time.Second)
-	defer timer.Stop()
-	go tick(g, timer)
-	for {
-		select {
-		case <-time.After(time.Duration(g.Timer) * time.Second):
-			fmt.Println("Timer out")
-			g.Process.Storyteller = (g.Process.Storyteller + 1) % g.NumPlayers
-			NotifyStoryteller(g)
-			return
-		case _, ok := <-g.Process.GameEnd:
-			if !ok {
-				return
-			}
-		}
+func (g *Game) stopTurn() {
+	g.Process.InTurn = false
+	g.Process.Story = ""
+	if g.ticker != nil {
+		g.ticker.Stop()
+		g.ticker = nil
 	}
 }
 
-func tick(game *Game, timer *time.Ticker) {
-	i := game.Timer
-	for _ = range timer.C {
-		fmt.Println("tick")
-		i -= 1
-		game.Events <- Event{
-			GameID:    game.ID,
-			Type:      EventTick,
-			Msg:       i,
-			Receivers: game.Players.IDs,
-		}
+func (g *Game) tick() {
+	if !g.Process.InTurn {
+		return
 	}
+
+	g.Process.Remaining -= 1
+	g.dirty = true
+	g.emit(EventTick, g.Process.Remaining, g.receivers())
+	if g.Process.Remaining > 0 {
+		return
+	}
+
+	g.stopTurn()
+	g.Process.Storyteller = (g.Process.Storyteller + 1) % g.NumPlayers
+	g.dirty = true
+	NotifyStoryteller(g)
+}
+
+func (g *Game) teammate(i int) uint {
+	return g.Process.Teams[(i+int(float64(g.NumPlayers)/2))%g.NumPlayers]
+}
+
+func NotifyGuessPhaseStart(g *Game) {
+	for i, id := range g.Process.Teams {
+		g.emit(EventTeam, g.teammate(i), map[uint]struct{}{id: {}})
+	}
+}
+
+func NotifyGameEnded(game *Game) {
+	game.GetResults()
+	game.emit(EventEnd, game.Process.Result, game.receivers())
+}
+
+func NotifyStoryteller(game *Game) {
+	game.emit(
+		EventGuessPhaseStart,
+		game.Process.Teams[game.Process.Storyteller],
+		game.receivers())
+}
+
+func NotifyWord(game *Game, story string) {
+	game.Process.Story = story
+	game.emit(
+		EventStory,
+		story,
+		map[uint]struct{}{game.Process.Teams[game.Process.Storyteller]: {}})
 }
@@ -0,0 +1,545 @@
+package game
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"runtime"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bitterfly/go-chaos/hatgame/server/containers"
+)
+
+const testTimeout = 10 * time.Second
+
+func testUser(id uint) containers.User {
+	return containers.User{ID: id, Email: fmt.Sprintf("%d@example.com", id), Username: fmt.Sprintf("player%d", id)}
+}
+
+func testWord(player uint, i int) string {
+	return fmt.Sprintf("word-%d-%d", player, i)
+}
+
+// collect reads the events of the game until it closes them.
+func collect(g *Game) <-chan []Event {
+	result := make(chan []Event, 1)
+	go func() {
+		events := make([]Event, 0)
+		for event := range g.Events {
+			events = append(events, event)
+		}
+		result <- events
+	}()
+	return result
+}
+
+func waitEvents(t *testing.T, events <-chan []Event) []Event {
+	t.Helper()
+	select {
+	case result := <-events:
+		return result
+	case <-time.After(testTimeout):
+		t.Fatal("the game did not close its events")
+		return nil
+	}
+}
+
+// checkLeaks fails the test if goroutines it started are still running at its
+// end.
+func checkLeaks(t *testing.T) {
+	before := runtime.NumGoroutine()
+	t.Cleanup(func() {
+		deadline := time.Now().Add(time.Second)
+		for runtime.NumGoroutine() > before {
+			if time.Now().After(deadline) {
+				stacks := make([]byte, 1<<16)
+				n := runtime.Stack(stacks, true)
+				t.Errorf("%d goroutines left behind:\n%s", runtime.NumGoroutine()-before, stacks[:n])
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	})
+}
+
+// checkClosed checks that the game stopped and that its events stay closed.
+func checkClosed(t *testing.T, g *Game) {
+	t.Helper()
+	select {
+	case <-g.Done():
+	case <-time.After(testTimeout):
+		t.Fatal("the game did not stop")
+	}
+	if _, ok := <-g.Events; ok {
+		t.Error("events are still open")
+	}
+}
+
+func hasEvent(events []Event, eventType EventType) bool {
+	for _, event := range events {
+		if event.Type == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// play runs a game of two players with two words each to the end, sending
+// the same commands in the same order every time.
+func play(t *testing.T, g *Game) {
+	t.Helper()
+	guest := testUser(2)
+	commands := []Command{
+		{Type: EventJoin, Player: 2, User: &guest},
+		{Type: EventJoined, Player: 1},
+		{Type: EventJoined, Player: 2},
+		{Type: EventRequestToStart, Player: 1},
+	}
+	words := make([]string, 0)
+	for id := uint(1); id <= 2; id++ {
+		for i := 0; i < 2; i++ {
+			commands = append(commands, Command{Type: EventAddWord, Player: id, Word: testWord(id, i)})
+			words = append(words, testWord(id, i))
+		}
+	}
+	sort.Strings(words)
+	commands = append(commands, Command{Type: EventReadyStoryteller, Player: 1})
+	for _, word := range words {
+		commands = append(commands, Command{Type: EventGuess, Player: 2, Word: word})
+	}
+
+	for _, command := range commands {
+		if err := g.Handle(command); err != nil {
+			t.Fatalf("%s of player %d: %s", command.Type, command.Player, err)
+		}
+	}
+}
+
+func TestFullGameStops(t *testing.T) {
+	checkLeaks(t)
+	g := NewGame(context.Background(), 1, testUser(1), 2, 2, 60, 42)
+	events := collect(g)
+	go g.Run()
+
+	play(t, g)
+	result := waitEvents(t, events)
+	checkClosed(t, g)
+
+	if !g.Process.Finished {
+		t.Error("the game did not finish")
+	}
+	if !hasEvent(result, EventEnd) {
+		t.Errorf("no %q event", EventEnd)
+	}
+}
+
+func TestAbortStops(t *testing.T) {
+	checkLeaks(t)
+	g := NewGame(context.Background(), 1, testUser(1), 2, 2, 60, 42)
+	events := collect(g)
+	go g.Run()
+
+	guest := testUser(2)
+	if err := g.Handle(Command{Type: EventJoin, Player: 2, User: &guest}); err != nil {
+		t.Fatalf("could not join: %s", err)
+	}
+	// Only the host can abort.
+	if err := g.Abort(2); err != nil {
+		t.Fatalf("could not send abort: %s", err)
+	}
+	if err := g.Abort(1); err != nil {
+		t.Fatalf("could not abort: %s", err)
+	}
+	result := waitEvents(t, events)
+	checkClosed(t, g)
+
+	if !g.Process.Aborted {
+		t.Error("the game is not marked aborted")
+	}
+	if !hasEvent(result, EventError) || !hasEvent(result, EventAborted) {
+		t.Errorf("want an error for the guest and %q, got %v", EventAborted, result)
+	}
+	if err := g.Abort(1); err == nil {
+		t.Error("a command after the abort was accepted")
+	}
+}
+
+func TestCancelStops(t *testing.T) {
+	checkLeaks(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	g := NewGame(ctx, 1, testUser(1), 2, 2, 60, 42)
+	events := collect(g)
+	go g.Run()
+
+	guest := testUser(2)
+	for _, command := range []Command{
+		{Type: EventJoin, Player: 2, User: &guest},
+		{Type: EventRequestToStart, Player: 1},
+		{Type: EventAddWord, Player: 1, Word: testWord(1, 0)},
+	} {
+		if err := g.Handle(command); err != nil {
+			t.Fatalf("%s: %s", command.Type, err)
+		}
+	}
+	cancel()
+	waitEvents(t, events)
+	checkClosed(t, g)
+
+	if g.Process.Finished || g.Process.Aborted {
+		t.Error("a cancelled game is marked finished or aborted")
+	}
+	if err := g.Handle(Command{Type: EventAddWord, Player: 1, Word: testWord(1, 1)}); err == nil {
+		t.Error("a command after the cancel was accepted")
+	}
+}
+
+func TestConcurrentClients(t *testing.T) {
+	checkLeaks(t)
+	const (
+		players = 8
+		words   = 3
+	)
+	g := NewGame(context.Background(), 1, testUser(1), players, words, 60, 42)
+	events := collect(g)
+	go g.Run()
+
+	var wg sync.WaitGroup
+	for id := uint(2); id <= players; id++ {
+		wg.Add(1)
+		go func(id uint) {
+			defer wg.Done()
+			user := testUser(id)
+			if err := g.Handle(Command{Type: EventJoin, Player: id, User: &user}); err != nil {
+				t.Errorf("player %d could not join: %s", id, err)
+				return
+			}
+			// Drop the connection and come back, as a flaky client would.
+			g.Handle(Command{Type: EventDisconnected, Player: id})
+			if err := g.Handle(Command{Type: EventJoin, Player: id, User: &user}); err != nil {
+				t.Errorf("player %d could not rejoin: %s", id, err)
+			}
+			g.Handle(Command{Type: EventJoined, Player: id})
+		}(id)
+	}
+	wg.Wait()
+	if t.Failed() {
+		t.FailNow()
+	}
+	if err := g.Handle(Command{Type: EventRequestToStart, Player: 1}); err != nil {
+		t.Fatalf("could not start the word phase: %s", err)
+	}
+
+	for id := uint(1); id <= players; id++ {
+		wg.Add(1)
+		go func(id uint) {
+			defer wg.Done()
+			for i := 0; i < words; i++ {
+				g.Handle(Command{Type: EventAddWord, Player: id, Word: testWord(id, i)})
+				// Words that are taken or over the limit are refused.
+				g.Handle(Command{Type: EventAddWord, Player: id, Word: testWord(id, i)})
+			}
+			g.Handle(Command{Type: EventAddWord, Player: id, Word: testWord(id, words)})
+		}(id)
+	}
+	wg.Wait()
+
+	for id := uint(1); id <= players; id++ {
+		wg.Add(1)
+		go func(id uint) {
+			defer wg.Done()
+			g.Handle(Command{Type: EventReadyStoryteller, Player: id})
+			if id != 1 {
+				g.Handle(Command{Type: EventDisconnected, Player: id})
+				user := testUser(id)
+				g.Handle(Command{Type: EventJoin, Player: id, User: &user})
+			}
+			// Everyone guesses every word at the same time, only the
+			// first guess of a word counts.
+			for player := uint(1); player <= players; player++ {
+				for i := 0; i < words; i++ {
+					g.Handle(Command{Type: EventGuess, Player: id, Word: testWord(player, i)})
+				}
+			}
+		}(id)
+	}
+	wg.Wait()
+
+	result := waitEvents(t, events)
+	<-g.Done()
+
+	if !g.Process.Finished {
+		t.Fatal("the game did not finish")
+	}
+	if got := len(g.Process.GuessedWords); got != players*words {
+		t.Errorf("guessed %d words, want %d", got, players*words)
+	}
+	score := 0
+	for _, team := range g.Process.Result {
+		score += team.Score
+	}
+	if score != players*words {
+		t.Errorf("teams scored %d, want %d", score, players*words)
+	}
+	if last := result[len(result)-1]; last.Type != EventEnd {
+		t.Errorf("last event is %q, want %q", last.Type, EventEnd)
+	}
+	if err := g.Handle(Command{Type: EventGuess, Player: 1, Word: testWord(1, 0)}); err == nil {
+		t.Error("a command after the end was accepted")
+	}
+}
+
+// draws plays a game and returns its teams and the words it drew, in order.
+func draws(t *testing.T, seed int64) ([]uint, []string) {
+	t.Helper()
+	g := NewGame(context.Background(), 1, testUser(1), 2, 2, 60, seed)
+	events := collect(g)
+	go g.Run()
+	play(t, g)
+	result := waitEvents(t, events)
+	checkClosed(t, g)
+
+	words := make([]string, 0)
+	for _, event := range result {
+		if event.Type == EventStory {
+			words = append(words, event.Msg.(string))
+		}
+	}
+	return g.Process.Teams, words
+}
+
+func TestSameSeedSameGame(t *testing.T) {
+	checkLeaks(t)
+	for _, seed := range []int64{1, 42, NewSeed()} {
+		firstTeams, firstWords := draws(t, seed)
+		secondTeams, secondWords := draws(t, seed)
+		if fmt.Sprint(firstTeams) != fmt.Sprint(secondTeams) {
+			t.Errorf("seed %d: teams %v and %v differ", seed, firstTeams, secondTeams)
+		}
+		if fmt.Sprint(firstWords) != fmt.Sprint(secondWords) {
+			t.Errorf("seed %d: drew %v and %v", seed, firstWords, secondWords)
+		}
+		if len(firstWords) == 0 {
+			t.Errorf("seed %d: no words were drawn", seed)
+		}
+	}
+}
+
+func TestSlowPersist(t *testing.T) {
+	checkLeaks(t)
+	g := NewGame(context.Background(), 1, testUser(1), 2, 2, 60, 42)
+	release := make(chan struct{})
+	var mutex sync.Mutex
+	saved := make([]Snapshot, 0)
+	g.Persist = func(snapshot Snapshot) {
+		<-release
+		mutex.Lock()
+		defer mutex.Unlock()
+		saved = append(saved, snapshot)
+	}
+	events := collect(g)
+	go g.Run()
+
+	// The whole game is played while the store does not answer.
+	play(t, g)
+	select {
+	case <-events:
+		t.Fatal("the events closed before the last snapshot was saved")
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(release)
+	waitEvents(t, events)
+	checkClosed(t, g)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	// One snapshot was being saved, the others were replaced by the last.
+	if len(saved) == 0 || len(saved) > 2 {
+		t.Fatalf("saved %d snapshots, want 1 or 2", len(saved))
+	}
+	if last := saved[len(saved)-1]; !last.Finished {
+		t.Errorf("the last snapshot is not finished: %+v", last)
+	}
+}
+
+// midTurn brings a game of two players with two words each into the first
+// turn, with one word guessed.
+func midTurn(t *testing.T, g *Game) {
+	t.Helper()
+	guest := testUser(2)
+	commands := []Command{
+		{Type: EventJoin, Player: 2, User: &guest},
+		{Type: EventJoined, Player: 1},
+		{Type: EventJoined, Player: 2},
+		{Type: EventRequestToStart, Player: 1},
+	}
+	for id := uint(1); id <= 2; id++ {
+		for i := 0; i < 2; i++ {
+			commands = append(commands, Command{Type: EventAddWord, Player: id, Word: testWord(id, i)})
+		}
+	}
+	commands = append(commands,
+		Command{Type: EventReadyStoryteller, Player: 1},
+		Command{Type: EventGuess, Player: 2, Word: testWord(1, 0)})
+	for _, command := range commands {
+		if err := g.Handle(command); err != nil {
+			t.Fatalf("%s of player %d: %s", command.Type, command.Player, err)
+		}
+	}
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	checkLeaks(t)
+	g := NewGame(context.Background(), 1, testUser(1), 2, 2, 60, 42)
+	events := collect(g)
+	go g.Run()
+	midTurn(t, g)
+	var snapshot Snapshot
+	var process Process
+	g.do(func() {
+		snapshot = g.snapshot()
+		process = g.Process
+	})
+	g.Stop()
+	waitEvents(t, events)
+	checkClosed(t, g)
+
+	if !snapshot.InTurn || snapshot.Remaining <= 0 || snapshot.Story == "" {
+		t.Fatalf("the snapshot is not in the middle of a turn: %+v", snapshot)
+	}
+	restored := Restore(context.Background(), snapshot)
+	if !reflect.DeepEqual(restored.Process, process) {
+		t.Errorf("restored process %+v, want %+v", restored.Process, process)
+	}
+	if fmt.Sprint(restored.Process.Teams) != fmt.Sprint(snapshot.Teams) {
+		t.Errorf("restored teams %v, want %v", restored.Process.Teams, snapshot.Teams)
+	}
+	if restored.Process.Remaining != snapshot.Remaining {
+		t.Errorf("restored %d seconds, want %d", restored.Process.Remaining, snapshot.Remaining)
+	}
+	for id := range restored.Players.IDs {
+		if _, ok := restored.Players.Disconnected[id]; !ok {
+			t.Errorf("player %d is not disconnected", id)
+		}
+	}
+
+	// Apart from the players being disconnected the restored game is the same.
+	want := snapshot
+	want.Disconnected = []uint{1, 2}
+	if got := restored.snapshot(); !reflect.DeepEqual(got, want) {
+		t.Errorf("restored snapshot %+v, want %+v", got, want)
+	}
+
+	// The turn goes on where it stopped.
+	events = collect(restored)
+	go restored.Run()
+	for _, word := range []string{testWord(1, 1), testWord(2, 0), testWord(2, 1)} {
+		if err := restored.Handle(Command{Type: EventGuess, Player: 2, Word: word}); err != nil {
+			t.Fatalf("could not guess %s: %s", word, err)
+		}
+	}
+	waitEvents(t, events)
+	checkClosed(t, restored)
+	if !restored.Process.Finished {
+		t.Error("the restored game did not finish")
+	}
+}
+
+func TestSnapshotRestoreAborted(t *testing.T) {
+	checkLeaks(t)
+	g := NewGame(context.Background(), 1, testUser(1), 2, 2, 60, 42)
+	events := collect(g)
+	go g.Run()
+	midTurn(t, g)
+	if err := g.Abort(1); err != nil {
+		t.Fatalf("could not abort: %s", err)
+	}
+	waitEvents(t, events)
+	checkClosed(t, g)
+
+	snapshot := g.snapshot()
+	if !snapshot.Aborted {
+		t.Fatal("the snapshot of an aborted game is not aborted")
+	}
+	restored := Restore(context.Background(), snapshot)
+	if !restored.Process.Aborted {
+		t.Error("the restored game is not aborted")
+	}
+	if !reflect.DeepEqual(restored.Process, g.Process) {
+		t.Errorf("restored process %+v, want %+v", restored.Process, g.Process)
+	}
+}
+
+func TestReplay(t *testing.T) {
+	checkLeaks(t)
+	// A timer of a second lets the first turn run out, so ticks are replayed
+	// as well.
+	g := NewGame(context.Background(), 1, testUser(1), 2, 2, 1, 42)
+	var mutex sync.Mutex
+	entries := make([]LogEntry, 0)
+	g.Record = func(entry LogEntry) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		entries = append(entries, entry)
+	}
+	events := collect(g)
+	go g.Run()
+
+	guest := testUser(2)
+	commands := []Command{
+		{Type: EventJoin, Player: 2, User: &guest},
+		{Type: EventJoined, Player: 1},
+		{Type: EventJoined, Player: 2},
+		{Type: EventRequestToStart, Player: 1},
+	}
+	for id := uint(1); id <= 2; id++ {
+		for i := 0; i < 2; i++ {
+			commands = append(commands, Command{Type: EventAddWord, Player: id, Word: testWord(id, i)})
+		}
+	}
+	commands = append(commands,
+		Command{Type: EventReadyStoryteller, Player: 1},
+		Command{Type: EventGuess, Player: 2, Word: testWord(1, 0)})
+	for _, command := range commands {
+		if err := g.Handle(command); err != nil {
+			t.Fatalf("%s of player %d: %s", command.Type, command.Player, err)
+		}
+	}
+	time.Sleep(1500 * time.Millisecond)
+	for _, command := range []Command{
+		{Type: EventReadyStoryteller, Player: 2},
+		{Type: EventGuess, Player: 1, Word: testWord(1, 1)},
+		{Type: EventGuess, Player: 1, Word: testWord(2, 0)},
+		{Type: EventGuess, Player: 1, Word: testWord(2, 1)},
+	} {
+		if err := g.Handle(command); err != nil {
+			t.Fatalf("%s of player %d: %s", command.Type, command.Player, err)
+		}
+	}
+	waitEvents(t, events)
+	checkClosed(t, g)
+	if !g.Process.Finished {
+		t.Fatal("the game did not finish")
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	ticks := 0
+	for _, entry := range entries {
+		if entry.Source == SourceTick {
+			ticks++
+		}
+	}
+	if ticks == 0 {
+		t.Error("no ticks were recorded")
+	}
+	replayed, err := Replay(entries)
+	if err != nil {
+		t.Fatalf("could not replay: %s", err)
+	}
+	if got, want := replayed.snapshot(), g.snapshot(); !reflect.DeepEqual(got, want) {
+		t.Errorf("replayed %+v, want %+v", got, want)
+	}
+}
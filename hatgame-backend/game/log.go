@@ -0,0 +1,75 @@
+package game
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+type Source string
+
+const (
+	SourceStart   Source = "start"
+	SourceCommand Source = "command"
+	SourceTick    Source = "tick"
+	SourceEvent   Source = "event"
+)
+
+type LogEntry struct {
+	Key      string
+	GameID   uint
+	Seq      int
+	Time     time.Time
+	Source   Source
+	Snapshot *Snapshot `json:",omitempty"`
+	Command  *Command  `json:",omitempty"`
+	Event    *Event    `json:",omitempty"`
+}
+
+func (g *Game) record(entry LogEntry) {
+	if g.Record == nil || g.replaying {
+		return
+	}
+	g.Seq++
+	entry.Key = g.Key
+	entry.GameID = g.ID
+	entry.Seq = g.Seq
+	entry.Time = time.Now()
+	g.Record(entry)
+}
+
+func Replay(entries []LogEntry) (*Game, error) {
+	var g *Game
+	for _, entry := range entries {
+		switch entry.Source {
+		case SourceStart:
+			if entry.Snapshot == nil {
+				return nil, fmt.Errorf("entry %d: missing snapshot", entry.Seq)
+			}
+			g = fromSnapshot(context.Background(), *entry.Snapshot)
+			g.replaying = true
+		case SourceCommand, SourceTick:
+			if g == nil {
+				return nil, fmt.Errorf("entry %d: game has not started yet", entry.Seq)
+			}
+			if entry.Source == SourceTick {
+				g.tick()
+				break
+			}
+			if entry.Command == nil {
+				return nil, fmt.Errorf("entry %d: missing command", entry.Seq)
+			}
+			g.apply(*entry.Command)
+		case SourceEvent:
+		default:
+			return nil, fmt.Errorf("entry %d: unknown source %q", entry.Seq, entry.Source)
+		}
+		if g != nil {
+			g.Seq = entry.Seq
+		}
+	}
+	if g == nil {
+		return nil, fmt.Errorf("log has no start entry")
+	}
+	return g, nil
+}
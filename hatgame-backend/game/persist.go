@@ -0,0 +1,43 @@
+package game
+
+// persister saves the snapshots of a game on its own goroutine, so that a slow
+// store does not hold up the game. While a snapshot is being saved only the
+// latest of the ones handed to it after that is kept.
+type persister struct {
+	save   func(Snapshot)
+	latest chan Snapshot
+	done   chan struct{}
+}
+
+func newPersister(save func(Snapshot)) *persister {
+	p := &persister{
+		save:   save,
+		latest: make(chan Snapshot, 1),
+		done:   make(chan struct{}),
+	}
+	go p.run()
+	return p
+}
+
+func (p *persister) run() {
+	defer close(p.done)
+	for snapshot := range p.latest {
+		p.save(snapshot)
+	}
+}
+
+// put replaces the snapshot waiting to be saved. It must only be called by
+// the game goroutine.
+func (p *persister) put(snapshot Snapshot) {
+	select {
+	case <-p.latest:
+	default:
+	}
+	p.latest <- snapshot
+}
+
+// close saves the snapshot that is still waiting and returns once it is saved.
+func (p *persister) close() {
+	close(p.latest)
+	<-p.done
+}
@@ -0,0 +1,39 @@
+package game
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	mathrand "math/rand"
+)
+
+type countingSource struct {
+	source mathrand.Source
+	draws  uint64
+}
+
+func newSource(seed int64, draws uint64) *countingSource {
+	source := &countingSource{source: mathrand.NewSource(seed)}
+	for source.draws < draws {
+		source.Int63()
+	}
+	return source
+}
+
+func (s *countingSource) Int63() int64 {
+	s.draws++
+	return s.source.Int63()
+}
+
+func (s *countingSource) Seed(seed int64) {
+	s.source.Seed(seed)
+	s.draws = 0
+}
+
+func NewSeed() int64 {
+	var seed [8]byte
+	if _, err := rand.Read(seed[:]); err != nil {
+		panic(fmt.Sprintf("could not generate game seed: %s", err))
+	}
+	return int64(binary.LittleEndian.Uint64(seed[:]) >> 1)
+}
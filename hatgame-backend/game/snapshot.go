@@ -0,0 +1,159 @@
+package game
+
+import (
+	"context"
+	mathrand "math/rand"
+	"sort"
+
+	"github.com/bitterfly/go-chaos/hatgame/server/containers"
+)
+
+type Snapshot struct {
+	ID           uint
+	Key          string
+	Seq          int
+	Seed         int64
+	Draws        uint64
+	Host         uint
+	NumPlayers   int
+	Timer        int
+	NumWords     int
+	Phase        Phase
+	Players      []containers.User
+	Disconnected []uint
+	WordsByUser  map[uint][]string
+	Teams        []uint
+	GuessedWords map[string]uint
+	Storyteller  int
+	InTurn       bool
+	Remaining    int
+	Story        string
+	Result       []containers.Result
+	Finished     bool
+	Aborted      bool
+}
+
+func (g *Game) Snapshot() Snapshot {
+	var snapshot Snapshot
+	if g.replaying {
+		return g.snapshot()
+	}
+	g.do(func() {
+		snapshot = g.snapshot()
+	})
+	return snapshot
+}
+
+func (g *Game) snapshot() Snapshot {
+	wordsByUser := make(map[uint][]string, len(g.Words.ByUser))
+	for id, words := range g.Words.ByUser {
+		list := make([]string, 0, len(words))
+		for word := range words {
+			list = append(list, word)
+		}
+		sort.Strings(list)
+		wordsByUser[id] = list
+	}
+
+	guessedWords := make(map[string]uint, len(g.Process.GuessedWords))
+	for word, id := range g.Process.GuessedWords {
+		guessedWords[word] = id
+	}
+
+	teams := make([]uint, len(g.Process.Teams))
+	copy(teams, g.Process.Teams)
+
+	disconnected := make([]uint, 0, len(g.Players.Disconnected))
+	for id := range g.Players.Disconnected {
+		disconnected = append(disconnected, id)
+	}
+	sort.Slice(disconnected, func(i, j int) bool {
+		return disconnected[i] < disconnected[j]
+	})
+
+	return Snapshot{
+		ID:           g.ID,
+		Key:          g.Key,
+		Seq:          g.Seq,
+		Seed:         g.Seed,
+		Draws:        g.source.draws,
+		Host:         g.Host,
+		NumPlayers:   g.NumPlayers,
+		Timer:        g.Timer,
+		NumWords:     g.NumWords,
+		Phase:        g.Process.Phase,
+		Players:      g.Players.list(),
+		Disconnected: disconnected,
+		WordsByUser:  wordsByUser,
+		Teams:        teams,
+		GuessedWords: guessedWords,
+		Storyteller:  g.Process.Storyteller,
+		InTurn:       g.Process.InTurn,
+		Remaining:    g.Process.Remaining,
+		Story:        g.Process.Story,
+		Result:       g.Process.Result,
+		Finished:     g.Process.Finished,
+		Aborted:      g.Process.Aborted,
+	}
+}
+
+func Restore(ctx context.Context, snapshot Snapshot) *Game {
+	g := fromSnapshot(ctx, snapshot)
+	for id := range g.Players.IDs {
+		g.Players.Disconnected[id] = struct{}{}
+	}
+	return g
+}
+
+func fromSnapshot(ctx context.Context, snapshot Snapshot) *Game {
+	var host containers.User
+	for _, player := range snapshot.Players {
+		if player.ID == snapshot.Host {
+			host = player
+		}
+	}
+
+	g := NewGame(
+		ctx,
+		snapshot.ID,
+		host,
+		snapshot.NumPlayers,
+		snapshot.NumWords,
+		snapshot.Timer,
+		snapshot.Seed)
+	g.source = newSource(snapshot.Seed, snapshot.Draws)
+	g.rand = mathrand.New(g.source)
+
+	for _, player := range snapshot.Players {
+		g.Players.IDs[player.ID] = struct{}{}
+		g.Players.Users[player] = struct{}{}
+		g.Words.ByUser[player.ID] = make(map[string]struct{})
+	}
+	for _, id := range snapshot.Disconnected {
+		g.Players.Disconnected[id] = struct{}{}
+	}
+	for id, words := range snapshot.WordsByUser {
+		if _, ok := g.Words.ByUser[id]; !ok {
+			g.Words.ByUser[id] = make(map[string]struct{})
+		}
+		for _, word := range words {
+			g.Words.ByUser[id][word] = struct{}{}
+			g.Words.All[word] = struct{}{}
+		}
+	}
+	for word, id := range snapshot.GuessedWords {
+		g.Process.GuessedWords[word] = id
+	}
+	g.Process.Teams = append(g.Process.Teams, snapshot.Teams...)
+	g.Process.Storyteller = snapshot.Storyteller
+	g.Process.Phase = snapshot.Phase
+	g.Process.InTurn = snapshot.InTurn
+	g.Process.Remaining = snapshot.Remaining
+	g.Process.Story = snapshot.Story
+	g.Process.Finished = snapshot.Finished
+	g.Process.Aborted = snapshot.Aborted
+	g.Key = snapshot.Key
+	g.Seq = snapshot.Seq
+
+	return g
+}
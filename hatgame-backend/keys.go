@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/bitterfly/go-chaos/hatgame/config"
+	"github.com/bitterfly/go-chaos/hatgame/server"
+)
+
+const keysUsage = "usage: hatgame keys list | rotate | retire <id>"
+
+func loadKeys(cfg config.Config) (*server.KeySet, error) {
+	if cfg.JWTSecret != "" {
+		return server.NewStaticKeySet(cfg.JWTSecret), nil
+	}
+	return server.LoadKeySet(cfg.KeyFile)
+}
+
+func reloadKeysOnHangup(keySet *server.KeySet) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	for range hangup {
+		if err := keySet.Reload(); err != nil {
+			slog.Error("Could not reload signing keys", "error", err)
+			continue
+		}
+		slog.Info("Reloaded signing keys", "key_id", keySet.Current().ID)
+	}
+}
+
+func keys(cfg config.Config, args []string) error {
+	if len(args) == 0 {
+		return errors.New(keysUsage)
+	}
+	if cfg.JWTSecret != "" {
+		return errors.New("a jwtSecret is configured, the key file is not used")
+	}
+	if _, err := server.LoadKeySet(cfg.KeyFile); err != nil {
+		return err
+	}
+	current, err := server.ReadKeyFile(cfg.KeyFile)
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "list":
+		for i, key := range current {
+			status := ""
+			if i == 0 {
+				status = "\tsigning"
+			}
+			fmt.Printf("%s\t%s%s\n", key.ID, key.Created.Format("2006-01-02 15:04:05"), status)
+		}
+	case "rotate":
+		key, err := server.NewSigningKey()
+		if err != nil {
+			return err
+		}
+		if err := server.WriteKeyFile(cfg.KeyFile, append([]server.SigningKey{key}, current...)); err != nil {
+			return err
+		}
+		fmt.Printf("signing with %s, send SIGHUP to running servers to pick it up\n", key.ID)
+	case "retire":
+		if len(args) != 2 {
+			return errors.New(keysUsage)
+		}
+		remaining := make([]server.SigningKey, 0, len(current))
+		for _, key := range current {
+			if key.ID != args[1] {
+				remaining = append(remaining, key)
+			}
+		}
+		if len(remaining) == len(current) {
+			return fmt.Errorf("there is no key %s", args[1])
+		}
+		if len(remaining) == 0 {
+			return errors.New("can not retire the only key, rotate first")
+		}
+		if err := server.WriteKeyFile(cfg.KeyFile, remaining); err != nil {
+			return err
+		}
+		fmt.Printf("retired %s, sessions signed with it are no longer valid\n", args[1])
+	default:
+		return errors.New(keysUsage)
+	}
+	return nil
+}
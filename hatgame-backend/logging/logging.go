@@ -0,0 +1,98 @@
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"strings"
+)
+
+const contextKey = "logger"
+
+// Fields that carry credentials and must never end up in a log.
+var secretParams = []string{"ticket", "token", "sessionToken"}
+
+func ParseLevel(level string) (slog.Level, error) {
+	switch level {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "info":
+		return slog.LevelInfo, nil
+	case "warn":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	}
+	return 0, fmt.Errorf("unknown log level %q", level)
+}
+
+// Setup makes a text or JSON logger with the given level the default one,
+// also for the standard log package.
+func Setup(w io.Writer, level string, format string) error {
+	l, err := ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	options := &slog.HandlerOptions{Level: l}
+	var handler slog.Handler
+	switch format {
+	case "text":
+		handler = slog.NewTextHandler(w, options)
+	case "json":
+		handler = slog.NewJSONHandler(w, options)
+	default:
+		return fmt.Errorf("unknown log format %q", format)
+	}
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
+
+func WithLogger(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, contextKey, logger)
+}
+
+func FromContext(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(contextKey).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
+
+// With adds attributes to the logger of the context.
+func With(ctx context.Context, args ...interface{}) context.Context {
+	return WithLogger(ctx, FromContext(ctx).With(args...))
+}
+
+func NewRequestID() string {
+	value := make([]byte, 8)
+	if _, err := rand.Read(value); err != nil {
+		panic(fmt.Sprintf("could not generate request id: %s", err))
+	}
+	return hex.EncodeToString(value)
+}
+
+// Redact hides tickets and session tokens in the query and in the
+// deprecated websocket paths, which have the token as their third segment.
+func Redact(u *url.URL) string {
+	path := u.EscapedPath()
+	segments := strings.Split(path, "/")
+	if len(segments) > 3 && segments[1] == "api" && (segments[2] == "host" || segments[2] == "join") {
+		segments[3] = "REDACTED"
+		path = strings.Join(segments, "/")
+	}
+
+	if u.RawQuery == "" {
+		return path
+	}
+	query := u.Query()
+	for _, param := range secretParams {
+		if _, ok := query[param]; ok {
+			query.Set(param, "REDACTED")
+		}
+	}
+	return path + "?" + query.Encode()
+}
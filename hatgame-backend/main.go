@@ -1,29 +1,151 @@
+//go:generate sh -c "go run . protocol-schema > protocol.schema.json"
+
 package main
 
 import (
-	"log"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
 
+	"github.com/bitterfly/go-chaos/hatgame/cluster"
+	"github.com/bitterfly/go-chaos/hatgame/config"
 	"github.com/bitterfly/go-chaos/hatgame/database"
+	"github.com/bitterfly/go-chaos/hatgame/logging"
 	"github.com/bitterfly/go-chaos/hatgame/server"
 	_ "github.com/lib/pq"
+	"gorm.io/gorm"
 )
 
+func fatal(err error) {
+	slog.Error(err.Error())
+	os.Exit(1)
+}
+
+func databaseDSN(cfg config.Database) (string, *database.DatabaseError) {
+	if cfg.DSN != "" {
+		return cfg.DSN, nil
+	}
+	return database.LoadDSN(cfg.File)
+}
+
+func openDatabase(cfg config.Database) (*gorm.DB, *database.DatabaseError) {
+	dsn, err := databaseDSN(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return database.OpenDSN(dsn)
+}
+
+func openStore(cfg config.Database) (database.Store, *gorm.DB) {
+	if cfg.Memory {
+		slog.Warn("Keeping everything in memory, nothing will be saved")
+		return database.NewMemory(), nil
+	}
+
+	db, err := openDatabase(cfg)
+	if err != nil {
+		fatal(err)
+	}
+	slog.Info("Connected to database")
+
+	migrations, err := database.MigrateUp(db)
+	if err != nil {
+		fatal(err)
+	}
+	for _, migration := range migrations {
+		slog.Info("Applied migration", "version", migration.Version, "name", migration.Name)
+	}
+	return database.NewPostgres(db), db
+}
+
+func openCluster(cfg config.Config, db *gorm.DB) (cluster.Registry, cluster.Bus) {
+	if cfg.Cluster.Bus == "postgres" {
+		dsn, err := databaseDSN(cfg.Database)
+		if err != nil {
+			fatal(err)
+		}
+		slog.Info("Sharing rooms with other instances through postgres")
+		postgres := cluster.NewPostgres(db, dsn)
+		return postgres, postgres
+	}
+	local := cluster.NewLocal()
+	return local, local
+}
+
 func main() {
-	db, err := database.Open("psqlInfo.json")
+	cfg, args, err := config.Load(os.Args[0], os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
 	if err != nil {
-		panic(err)
+		fatal(err)
+	}
+	if err := logging.Setup(os.Stderr, cfg.LogLevel, cfg.LogFormat); err != nil {
+		fatal(err)
 	}
-	log.Printf("Connected to database.")
 
-	err = database.Automigrate(db)
+	if len(args) > 0 && args[0] == "migrate" {
+		if err := migrate(cfg.Database, args[1:]); err != nil {
+			fatal(err)
+		}
+		return
+	}
+	if len(args) > 0 && args[0] == "protocol-schema" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(server.ProtocolSchema()); err != nil {
+			fatal(err)
+		}
+		return
+	}
+	if len(args) > 0 && args[0] == "keys" {
+		if err := keys(cfg, args[1:]); err != nil {
+			fatal(err)
+		}
+		return
+	}
+
+	keySet, err := loadKeys(cfg)
 	if err != nil {
-		panic(err)
+		fatal(err)
+	}
+	go reloadKeysOnHangup(keySet)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	store, db := openStore(cfg.Database)
+	registry, bus := openCluster(cfg, db)
+	server := server.New(store, keySet, registry, bus, cfg)
+	if err := server.Restore(); err != nil {
+		slog.Error("Could not restore running games", "error", err)
+	}
+
+	serverError := make(chan error, 1)
+	go func() {
+		serverError <- server.Connect(cfg.Listen)
+	}()
+
+	select {
+	case err := <-serverError:
+		if err != nil {
+			fatal(err)
+		}
+		return
+	case <-ctx.Done():
 	}
-	log.Printf("Migrated the database.")
+	stop()
 
-	server := server.New(db)
-	databaseError := server.Connect("localhost:8080")
-	if databaseError != nil {
-		panic(databaseError)
+	slog.Info("Shutting down, waiting for running games", "timeout", cfg.ShutdownTimeout.Duration)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout.Duration)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		slog.Error("Error during shutdown", "error", err)
 	}
+	slog.Info("Server stopped")
 }
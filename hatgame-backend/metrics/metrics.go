@@ -0,0 +1,301 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultBuckets are latency buckets in seconds.
+var DefaultBuckets = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5}
+
+type Sample struct {
+	Labels []string
+	Value  float64
+}
+
+type collector interface {
+	write(w io.Writer)
+}
+
+type Registry struct {
+	collectors []collector
+	mutex      *sync.Mutex
+}
+
+func NewRegistry() *Registry {
+	return &Registry{mutex: &sync.Mutex{}}
+}
+
+var Default = NewRegistry()
+
+func (r *Registry) register(c collector) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.collectors = append(r.collectors, c)
+}
+
+func (r *Registry) Write(w io.Writer) {
+	r.mutex.Lock()
+	collectors := append([]collector(nil), r.collectors...)
+	r.mutex.Unlock()
+
+	buffered := bufio.NewWriter(w)
+	for _, c := range collectors {
+		c.write(buffered)
+	}
+	buffered.Flush()
+}
+
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		r.Write(w)
+	})
+}
+
+type desc struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+}
+
+func (d desc) header(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", d.name, strings.ReplaceAll(d.help, "\n", " "))
+	fmt.Fprintf(w, "# TYPE %s %s\n", d.name, d.kind)
+}
+
+func (d desc) check(values []string) {
+	if len(values) != len(d.labels) {
+		panic(fmt.Sprintf("metric %s has %d labels, got %d values", d.name, len(d.labels), len(values)))
+	}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(names []string, values []string, extra ...string) string {
+	pairs := make([]string, 0, len(names)+len(extra)/2)
+	for i, name := range names {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, name, labelEscaper.Replace(values[i])))
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, extra[i], extra[i+1]))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func key(values []string) string {
+	return strings.Join(values, "\xff")
+}
+
+type series struct {
+	labels []string
+	value  float64
+}
+
+// values is the state shared by counters and gauges.
+type values struct {
+	desc
+	series map[string]*series
+	mutex  *sync.Mutex
+}
+
+func newValues(name string, help string, kind string, labels []string) *values {
+	return &values{
+		desc:   desc{name: name, help: help, kind: kind, labels: labels},
+		series: make(map[string]*series),
+		mutex:  &sync.Mutex{},
+	}
+}
+
+func (v *values) add(delta float64, labels []string) {
+	v.check(labels)
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	k := key(labels)
+	s, ok := v.series[k]
+	if !ok {
+		s = &series{labels: append([]string(nil), labels...)}
+		v.series[k] = s
+	}
+	s.value += delta
+}
+
+func (v *values) set(value float64, labels []string) {
+	v.check(labels)
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	v.series[key(labels)] = &series{labels: append([]string(nil), labels...), value: value}
+}
+
+func (v *values) write(w io.Writer) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	v.header(w)
+	keys := make([]string, 0, len(v.series))
+	for k := range v.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		s := v.series[k]
+		fmt.Fprintf(w, "%s%s %s\n", v.name, formatLabels(v.labels, s.labels), formatValue(s.value))
+	}
+}
+
+type Counter struct {
+	*values
+}
+
+func NewCounter(name string, help string, labels ...string) *Counter {
+	c := &Counter{newValues(name, help, "counter", labels)}
+	Default.register(c)
+	return c
+}
+
+func (c *Counter) Inc(labels ...string) {
+	c.add(1, labels)
+}
+
+func (c *Counter) Add(delta float64, labels ...string) {
+	if delta < 0 {
+		panic(fmt.Sprintf("counter %s can not decrease", c.name))
+	}
+	c.add(delta, labels)
+}
+
+type Gauge struct {
+	*values
+}
+
+func NewGauge(name string, help string, labels ...string) *Gauge {
+	g := &Gauge{newValues(name, help, "gauge", labels)}
+	Default.register(g)
+	return g
+}
+
+func (g *Gauge) Inc(labels ...string) {
+	g.add(1, labels)
+}
+
+func (g *Gauge) Dec(labels ...string) {
+	g.add(-1, labels)
+}
+
+func (g *Gauge) Set(value float64, labels ...string) {
+	g.set(value, labels)
+}
+
+// GaugeFunc is computed on every scrape.
+type GaugeFunc struct {
+	desc
+	collect func() []Sample
+}
+
+func NewGaugeFunc(name string, help string, collect func() []Sample, labels ...string) *GaugeFunc {
+	g := &GaugeFunc{desc: desc{name: name, help: help, kind: "gauge", labels: labels}, collect: collect}
+	Default.register(g)
+	return g
+}
+
+func (g *GaugeFunc) write(w io.Writer) {
+	samples := g.collect()
+	sort.Slice(samples, func(i, j int) bool {
+		return key(samples[i].Labels) < key(samples[j].Labels)
+	})
+	g.header(w)
+	for _, s := range samples {
+		g.check(s.Labels)
+		fmt.Fprintf(w, "%s%s %s\n", g.name, formatLabels(g.labels, s.Labels), formatValue(s.Value))
+	}
+}
+
+type histogramSeries struct {
+	labels []string
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+type Histogram struct {
+	desc
+	buckets []float64
+	series  map[string]*histogramSeries
+	mutex   *sync.Mutex
+}
+
+func NewHistogram(name string, help string, buckets []float64, labels ...string) *Histogram {
+	h := &Histogram{
+		desc:    desc{name: name, help: help, kind: "histogram", labels: labels},
+		buckets: buckets,
+		series:  make(map[string]*histogramSeries),
+		mutex:   &sync.Mutex{},
+	}
+	Default.register(h)
+	return h
+}
+
+func (h *Histogram) Observe(value float64, labels ...string) {
+	h.check(labels)
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	k := key(labels)
+	s, ok := h.series[k]
+	if !ok {
+		s = &histogramSeries{labels: append([]string(nil), labels...), counts: make([]uint64, len(h.buckets))}
+		h.series[k] = s
+	}
+	for i, bound := range h.buckets {
+		if value <= bound {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.sum += value
+}
+
+// Since observes the seconds passed since start.
+func (h *Histogram) Since(start time.Time, labels ...string) {
+	h.Observe(time.Since(start).Seconds(), labels...)
+}
+
+func (h *Histogram) write(w io.Writer) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.header(w)
+	keys := make([]string, 0, len(h.series))
+	for k := range h.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		s := h.series[k]
+		for i, bound := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, s.labels, "le", formatValue(bound)), s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, s.labels, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, s.labels), formatValue(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, s.labels), s.count)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/bitterfly/go-chaos/hatgame/config"
+	"github.com/bitterfly/go-chaos/hatgame/database"
+)
+
+const migrateUsage = "usage: hatgame migrate up | down [steps] | status"
+
+func migrate(cfg config.Database, args []string) error {
+	if len(args) == 0 {
+		return errors.New(migrateUsage)
+	}
+	if cfg.Memory {
+		return errors.New("there is nothing to migrate in memory")
+	}
+
+	db, derr := openDatabase(cfg)
+	if derr != nil {
+		return derr
+	}
+
+	switch args[0] {
+	case "up":
+		migrations, derr := database.MigrateUp(db)
+		for _, migration := range migrations {
+			fmt.Printf("applied %04d_%s\n", migration.Version, migration.Name)
+		}
+		if derr != nil {
+			return derr
+		}
+		if len(migrations) == 0 {
+			fmt.Println("nothing to apply")
+		}
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			n, err := strconv.Atoi(args[1])
+			if err != nil || n < 1 {
+				return fmt.Errorf("steps must be a positive number, got %q", args[1])
+			}
+			steps = n
+		}
+		migrations, derr := database.MigrateDown(db, steps)
+		for _, migration := range migrations {
+			fmt.Printf("rolled back %04d_%s\n", migration.Version, migration.Name)
+		}
+		if derr != nil {
+			return derr
+		}
+		if len(migrations) == 0 {
+			fmt.Println("nothing to roll back")
+		}
+	case "status":
+		status, derr := database.GetMigrationStatus(db)
+		if derr != nil {
+			return derr
+		}
+		for _, migration := range status {
+			applied := "pending"
+			if migration.AppliedAt != nil {
+				applied = "applied " + migration.AppliedAt.Format("2006-01-02 15:04:05")
+			}
+			fmt.Printf("%04d_%s\t%s\n", migration.Version, migration.Name, applied)
+		}
+	default:
+		return errors.New(migrateUsage)
+	}
+	return nil
+}
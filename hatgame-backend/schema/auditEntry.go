@@ -0,0 +1,16 @@
+package schema
+
+import "time"
+
+type AuditEntry struct {
+	ID        uint      `gorm:"primaryKey"`
+	CreatedAt time.Time `gorm:"index"`
+	AdminID   uint      `gorm:"index;not null"`
+	Action    string    `gorm:"not null"`
+	Target    string
+	Details   string
+}
+
+func (AuditEntry) TableName() string {
+	return "audit_log"
+}
@@ -0,0 +1,23 @@
+package schema
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	FlagUser = "user"
+	FlagWord = "word"
+)
+
+// Flag is a report of a user or a word that an admin should look at.
+type Flag struct {
+	gorm.Model
+	ReporterID uint   `gorm:"index;not null"`
+	Kind       string `gorm:"not null"`
+	Target     string `gorm:"not null"`
+	Reason     string
+	ResolvedAt *time.Time `gorm:"index"`
+	ResolvedBy *uint
+}
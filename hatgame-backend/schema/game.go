@@ -5,6 +5,8 @@ import "gorm.io/gorm"
 type Game struct {
 	gorm.Model
 	UserID     uint
+	LogKey     string `gorm:"index"`
+	Seed       int64
 	NumPlayers int
 	Timer      int
 	NumWords   int
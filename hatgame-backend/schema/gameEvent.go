@@ -0,0 +1,13 @@
+package schema
+
+import "gorm.io/gorm"
+
+type GameEvent struct {
+	gorm.Model
+	GameKey string `gorm:"index:idx_game_event,unique;not null"`
+	Seq     int    `gorm:"index:idx_game_event,unique"`
+	GameID  uint
+	Source  string
+	Type    string
+	Data    []byte
+}
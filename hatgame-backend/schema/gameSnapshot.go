@@ -0,0 +1,9 @@
+package schema
+
+import "gorm.io/gorm"
+
+type GameSnapshot struct {
+	gorm.Model
+	GameID uint `gorm:"uniqueIndex;not null"`
+	Data   []byte
+}
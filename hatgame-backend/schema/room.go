@@ -0,0 +1,15 @@
+package schema
+
+import "time"
+
+type Room struct {
+	ID        uint   `gorm:"primaryKey;autoIncrement:false"`
+	Code      string `gorm:"uniqueIndex;not null"`
+	Owner     string `gorm:"index;not null"`
+	Players   int
+	Words     int
+	Timer     int
+	ExpiresAt time.Time
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
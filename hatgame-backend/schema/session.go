@@ -0,0 +1,16 @@
+package schema
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+type Session struct {
+	gorm.Model
+	UserID       uint   `gorm:"index;not null"`
+	RefreshHash  string `gorm:"uniqueIndex;not null"`
+	PreviousHash string `gorm:"index"`
+	ExpiresAt    time.Time
+	RevokedAt    *time.Time
+}
@@ -0,0 +1,12 @@
+package schema
+
+import "time"
+
+// Ticket is a one-time websocket or SSE ticket, kept by the hash of its value.
+type Ticket struct {
+	Hash      string    `gorm:"primaryKey"`
+	UserID    uint      `gorm:"not null"`
+	SessionID uint      `gorm:"not null"`
+	ExpiresAt time.Time `gorm:"index;not null"`
+	CreatedAt time.Time
+}
@@ -8,12 +8,25 @@ import (
 	"gorm.io/gorm"
 )
 
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin"
+)
+
+const (
+	StatusActive   = "active"
+	StatusDisabled = "disabled"
+	StatusBanned   = "banned"
+)
+
 type User struct {
 	gorm.Model
 	Email    string `gorm:"uniqueIndex;notnull"`
 	Password []byte `gorm:"notnull" json:"-"`
-	Username string
+	Username string `gorm:"not null"`
 	Avatar   []byte
+	Role     string `gorm:"not null;default:user"`
+	Status   string `gorm:"not null;default:active"`
 }
 
 func ParseUser(data io.ReadCloser) (*User, error) {
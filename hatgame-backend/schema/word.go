@@ -4,5 +4,5 @@ import "gorm.io/gorm"
 
 type Word struct {
 	gorm.Model
-	Word string `gorm:"unique,notnull"`
+	Word string `gorm:"unique;not null"`
 }
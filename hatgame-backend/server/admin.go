@@ -0,0 +1,379 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bitterfly/go-chaos/hatgame/database"
+	"github.com/bitterfly/go-chaos/hatgame/logging"
+	"github.com/bitterfly/go-chaos/hatgame/schema"
+	"github.com/bitterfly/go-chaos/hatgame/server/containers"
+	"github.com/bitterfly/go-chaos/hatgame/utils"
+	"github.com/gorilla/mux"
+)
+
+const (
+	closeWait        = 5 * time.Second
+	adminSearchLimit = 50
+	adminListLimit   = 100
+)
+
+// Actions in the audit log.
+const (
+	auditRoomClose     = "room.close"
+	auditUserStatus    = "user.status"
+	auditUserRole      = "user.role"
+	auditUsernameReset = "user.reset_username"
+	auditWordRemove    = "word.remove"
+	auditFlagResolve   = "flag.resolve"
+)
+
+// isAdmin tells whether the user has the admin role or is listed as an admin
+// in the configuration, which is how the first admin gets in.
+func (s *Server) isAdmin(user *schema.User) bool {
+	if user.Role == schema.RoleAdmin {
+		return true
+	}
+	for _, admin := range s.Config.Admins {
+		if strings.EqualFold(admin, user.Email) {
+			return true
+		}
+	}
+	return false
+}
+
+// adminHandler lets through only admins. It has to come after authHandler.
+func (s *Server) adminHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, ok := r.Context().Value("id").(uint)
+		if !ok {
+			writeErrorf(w, http.StatusInternalServerError, CodeInternal, "Missing user in request context.")
+			return
+		}
+		user, derr := s.Store.GetUserByID(id)
+		if derr != nil {
+			writeErrorf(w, http.StatusInternalServerError, CodeInternal, "Could not fetch user.")
+			return
+		}
+		if !s.isAdmin(user) || user.Status != schema.StatusActive {
+			logging.FromContext(r.Context()).Warn("Admin API used by someone who is not an admin")
+			writeErrorf(w, http.StatusForbidden, CodeForbidden, "Only admins can do that.")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) handleAdminRooms(w http.ResponseWriter, r *http.Request) {
+	s.Mutex.RLock()
+	games := make([]*Game, 0, len(s.Games))
+	for _, g := range s.Games {
+		games = append(games, g)
+	}
+	s.Mutex.RUnlock()
+
+	now := time.Now()
+	rooms := make([]containers.LiveRoom, 0, len(games))
+	for _, g := range games {
+		info := g.State.Info()
+		g.Mutex.RLock()
+		connected := len(g.Players)
+		g.Mutex.RUnlock()
+		rooms = append(rooms, containers.LiveRoom{
+			ID:         info.ID,
+			Code:       g.Code,
+			Instance:   s.Instance,
+			Phase:      string(g.State.Phase()),
+			Players:    len(info.Players),
+			Connected:  connected,
+			Capacity:   g.State.NumPlayers,
+			Words:      g.State.NumWords,
+			Timer:      g.State.Timer,
+			Started:    g.Started,
+			Age:        int64(now.Sub(g.Started).Seconds()),
+			LastActive: g.LastActive(),
+		})
+	}
+	sort.Slice(rooms, func(i, j int) bool {
+		return rooms[i].ID < rooms[j].ID
+	})
+	writeJSON(w, http.StatusOK, rooms)
+}
+
+func (s *Server) handleAdminCloseRoom(w http.ResponseWriter, r *http.Request) {
+	logger := logging.FromContext(r.Context())
+	gameID, err := utils.ParseUint(mux.Vars(r), "id")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, containers.Error{Code: CodeInvalidRequest, Message: err.Error()})
+		return
+	}
+	logger = logger.With("game_id", gameID)
+
+	serverGame, room, ok := s.locate(uint(gameID))
+	if !ok {
+		writeErrorf(w, http.StatusNotFound, CodeNotFound, "No game with id %d.", gameID)
+		return
+	}
+	if serverGame == nil {
+		logger.Info("Asking the owner to close the room", "instance", room.Owner)
+		if err := publish(s.Bus, roomTopic(room.ID), relayEnvelope{Kind: relayCloseRoom}); err != nil {
+			logger.Error("Could not reach the owner of the room", "instance", room.Owner, "error", err)
+			writeErrorf(w, http.StatusInternalServerError, CodeInternal, "Could not reach instance %s.", room.Owner)
+			return
+		}
+		s.audit(r, auditRoomClose, fmt.Sprintf("room:%d", gameID), map[string]string{"Instance": room.Owner})
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	logger.Info("Closing room")
+	if err := s.closeGame(serverGame); err != nil {
+		logger.Error("Could not close room", "error", err)
+		writeErrorf(w, http.StatusInternalServerError, CodeInternal, "%s", err)
+		return
+	}
+	s.audit(r, auditRoomClose, fmt.Sprintf("room:%d", gameID), map[string]string{"Instance": s.Instance})
+	w.WriteHeader(http.StatusOK)
+}
+
+// closeGame ends the game for all of its players. A game that does not take
+// the command is stopped, which also drops its snapshot so it is not
+// restored.
+func (s *Server) closeGame(serverGame *Game) error {
+	currentGame := serverGame.State
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		currentGame.Close()
+	}()
+
+	select {
+	case <-closed:
+		return nil
+	case <-time.After(closeWait):
+	}
+	serverGame.Log.Warn("Game did not take the close command, stopping it")
+	currentGame.Stop()
+	select {
+	case <-currentGame.Done():
+	case <-time.After(closeWait):
+		return errors.New("the game did not stop")
+	}
+	if derr := s.Store.DeleteSnapshot(currentGame.ID); derr != nil {
+		return fmt.Errorf("could not delete the snapshot: %w", derr)
+	}
+	return nil
+}
+
+// audit records an action of the admin who made the request.
+func (s *Server) audit(r *http.Request, action string, target string, details interface{}) {
+	logger := logging.FromContext(r.Context())
+	id, _ := r.Context().Value("id").(uint)
+	entry := &schema.AuditEntry{AdminID: id, Action: action, Target: target}
+	if details != nil {
+		data, err := json.Marshal(details)
+		if err != nil {
+			logger.Error("Could not encode the details of an admin action", "action", action, "error", err)
+		}
+		entry.Details = string(data)
+	}
+
+	logger.Info("Admin action", "action", action, "target", target, "details", entry.Details)
+	if derr := s.Store.AddAuditEntry(entry); derr != nil {
+		logger.Error("Could not record admin action", "action", action, "target", target, "error", derr)
+	}
+}
+
+// disconnectUser drops the connections of the user to the games of this
+// instance.
+func (s *Server) disconnectUser(id uint) {
+	s.Mutex.RLock()
+	games := make([]*Game, 0, len(s.Games))
+	for _, g := range s.Games {
+		games = append(games, g)
+	}
+	s.Mutex.RUnlock()
+
+	for _, g := range games {
+		if client, ok := g.Client(id); ok {
+			client.Close()
+		}
+	}
+}
+
+// adminTarget finds the user of the {id} path variable, who can not be the
+// admin making the request.
+func (s *Server) adminTarget(w http.ResponseWriter, r *http.Request) (*schema.User, bool) {
+	id, err := utils.ParseUint(mux.Vars(r), "id")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, containers.Error{Code: CodeInvalidRequest, Message: err.Error()})
+		return nil, false
+	}
+	if adminID, _ := r.Context().Value("id").(uint); adminID == id {
+		writeErrorf(w, http.StatusBadRequest, CodeInvalidRequest, "You can not do that to your own account.")
+		return nil, false
+	}
+	user, derr := s.Store.GetUserByID(id)
+	if derr != nil {
+		writeErrorf(w, http.StatusNotFound, CodeNotFound, "No user with id %d.", id)
+		return nil, false
+	}
+	return user, true
+}
+
+func (s *Server) handleAdminUsers(w http.ResponseWriter, r *http.Request) {
+	users, derr := s.Store.SearchUsers(r.URL.Query().Get("q"), adminSearchLimit)
+	if derr != nil {
+		logging.FromContext(r.Context()).Error("Could not search users", "error", derr)
+		writeErrorf(w, http.StatusInternalServerError, CodeInternal, "Could not search users.")
+		return
+	}
+	writeJSON(w, http.StatusOK, users)
+}
+
+func (s *Server) handleAdminUserStatus(w http.ResponseWriter, r *http.Request) {
+	logger := logging.FromContext(r.Context())
+	change, err := containers.ParseUserStatus(r.Body)
+	if err != nil {
+		writeErrorf(w, http.StatusBadRequest, CodeBadJSON, "Bad status json.")
+		return
+	}
+	user, ok := s.adminTarget(w, r)
+	if !ok {
+		return
+	}
+
+	if derr := s.Store.UpdateUserStatus(user.ID, change.Status); derr != nil {
+		logger.Error("Could not change the status of a user", "user_id", user.ID, "error", derr)
+		writeErrorf(w, http.StatusInternalServerError, CodeInternal, "Could not change the status.")
+		return
+	}
+	if change.Status != schema.StatusActive {
+		if derr := s.Store.RevokeUserSessions(user.ID); derr != nil {
+			logger.Error("Could not revoke sessions", "user_id", user.ID, "error", derr)
+		}
+		s.disconnectUser(user.ID)
+	}
+	s.audit(r, auditUserStatus, fmt.Sprintf("user:%d", user.ID), map[string]string{
+		"Previous": user.Status,
+		"Status":   change.Status,
+		"Reason":   change.Reason,
+	})
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) handleAdminUserRole(w http.ResponseWriter, r *http.Request) {
+	change, err := containers.ParseUserRole(r.Body)
+	if err != nil {
+		writeErrorf(w, http.StatusBadRequest, CodeBadJSON, "Bad role json.")
+		return
+	}
+	user, ok := s.adminTarget(w, r)
+	if !ok {
+		return
+	}
+
+	if derr := s.Store.UpdateUserRole(user.ID, change.Role); derr != nil {
+		logging.FromContext(r.Context()).Error("Could not change the role of a user", "user_id", user.ID, "error", derr)
+		writeErrorf(w, http.StatusInternalServerError, CodeInternal, "Could not change the role.")
+		return
+	}
+	s.audit(r, auditUserRole, fmt.Sprintf("user:%d", user.ID), map[string]string{
+		"Previous": user.Role,
+		"Role":     change.Role,
+	})
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) handleAdminResetUsername(w http.ResponseWriter, r *http.Request) {
+	user, ok := s.adminTarget(w, r)
+	if !ok {
+		return
+	}
+
+	username := fmt.Sprintf("player%d", user.ID)
+	if derr := s.Store.UpdateUserUsername(user.ID, username); derr != nil {
+		if derr.ErrorType == database.ConflictError {
+			writeErrorf(w, http.StatusConflict, CodeConflict, "Another user is called %s.", username)
+			return
+		}
+		logging.FromContext(r.Context()).Error("Could not reset username", "user_id", user.ID, "error", derr)
+		writeErrorf(w, http.StatusInternalServerError, CodeInternal, "Could not reset the username.")
+		return
+	}
+	s.audit(r, auditUsernameReset, fmt.Sprintf("user:%d", user.ID), map[string]string{
+		"Previous": user.Username,
+		"Username": username,
+	})
+	writeJSON(w, http.StatusOK, map[string]interface{}{"Username": username})
+}
+
+func (s *Server) handleAdminRemoveWord(w http.ResponseWriter, r *http.Request) {
+	removal, err := containers.ParseWordRemoval(r.Body)
+	if err != nil {
+		writeErrorf(w, http.StatusBadRequest, CodeBadJSON, "Bad word json.")
+		return
+	}
+
+	removed, derr := s.Store.RemoveWord(removal.Word)
+	if derr != nil {
+		logging.FromContext(r.Context()).Error("Could not remove word", "word", removal.Word, "error", derr)
+		writeErrorf(w, http.StatusInternalServerError, CodeInternal, "Could not remove the word.")
+		return
+	}
+	if !removed {
+		writeErrorf(w, http.StatusNotFound, CodeNotFound, "No word %q in the dictionary.", removal.Word)
+		return
+	}
+	s.audit(r, auditWordRemove, "word:"+removal.Word, nil)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) handleAdminFlags(w http.ResponseWriter, r *http.Request) {
+	resolved, _ := strconv.ParseBool(r.URL.Query().Get("resolved"))
+	flags, derr := s.Store.GetFlags(resolved, adminListLimit)
+	if derr != nil {
+		logging.FromContext(r.Context()).Error("Could not get flags", "error", derr)
+		writeErrorf(w, http.StatusInternalServerError, CodeInternal, "Could not get flags.")
+		return
+	}
+	writeJSON(w, http.StatusOK, flags)
+}
+
+func (s *Server) handleAdminResolveFlag(w http.ResponseWriter, r *http.Request) {
+	id, err := utils.ParseUint(mux.Vars(r), "id")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, containers.Error{Code: CodeInvalidRequest, Message: err.Error()})
+		return
+	}
+	adminID, _ := r.Context().Value("id").(uint)
+
+	resolved, derr := s.Store.ResolveFlag(id, adminID)
+	if derr != nil {
+		logging.FromContext(r.Context()).Error("Could not resolve flag", "flag_id", id, "error", derr)
+		writeErrorf(w, http.StatusInternalServerError, CodeInternal, "Could not resolve the flag.")
+		return
+	}
+	if !resolved {
+		writeErrorf(w, http.StatusNotFound, CodeNotFound, "No open flag with id %d.", id)
+		return
+	}
+	s.audit(r, auditFlagResolve, fmt.Sprintf("flag:%d", id), nil)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) handleAdminAudit(w http.ResponseWriter, r *http.Request) {
+	entries, derr := s.Store.GetAuditLog(adminListLimit)
+	if derr != nil {
+		logging.FromContext(r.Context()).Error("Could not get the audit log", "error", derr)
+		writeErrorf(w, http.StatusInternalServerError, CodeInternal, "Could not get the audit log.")
+		return
+	}
+	writeJSON(w, http.StatusOK, entries)
+}
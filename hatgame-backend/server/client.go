@@ -0,0 +1,126 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+const sendBufferSize = 64
+
+type Conn interface {
+	ReadMessage() ([]byte, error)
+	WriteMessage(msg []byte) error
+	Ping() error
+	CloseGracefully() error
+	Close() error
+}
+
+type Client struct {
+	ID   uint
+	Log  *slog.Logger
+	conn Conn
+	send chan []byte
+	done chan struct{}
+	once *sync.Once
+}
+
+func NewClient(id uint, conn Conn, logger *slog.Logger) *Client {
+	client := &Client{
+		ID:   id,
+		Log:  logger,
+		conn: conn,
+		send: make(chan []byte, sendBufferSize),
+		done: make(chan struct{}),
+		once: &sync.Once{},
+	}
+	clientsConnected.Inc(transport(conn))
+	go client.writePump()
+	return client
+}
+
+func (c *Client) Send(msg []byte) error {
+	select {
+	case <-c.done:
+		eventsDropped.Inc("closed")
+		return fmt.Errorf("client %d is closed", c.ID)
+	default:
+	}
+
+	select {
+	case c.send <- msg:
+		return nil
+	case <-c.done:
+		eventsDropped.Inc("closed")
+		return fmt.Errorf("client %d is closed", c.ID)
+	default:
+		eventsDropped.Inc("slow")
+		c.Close()
+		return fmt.Errorf("client %d is too slow, disconnecting", c.ID)
+	}
+}
+
+func (c *Client) SendMessage(message *Message) error {
+	message.Version = ProtocolVersion
+	msg, err := json.Marshal(message)
+	if err != nil {
+		return fmt.Errorf("failed to marshal event payload into JSON: %w", err)
+	}
+	return c.Send(msg)
+}
+
+func (c *Client) ReadMessage() ([]byte, error) {
+	return c.conn.ReadMessage()
+}
+
+func (c *Client) Close() {
+	c.once.Do(func() {
+		close(c.done)
+		c.conn.Close()
+		clientsConnected.Dec(transport(c.conn))
+	})
+}
+
+func (c *Client) CloseAfterFlush() {
+	select {
+	case c.send <- nil:
+	case <-c.done:
+	default:
+		c.Close()
+	}
+}
+
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
+func (c *Client) writePump() {
+	ping := time.NewTicker(pingPeriod)
+	defer ping.Stop()
+	defer c.Close()
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case msg := <-c.send:
+			if msg == nil {
+				c.conn.CloseGracefully()
+				return
+			}
+			if err := c.conn.WriteMessage(msg); err != nil {
+				c.Log.Info("Could not write to player", "error", err)
+				eventsDropped.Inc("write_failed")
+				return
+			}
+			eventsSent.Inc()
+		case <-ping.C:
+			if err := c.conn.Ping(); err != nil {
+				c.Log.Info("Could not ping player", "error", err)
+				return
+			}
+		}
+	}
+}
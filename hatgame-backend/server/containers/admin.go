@@ -0,0 +1,104 @@
+package containers
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/bitterfly/go-chaos/hatgame/utils"
+)
+
+type Health struct {
+	Status   string
+	Instance string
+}
+
+type LiveRoom struct {
+	ID         uint
+	Code       string
+	Instance   string
+	Phase      string
+	Players    int
+	Connected  int
+	Capacity   int
+	Words      int
+	Timer      int
+	Started    time.Time
+	Age        int64
+	LastActive time.Time
+}
+
+type UserStatus struct {
+	Status string
+	Reason string
+}
+
+func ParseUserStatus(data io.ReadCloser) (*UserStatus, error) {
+	var container interface{} = &UserStatus{}
+	res, err := utils.Parse(data, container)
+	if err != nil {
+		return nil, err
+	}
+
+	status, ok := res.(*UserStatus)
+	if !ok {
+		return nil, fmt.Errorf("could not convert to UserStatus")
+	}
+	return status, nil
+}
+
+type UserRole struct {
+	Role string
+}
+
+func ParseUserRole(data io.ReadCloser) (*UserRole, error) {
+	var container interface{} = &UserRole{}
+	res, err := utils.Parse(data, container)
+	if err != nil {
+		return nil, err
+	}
+
+	role, ok := res.(*UserRole)
+	if !ok {
+		return nil, fmt.Errorf("could not convert to UserRole")
+	}
+	return role, nil
+}
+
+type WordRemoval struct {
+	Word string
+}
+
+func ParseWordRemoval(data io.ReadCloser) (*WordRemoval, error) {
+	var container interface{} = &WordRemoval{}
+	res, err := utils.Parse(data, container)
+	if err != nil {
+		return nil, err
+	}
+
+	removal, ok := res.(*WordRemoval)
+	if !ok {
+		return nil, fmt.Errorf("could not convert to WordRemoval")
+	}
+	return removal, nil
+}
+
+type FlagReport struct {
+	Kind   string
+	Target string
+	Reason string
+}
+
+func ParseFlagReport(data io.ReadCloser) (*FlagReport, error) {
+	var container interface{} = &FlagReport{}
+	res, err := utils.Parse(data, container)
+	if err != nil {
+		return nil, err
+	}
+
+	report, ok := res.(*FlagReport)
+	if !ok {
+		return nil, fmt.Errorf("could not convert to FlagReport")
+	}
+	return report, nil
+}
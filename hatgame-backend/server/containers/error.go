@@ -0,0 +1,12 @@
+package containers
+
+type FieldError struct {
+	Field   string
+	Message string
+}
+
+type Error struct {
+	Code    string
+	Message string
+	Fields  []FieldError `json:",omitempty"`
+}
@@ -9,9 +9,16 @@ import (
 
 type Host struct {
 	Players int
+	Words   int
 	Timer   int
 }
 
+type Room struct {
+	ID   uint
+	Code string
+	Host
+}
+
 func ParseHost(data io.ReadCloser) (*Host, error) {
 	var container interface{} = &Host{}
 	res, err := utils.Parse(data, container)
@@ -21,7 +28,7 @@ func ParseHost(data io.ReadCloser) (*Host, error) {
 
 	host, ok := res.(*Host)
 	if !ok {
-		return nil, fmt.Errorf("could not convert to server User")
+		return nil, fmt.Errorf("could not convert to server Host")
 	}
 	return host, nil
 }
@@ -0,0 +1,26 @@
+package containers
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/bitterfly/go-chaos/hatgame/utils"
+)
+
+type Refresh struct {
+	RefreshToken string
+}
+
+func ParseRefresh(data io.ReadCloser) (*Refresh, error) {
+	var container interface{} = &Refresh{}
+	res, err := utils.Parse(data, container)
+	if err != nil {
+		return nil, err
+	}
+
+	refresh, ok := res.(*Refresh)
+	if !ok {
+		return nil, fmt.Errorf("could not convert to Refresh")
+	}
+	return refresh, nil
+}
@@ -0,0 +1,46 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/bitterfly/go-chaos/hatgame/server/containers"
+)
+
+const (
+	CodeBadJSON          = "bad_json"
+	CodeInvalidRequest   = "invalid_request"
+	CodeInvalidSettings  = "invalid_settings"
+	CodeUnauthorized     = "unauthorized"
+	CodeWrongCredentials = "wrong_credentials"
+	CodeAccountDisabled  = "account_disabled"
+	CodeAccountBanned    = "account_banned"
+	CodeRefreshReused    = "refresh_reused"
+	CodeSessionExpired   = "session_expired"
+	CodeForbidden        = "forbidden"
+	CodeNotFound         = "not_found"
+	CodeMethodNotAllowed = "method_not_allowed"
+	CodeConflict         = "conflict"
+	CodeDraining         = "draining"
+	CodeTooManyGames     = "too_many_games"
+	CodeRateLimited      = "rate_limited"
+	CodeNotReady         = "not_ready"
+	CodeInternal         = "internal"
+)
+
+func writeError(w http.ResponseWriter, status int, e containers.Error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(e)
+}
+
+func writeErrorf(w http.ResponseWriter, status int, code string, format string, args ...interface{}) {
+	writeError(w, status, containers.Error{Code: code, Message: fmt.Sprintf(format, args...)})
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
@@ -0,0 +1,60 @@
+package server
+
+import (
+	"log/slog"
+
+	"github.com/bitterfly/go-chaos/hatgame/database"
+	"github.com/bitterfly/go-chaos/hatgame/game"
+)
+
+const (
+	eventLogBufferSize = 1024
+	eventLogBatchSize  = 128
+)
+
+type EventLog struct {
+	entries chan game.LogEntry
+	done    chan struct{}
+}
+
+func NewEventLog(store database.Store) *EventLog {
+	eventLog := &EventLog{
+		entries: make(chan game.LogEntry, eventLogBufferSize),
+		done:    make(chan struct{}),
+	}
+	go eventLog.write(store)
+	return eventLog
+}
+
+func (l *EventLog) Record(entry game.LogEntry) {
+	l.entries <- entry
+}
+
+func (l *EventLog) Close() {
+	close(l.entries)
+	<-l.done
+}
+
+func (l *EventLog) write(store database.Store) {
+	defer close(l.done)
+	batch := make([]game.LogEntry, 0, eventLogBatchSize)
+	for entry := range l.entries {
+		batch = append(batch[:0], entry)
+	collect:
+		for len(batch) < eventLogBatchSize {
+			select {
+			case entry, ok := <-l.entries:
+				if !ok {
+					break collect
+				}
+				batch = append(batch, entry)
+			default:
+				break collect
+			}
+		}
+
+		if derr := store.AddGameEvents(batch); derr != nil {
+			slog.Error("Could not write game events", "game_id", batch[0].GameID, "events", len(batch), "error", derr)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/bitterfly/go-chaos/hatgame/logging"
+	"github.com/bitterfly/go-chaos/hatgame/schema"
+	"github.com/bitterfly/go-chaos/hatgame/server/containers"
+)
+
+// handleFlag lets players report a user or a word to the admins.
+func (s *Server) handleFlag(w http.ResponseWriter, r *http.Request) {
+	id, ok := r.Context().Value("id").(uint)
+	if !ok {
+		writeErrorf(w, http.StatusInternalServerError, CodeInternal, "Missing user in request context.")
+		return
+	}
+	report, err := containers.ParseFlagReport(r.Body)
+	if err != nil {
+		writeErrorf(w, http.StatusBadRequest, CodeBadJSON, "Bad flag json.")
+		return
+	}
+
+	target := strings.TrimSpace(report.Target)
+	if report.Kind == schema.FlagUser {
+		userID, err := strconv.ParseUint(target, 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, containers.Error{
+				Code:    CodeInvalidRequest,
+				Message: "Invalid flag.",
+				Fields:  []containers.FieldError{{Field: "Target", Message: "has to be a user id"}},
+			})
+			return
+		}
+		if _, derr := s.Store.GetUserByID(uint(userID)); derr != nil {
+			writeErrorf(w, http.StatusNotFound, CodeNotFound, "No user with id %d.", userID)
+			return
+		}
+	}
+
+	flag := &schema.Flag{
+		ReporterID: id,
+		Kind:       report.Kind,
+		Target:     target,
+		Reason:     report.Reason,
+	}
+	flagID, derr := s.Store.AddFlag(flag)
+	if derr != nil {
+		logging.FromContext(r.Context()).Error("Could not add flag", "error", derr)
+		writeErrorf(w, http.StatusInternalServerError, CodeInternal, "Could not save the flag.")
+		return
+	}
+	writeJSON(w, http.StatusCreated, map[string]interface{}{"ID": flagID})
+}
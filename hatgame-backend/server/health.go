@@ -0,0 +1,31 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/bitterfly/go-chaos/hatgame/logging"
+	"github.com/bitterfly/go-chaos/hatgame/server/containers"
+)
+
+// handleHealth only tells that the process is up and serving.
+func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, containers.Health{Status: "ok", Instance: s.Instance})
+}
+
+// handleReady tells whether the instance should get traffic: the store is
+// usable and the server is not shutting down.
+func (s *Server) handleReady(w http.ResponseWriter, r *http.Request) {
+	s.Mutex.RLock()
+	draining := s.Draining
+	s.Mutex.RUnlock()
+	if draining {
+		writeErrorf(w, http.StatusServiceUnavailable, CodeDraining, "The server is shutting down.")
+		return
+	}
+	if derr := s.Store.Ready(); derr != nil {
+		logging.FromContext(r.Context()).Warn("Not ready", "error", derr)
+		writeErrorf(w, http.StatusServiceUnavailable, CodeNotReady, "The database is not ready.")
+		return
+	}
+	writeJSON(w, http.StatusOK, containers.Health{Status: "ready", Instance: s.Instance})
+}
@@ -0,0 +1,149 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const signingKeySize = 32
+
+type SigningKey struct {
+	ID      string
+	Secret  []byte
+	Created time.Time
+}
+
+type keyFile struct {
+	Keys []SigningKey
+}
+
+type KeySet struct {
+	filename string
+	keys     []SigningKey
+	mutex    *sync.RWMutex
+}
+
+func NewSigningKey() (SigningKey, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return SigningKey{}, err
+	}
+	secret := make([]byte, signingKeySize)
+	if _, err := rand.Read(secret); err != nil {
+		return SigningKey{}, err
+	}
+	return SigningKey{ID: hex.EncodeToString(id), Secret: secret, Created: time.Now().UTC()}, nil
+}
+
+func NewStaticKeySet(secret string) *KeySet {
+	sum := sha256.Sum256([]byte(secret))
+	return &KeySet{
+		keys:  []SigningKey{{ID: hex.EncodeToString(sum[:4]), Secret: []byte(secret)}},
+		mutex: &sync.RWMutex{},
+	}
+}
+
+func LoadKeySet(filename string) (*KeySet, error) {
+	keySet := &KeySet{filename: filename, mutex: &sync.RWMutex{}}
+	keys, err := ReadKeyFile(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		key, err := NewSigningKey()
+		if err != nil {
+			return nil, fmt.Errorf("could not generate signing key: %w", err)
+		}
+		keys = []SigningKey{key}
+		if err := WriteKeyFile(filename, keys); err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	}
+	keySet.keys = keys
+	return keySet, nil
+}
+
+func (k *KeySet) Reload() error {
+	if k.filename == "" {
+		return nil
+	}
+	keys, err := ReadKeyFile(k.filename)
+	if err != nil {
+		return err
+	}
+	k.mutex.Lock()
+	k.keys = keys
+	k.mutex.Unlock()
+	return nil
+}
+
+func (k *KeySet) Current() SigningKey {
+	k.mutex.RLock()
+	defer k.mutex.RUnlock()
+	return k.keys[0]
+}
+
+func (k *KeySet) Find(id string) (SigningKey, bool) {
+	k.mutex.RLock()
+	defer k.mutex.RUnlock()
+	for _, key := range k.keys {
+		if key.ID == id {
+			return key, true
+		}
+	}
+	return SigningKey{}, false
+}
+
+func ReadKeyFile(filename string) ([]SigningKey, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var file keyFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("could not parse key file %s: %w", filename, err)
+	}
+	if len(file.Keys) == 0 {
+		return nil, fmt.Errorf("key file %s has no keys", filename)
+	}
+	for _, key := range file.Keys {
+		if key.ID == "" || len(key.Secret) < signingKeySize {
+			return nil, fmt.Errorf("key file %s has a key without an id or with a secret shorter than %d bytes", filename, signingKeySize)
+		}
+	}
+	return file.Keys, nil
+}
+
+func WriteKeyFile(filename string, keys []SigningKey) error {
+	data, err := json.MarshalIndent(keyFile{Keys: keys}, "", "    ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+".*")
+	if err != nil {
+		return fmt.Errorf("could not write key file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if err := tmp.Chmod(0600); err != nil {
+		tmp.Close()
+		return fmt.Errorf("could not write key file: %w", err)
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("could not write key file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("could not write key file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), filename); err != nil {
+		return fmt.Errorf("could not write key file: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,234 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bitterfly/go-chaos/hatgame/config"
+	"github.com/bitterfly/go-chaos/hatgame/server/containers"
+)
+
+const sweepPeriod = time.Minute
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// Limiter is a token bucket per key. A key can use rate.Count tokens at once
+// and gets them back at rate.Count per rate.Per.
+type Limiter struct {
+	rate    config.Rate
+	buckets map[string]*bucket
+	swept   time.Time
+	now     func() time.Time
+	mutex   *sync.Mutex
+}
+
+func NewLimiter(rate config.Rate) *Limiter {
+	return &Limiter{
+		rate:    rate,
+		buckets: make(map[string]*bucket),
+		swept:   time.Now(),
+		now:     time.Now,
+		mutex:   &sync.Mutex{},
+	}
+}
+
+// Allow takes a token of the key. If there is none it returns false and how
+// long until there is one.
+func (l *Limiter) Allow(key string) (bool, time.Duration) {
+	if l.rate.Count == 0 {
+		return true, 0
+	}
+	perToken := l.rate.Per / time.Duration(l.rate.Count)
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	now := l.now()
+	l.sweep(now)
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(l.rate.Count), updated: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(float64(l.rate.Count), b.tokens+float64(now.Sub(b.updated))/float64(perToken))
+	b.updated = now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) * float64(perToken))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// sweep forgets the keys whose buckets have filled up again.
+func (l *Limiter) sweep(now time.Time) {
+	if now.Sub(l.swept) < sweepPeriod {
+		return
+	}
+	l.swept = now
+	for key, b := range l.buckets {
+		if now.Sub(b.updated) >= l.rate.Per {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+type failures struct {
+	count  int
+	last   time.Time
+	locked time.Time
+}
+
+// Lockouts counts failed logins per key. After `after` failures in a row the
+// key is locked out, first for `base` and then twice as long for every further
+// failure, up to `max`. Failures are forgotten `max` after the last one.
+type Lockouts struct {
+	after    int
+	base     time.Duration
+	max      time.Duration
+	failures map[string]*failures
+	swept    time.Time
+	now      func() time.Time
+	mutex    *sync.Mutex
+}
+
+func NewLockouts(limits config.Limits) *Lockouts {
+	return &Lockouts{
+		after:    limits.LockoutAfter,
+		base:     limits.Lockout.Duration,
+		max:      limits.MaxLockout.Duration,
+		failures: make(map[string]*failures),
+		swept:    time.Now(),
+		now:      time.Now,
+		mutex:    &sync.Mutex{},
+	}
+}
+
+// Locked tells how long the key is still locked out for.
+func (l *Lockouts) Locked(key string) time.Duration {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	f, ok := l.failures[key]
+	if !ok {
+		return 0
+	}
+	if wait := f.locked.Sub(l.now()); wait > 0 {
+		return wait
+	}
+	return 0
+}
+
+// Fail records a failure of the key and returns how long it is locked out for
+// because of it.
+func (l *Lockouts) Fail(key string) time.Duration {
+	if l.after == 0 {
+		return 0
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	now := l.now()
+	l.sweep(now)
+
+	f, ok := l.failures[key]
+	if !ok || now.Sub(f.last) >= l.max {
+		f = &failures{}
+		l.failures[key] = f
+	}
+	f.count++
+	f.last = now
+	if f.count < l.after {
+		return 0
+	}
+
+	lockout := l.max
+	if doublings := f.count - l.after; doublings < 32 {
+		lockout = min(l.base<<doublings, l.max)
+	}
+	f.locked = now.Add(lockout)
+	return lockout
+}
+
+// Reset forgets the failures of the key.
+func (l *Lockouts) Reset(key string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	delete(l.failures, key)
+}
+
+func (l *Lockouts) sweep(now time.Time) {
+	if now.Sub(l.swept) < sweepPeriod {
+		return
+	}
+	l.swept = now
+	for key, f := range l.failures {
+		if now.Sub(f.last) >= l.max && now.After(f.locked) {
+			delete(l.failures, key)
+		}
+	}
+}
+
+// retryAfter rounds the wait up to whole seconds, as Retry-After wants them.
+func retryAfter(wait time.Duration) int {
+	seconds := int(math.Ceil(wait.Seconds()))
+	if seconds < 1 {
+		return 1
+	}
+	return seconds
+}
+
+func writeTooManyRequests(w http.ResponseWriter, wait time.Duration, message string) {
+	seconds := retryAfter(wait)
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	writeError(w, http.StatusTooManyRequests, containers.Error{
+		Code:    CodeRateLimited,
+		Message: fmt.Sprintf("%s Try again in %d seconds.", message, seconds),
+	})
+}
+
+func (s *Server) trustedProxy(ip net.IP) bool {
+	for _, proxy := range s.Config.TrustedProxies {
+		if _, network, err := net.ParseCIDR(proxy); err == nil {
+			if network.Contains(ip) {
+				return true
+			}
+		} else if trusted := net.ParseIP(proxy); trusted != nil && trusted.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP is the address the request came from. Behind trusted proxies it is
+// the last address in X-Forwarded-For that is not one of them.
+func (s *Server) clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !s.trustedProxy(ip) {
+		return host
+	}
+
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		address := net.ParseIP(strings.TrimSpace(forwarded[i]))
+		if address == nil {
+			break
+		}
+		host = address.String()
+		if !s.trustedProxy(address) {
+			break
+		}
+	}
+	return host
+}
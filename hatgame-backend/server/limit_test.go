@@ -0,0 +1,311 @@
+package server
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/bitterfly/go-chaos/hatgame/config"
+)
+
+type testClock struct {
+	now time.Time
+}
+
+func newTestClock() *testClock {
+	return &testClock{now: time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)}
+}
+
+func (c *testClock) Now() time.Time {
+	return c.now
+}
+
+func (c *testClock) advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+type limitStep struct {
+	after   time.Duration
+	key     string
+	allowed bool
+	wait    time.Duration
+}
+
+func TestLimiter(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		rate  config.Rate
+		steps []limitStep
+	}{
+		{
+			name: "burst then refill",
+			rate: config.Rate{Count: 2, Per: time.Second},
+			steps: []limitStep{
+				{key: "a", allowed: true},
+				{key: "a", allowed: true},
+				{key: "a", allowed: false, wait: 500 * time.Millisecond},
+				{after: 250 * time.Millisecond, key: "a", allowed: false, wait: 250 * time.Millisecond},
+				{after: 250 * time.Millisecond, key: "a", allowed: true},
+				{key: "a", allowed: false, wait: 500 * time.Millisecond},
+			},
+		},
+		{
+			name: "keys are separate",
+			rate: config.Rate{Count: 1, Per: time.Minute},
+			steps: []limitStep{
+				{key: "a", allowed: true},
+				{key: "a", allowed: false, wait: time.Minute},
+				{key: "b", allowed: true},
+				{key: "b", allowed: false, wait: time.Minute},
+			},
+		},
+		{
+			name: "tokens do not pile up",
+			rate: config.Rate{Count: 2, Per: time.Second},
+			steps: []limitStep{
+				{after: time.Hour, key: "a", allowed: true},
+				{key: "a", allowed: true},
+				{key: "a", allowed: false, wait: 500 * time.Millisecond},
+			},
+		},
+		{
+			name: "zero count is no limit",
+			rate: config.Rate{Count: 0, Per: time.Second},
+			steps: []limitStep{
+				{key: "a", allowed: true},
+				{key: "a", allowed: true},
+				{key: "a", allowed: true},
+			},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			clock := newTestClock()
+			limiter := NewLimiter(test.rate)
+			limiter.now = clock.Now
+			for i, step := range test.steps {
+				clock.advance(step.after)
+				allowed, wait := limiter.Allow(step.key)
+				if allowed != step.allowed || wait != step.wait {
+					t.Errorf("step %d: got %t and %s, want %t and %s", i, allowed, wait, step.allowed, step.wait)
+				}
+			}
+		})
+	}
+}
+
+func TestLimiterSweep(t *testing.T) {
+	clock := newTestClock()
+	limiter := NewLimiter(config.Rate{Count: 1, Per: time.Second})
+	limiter.now = clock.Now
+	limiter.swept = clock.Now()
+
+	limiter.Allow("a")
+	limiter.Allow("b")
+	clock.advance(sweepPeriod)
+	limiter.Allow("c")
+	if _, ok := limiter.buckets["a"]; ok {
+		t.Error("a full bucket was kept")
+	}
+	if len(limiter.buckets) != 1 {
+		t.Errorf("%d buckets are kept, want 1", len(limiter.buckets))
+	}
+}
+
+type lockoutStep struct {
+	after  time.Duration
+	fail   bool
+	reset  bool
+	locked time.Duration
+}
+
+func TestLockouts(t *testing.T) {
+	limits := config.Limits{
+		LockoutAfter: 3,
+		Lockout:      config.Duration{Duration: time.Second},
+		MaxLockout:   config.Duration{Duration: 10 * time.Second},
+	}
+	for _, test := range []struct {
+		name   string
+		limits config.Limits
+		steps  []lockoutStep
+	}{
+		{
+			name:   "doubles up to the maximum",
+			limits: limits,
+			steps: []lockoutStep{
+				{fail: true, locked: 0},
+				{fail: true, locked: 0},
+				{fail: true, locked: time.Second},
+				{fail: true, locked: 2 * time.Second},
+				{fail: true, locked: 4 * time.Second},
+				{fail: true, locked: 8 * time.Second},
+				{fail: true, locked: 10 * time.Second},
+				{fail: true, locked: 10 * time.Second},
+			},
+		},
+		{
+			name:   "runs out",
+			limits: limits,
+			steps: []lockoutStep{
+				{fail: true},
+				{fail: true},
+				{fail: true, locked: time.Second},
+				{after: 400 * time.Millisecond, locked: 600 * time.Millisecond},
+				{after: 600 * time.Millisecond, locked: 0},
+			},
+		},
+		{
+			name:   "reset forgets the failures",
+			limits: limits,
+			steps: []lockoutStep{
+				{fail: true},
+				{fail: true},
+				{fail: true, locked: time.Second},
+				{reset: true, locked: 0},
+				{fail: true, locked: 0},
+				{fail: true, locked: 0},
+				{fail: true, locked: time.Second},
+			},
+		},
+		{
+			name:   "failures are forgotten after the maximum",
+			limits: limits,
+			steps: []lockoutStep{
+				{fail: true},
+				{fail: true},
+				{after: 10 * time.Second, fail: true, locked: 0},
+				{fail: true, locked: 0},
+				{fail: true, locked: time.Second},
+			},
+		},
+		{
+			name:   "zero failures is no lockout",
+			limits: config.Limits{Lockout: limits.Lockout, MaxLockout: limits.MaxLockout},
+			steps: []lockoutStep{
+				{fail: true},
+				{fail: true},
+				{fail: true},
+				{fail: true},
+			},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			clock := newTestClock()
+			lockouts := NewLockouts(test.limits)
+			lockouts.now = clock.Now
+			for i, step := range test.steps {
+				clock.advance(step.after)
+				if step.reset {
+					lockouts.Reset("key")
+				}
+				if step.fail {
+					if lockout := lockouts.Fail("key"); lockout != step.locked {
+						t.Errorf("step %d: failure locked out for %s, want %s", i, lockout, step.locked)
+					}
+				}
+				if locked := lockouts.Locked("key"); locked != step.locked {
+					t.Errorf("step %d: locked for %s, want %s", i, locked, step.locked)
+				}
+				if locked := lockouts.Locked("other"); locked != 0 {
+					t.Errorf("step %d: another key is locked for %s", i, locked)
+				}
+			}
+		})
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	for _, test := range []struct {
+		name      string
+		trusted   []string
+		remote    string
+		forwarded []string
+		want      string
+	}{
+		{
+			name:      "no proxies",
+			remote:    "203.0.113.7:5000",
+			forwarded: []string{"198.51.100.1"},
+			want:      "203.0.113.7",
+		},
+		{
+			name:      "untrusted remote",
+			trusted:   []string{"10.0.0.0/8"},
+			remote:    "203.0.113.7:5000",
+			forwarded: []string{"198.51.100.1"},
+			want:      "203.0.113.7",
+		},
+		{
+			name:      "trusted remote",
+			trusted:   []string{"10.0.0.0/8"},
+			remote:    "10.0.0.1:5000",
+			forwarded: []string{"198.51.100.1"},
+			want:      "198.51.100.1",
+		},
+		{
+			name:      "spoofed addresses before the proxies",
+			trusted:   []string{"10.0.0.0/8"},
+			remote:    "10.0.0.1:5000",
+			forwarded: []string{"192.0.2.66, 198.51.100.1, 10.0.0.2"},
+			want:      "198.51.100.1",
+		},
+		{
+			name:      "several headers",
+			trusted:   []string{"10.0.0.0/8"},
+			remote:    "10.0.0.1:5000",
+			forwarded: []string{"192.0.2.66", "198.51.100.1", "10.0.0.2"},
+			want:      "198.51.100.1",
+		},
+		{
+			name:      "single trusted address",
+			trusted:   []string{"127.0.0.1"},
+			remote:    "127.0.0.1:5000",
+			forwarded: []string{"198.51.100.1"},
+			want:      "198.51.100.1",
+		},
+		{
+			name:      "only proxies",
+			trusted:   []string{"10.0.0.0/8"},
+			remote:    "10.0.0.1:5000",
+			forwarded: []string{"10.0.0.3, 10.0.0.2"},
+			want:      "10.0.0.3",
+		},
+		{
+			name:    "no header",
+			trusted: []string{"10.0.0.0/8"},
+			remote:  "10.0.0.1:5000",
+			want:    "10.0.0.1",
+		},
+		{
+			name:      "garbage stops the walk",
+			trusted:   []string{"10.0.0.0/8"},
+			remote:    "10.0.0.1:5000",
+			forwarded: []string{"198.51.100.1, not-an-address, 10.0.0.2"},
+			want:      "10.0.0.2",
+		},
+		{
+			name:      "ipv6",
+			trusted:   []string{"::1"},
+			remote:    "[::1]:5000",
+			forwarded: []string{"2001:db8::1"},
+			want:      "2001:db8::1",
+		},
+		{
+			name:   "remote without a port",
+			remote: "203.0.113.7",
+			want:   "203.0.113.7",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			s := &Server{Config: config.Config{TrustedProxies: test.trusted}}
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = test.remote
+			for _, value := range test.forwarded {
+				r.Header.Add("X-Forwarded-For", value)
+			}
+			if got := s.clientIP(r); got != test.want {
+				t.Errorf("got %s, want %s", got, test.want)
+			}
+		})
+	}
+}
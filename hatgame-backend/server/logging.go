@@ -0,0 +1,72 @@
+package server
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"sync"
+
+	"github.com/bitterfly/go-chaos/hatgame/logging"
+	"github.com/felixge/httpsnoop"
+)
+
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// requestUser lets the access log see the user that authHandler found deeper
+// in the chain.
+type requestUser struct {
+	id    uint
+	mutex *sync.Mutex
+}
+
+func (u *requestUser) set(id uint) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	u.id = id
+}
+
+func (u *requestUser) get() uint {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	return u.id
+}
+
+func setRequestUser(ctx context.Context, id uint) context.Context {
+	if user, ok := ctx.Value("requestUser").(*requestUser); ok {
+		user.set(id)
+	}
+	return logging.With(ctx, "user_id", id)
+}
+
+// accessLog gives every request an ID and a logger carrying it and logs the
+// request once it is answered, without tickets or tokens in the URL.
+func accessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID := r.Header.Get("X-Request-ID")
+		if !requestIDPattern.MatchString(requestID) {
+			requestID = logging.NewRequestID()
+		}
+		w.Header().Set("X-Request-ID", requestID)
+
+		logger := slog.Default().With("request_id", requestID)
+		user := &requestUser{mutex: &sync.Mutex{}}
+		ctx := logging.WithLogger(r.Context(), logger)
+		ctx = context.WithValue(ctx, "requestUser", user)
+
+		m := httpsnoop.CaptureMetrics(next, w, r.WithContext(ctx))
+
+		attrs := []slog.Attr{
+			slog.String("method", r.Method),
+			slog.String("url", logging.Redact(r.URL)),
+			slog.Int("status", m.Code),
+			slog.Int64("bytes", m.Written),
+			slog.Duration("duration", m.Duration),
+			slog.String("remote", r.RemoteAddr),
+		}
+		if id := user.get(); id != 0 {
+			attrs = append(attrs, slog.Uint64("user_id", uint64(id)))
+		}
+		logger.LogAttrs(ctx, slog.LevelInfo, "request", attrs...)
+	})
+}
@@ -0,0 +1,162 @@
+package server
+
+import (
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bitterfly/go-chaos/hatgame/game"
+	"github.com/bitterfly/go-chaos/hatgame/metrics"
+	"github.com/felixge/httpsnoop"
+	"github.com/gorilla/mux"
+)
+
+var (
+	clientsConnected = metrics.NewGauge(
+		"hatgame_clients_connected",
+		"Players connected to this instance, by transport.",
+		"transport")
+	eventsSent = metrics.NewCounter(
+		"hatgame_events_sent_total",
+		"Messages written to players.")
+	eventsDropped = metrics.NewCounter(
+		"hatgame_events_dropped_total",
+		"Messages that could not be sent to players.",
+		"reason")
+	messageDuration = metrics.NewHistogram(
+		"hatgame_message_handling_seconds",
+		"Time spent in HandleMessage, by message type.",
+		metrics.DefaultBuckets,
+		"type")
+	httpRequests = metrics.NewCounter(
+		"hatgame_http_requests_total",
+		"HTTP requests, by route, method and status.",
+		"route", "method", "status")
+	httpDuration = metrics.NewHistogram(
+		"hatgame_http_request_duration_seconds",
+		"Time to answer HTTP requests, by route and method. Websockets and event streams count until they close.",
+		metrics.DefaultBuckets,
+		"route", "method")
+	loginFailures = metrics.NewCounter(
+		"hatgame_login_failures_total",
+		"Failed logins, by reason.",
+		"reason")
+	gamesCompleted = metrics.NewCounter(
+		"hatgame_games_completed_total",
+		"Games that ended, by result.",
+		"result")
+	rooms = metrics.NewGaugeFunc(
+		"hatgame_rooms",
+		"Rooms owned by this instance, by phase.",
+		collectCurrentRooms,
+		"phase")
+)
+
+// currentServer is the server the rooms gauge reports on, the last one made
+// by New.
+var (
+	currentServer      *Server
+	currentServerMutex = &sync.Mutex{}
+)
+
+func setCurrentServer(s *Server) {
+	currentServerMutex.Lock()
+	defer currentServerMutex.Unlock()
+	currentServer = s
+}
+
+func collectCurrentRooms() []metrics.Sample {
+	currentServerMutex.Lock()
+	s := currentServer
+	currentServerMutex.Unlock()
+	return s.collectRooms()
+}
+
+func transport(conn Conn) string {
+	switch conn.(type) {
+	case *wsConn:
+		return "websocket"
+	case *sseConn:
+		return "sse"
+	case *busConn:
+		return "relay"
+	}
+	return "unknown"
+}
+
+func (s *Server) collectRooms() []metrics.Sample {
+	games := make([]*game.Game, 0)
+	if s != nil {
+		s.Mutex.RLock()
+		for _, g := range s.Games {
+			games = append(games, g.State)
+		}
+		s.Mutex.RUnlock()
+	}
+
+	counts := map[game.Phase]int{
+		game.PhaseLobby: 0,
+		game.PhaseWords: 0,
+		game.PhaseGuess: 0,
+		game.PhaseEnded: 0,
+	}
+	for _, g := range games {
+		counts[g.Phase()]++
+	}
+	samples := make([]metrics.Sample, 0, len(counts))
+	for phase, count := range counts {
+		samples = append(samples, metrics.Sample{Labels: []string{string(phase)}, Value: float64(count)})
+	}
+	return samples
+}
+
+func (s *Server) measureRequest(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := "unknown"
+		if current := mux.CurrentRoute(r); current != nil {
+			if template, err := current.GetPathTemplate(); err == nil {
+				route = template
+			}
+		}
+
+		start := time.Now()
+		status := http.StatusOK
+		hijacked := false
+		wrapped := httpsnoop.Wrap(w, httpsnoop.Hooks{
+			WriteHeader: func(next httpsnoop.WriteHeaderFunc) httpsnoop.WriteHeaderFunc {
+				return func(code int) {
+					status = code
+					next(code)
+				}
+			},
+			Hijack: func(next httpsnoop.HijackFunc) httpsnoop.HijackFunc {
+				hijacked = true
+				return next
+			},
+		})
+		next.ServeHTTP(wrapped, r)
+
+		if hijacked {
+			status = http.StatusSwitchingProtocols
+		}
+		httpRequests.Inc(route, r.Method, strconv.Itoa(status))
+		httpDuration.Since(start, route, r.Method)
+	})
+}
+
+func (s *Server) serveMetrics(address string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Default.Handler())
+	metricsServer := &http.Server{Addr: address, Handler: mux}
+
+	s.Mutex.Lock()
+	s.metricsServer = metricsServer
+	s.Mutex.Unlock()
+
+	slog.Info("Serving metrics", "address", address, "path", "/metrics")
+	if err := metricsServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		slog.Error("Could not serve metrics", "error", err)
+	}
+}
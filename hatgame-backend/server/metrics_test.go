@@ -0,0 +1,30 @@
+package server
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/bitterfly/go-chaos/hatgame/cluster"
+	"github.com/bitterfly/go-chaos/hatgame/config"
+	"github.com/bitterfly/go-chaos/hatgame/database"
+	"github.com/bitterfly/go-chaos/hatgame/metrics"
+)
+
+func TestRoomsGaugeRegisteredOnce(t *testing.T) {
+	keys := NewStaticKeySet("0123456789abcdef0123456789abcdef")
+	for i := 0; i < 2; i++ {
+		local := cluster.NewLocal()
+		s := New(database.NewMemory(), keys, local, local, config.Default())
+		defer s.cancel()
+	}
+
+	var out bytes.Buffer
+	metrics.Default.Write(&out)
+	if n := strings.Count(out.String(), "# TYPE hatgame_rooms gauge"); n != 1 {
+		t.Errorf("hatgame_rooms is written %d times", n)
+	}
+	if !strings.Contains(out.String(), `hatgame_rooms{phase="lobby"} 0`) {
+		t.Errorf("no lobby rooms in:\n%s", out.String())
+	}
+}
@@ -0,0 +1,392 @@
+package server
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/bitterfly/go-chaos/hatgame/server/containers"
+	"github.com/gorilla/mux"
+)
+
+//go:embed openapi.json
+var openAPISpec []byte
+
+type openAPISchema struct {
+	Ref                  string                    `json:"$ref"`
+	Type                 string                    `json:"type"`
+	Properties           map[string]*openAPISchema `json:"properties"`
+	Required             []string                  `json:"required"`
+	AdditionalProperties *bool                     `json:"additionalProperties"`
+	Items                *openAPISchema            `json:"items"`
+	MinLength            *int                      `json:"minLength"`
+	MaxLength            *int                      `json:"maxLength"`
+	Minimum              *float64                  `json:"minimum"`
+	Maximum              *float64                  `json:"maximum"`
+	Enum                 []interface{}             `json:"enum"`
+	Nullable             bool                      `json:"nullable"`
+}
+
+type openAPIParameter struct {
+	Ref      string         `json:"$ref"`
+	Name     string         `json:"name"`
+	In       string         `json:"in"`
+	Required bool           `json:"required"`
+	Schema   *openAPISchema `json:"schema"`
+}
+
+type openAPIMediaType struct {
+	Schema *openAPISchema `json:"schema"`
+}
+
+type openAPIRequestBody struct {
+	Required bool                        `json:"required"`
+	Content  map[string]openAPIMediaType `json:"content"`
+}
+
+type openAPIOperation struct {
+	Parameters  []*openAPIParameter `json:"parameters"`
+	RequestBody *openAPIRequestBody `json:"requestBody"`
+}
+
+type openAPIDocument struct {
+	Paths      map[string]map[string]*openAPIOperation `json:"paths"`
+	Components struct {
+		Schemas    map[string]*openAPISchema    `json:"schemas"`
+		Parameters map[string]*openAPIParameter `json:"parameters"`
+	} `json:"components"`
+}
+
+type requestValidator struct {
+	document openAPIDocument
+}
+
+func newRequestValidator(spec []byte) (*requestValidator, error) {
+	v := &requestValidator{}
+	if err := json.Unmarshal(spec, &v.document); err != nil {
+		return nil, fmt.Errorf("could not parse OpenAPI spec: %w", err)
+	}
+	for path, operations := range v.document.Paths {
+		for method, operation := range operations {
+			for i, parameter := range operation.Parameters {
+				if parameter.Ref == "" {
+					continue
+				}
+				resolved, ok := v.document.Components.Parameters[strings.TrimPrefix(parameter.Ref, "#/components/parameters/")]
+				if !ok {
+					return nil, fmt.Errorf("%s %s: unknown parameter %s", method, path, parameter.Ref)
+				}
+				operation.Parameters[i] = resolved
+			}
+		}
+	}
+	return v, nil
+}
+
+func (v *requestValidator) operation(path string, method string) (*openAPIOperation, bool) {
+	operations, ok := v.document.Paths[path]
+	if !ok {
+		return nil, false
+	}
+	operation, ok := operations[strings.ToLower(method)]
+	return operation, ok
+}
+
+func (v *requestValidator) resolve(schema *openAPISchema) *openAPISchema {
+	for schema != nil && schema.Ref != "" {
+		schema = v.document.Components.Schemas[strings.TrimPrefix(schema.Ref, "#/components/schemas/")]
+	}
+	return schema
+}
+
+func (v *requestValidator) validateParameters(r *http.Request, operation *openAPIOperation) []containers.FieldError {
+	problems := make([]containers.FieldError, 0)
+	vars := mux.Vars(r)
+	query := r.URL.Query()
+	for _, parameter := range operation.Parameters {
+		var value string
+		var ok bool
+		switch parameter.In {
+		case "path":
+			value, ok = vars[parameter.Name]
+		case "query":
+			ok = query.Has(parameter.Name)
+			value = query.Get(parameter.Name)
+		default:
+			continue
+		}
+		if !ok {
+			if parameter.Required {
+				problems = append(problems, containers.FieldError{Field: parameter.Name, Message: "is required"})
+			}
+			continue
+		}
+
+		schema := v.resolve(parameter.Schema)
+		var parsed interface{} = value
+		if schema != nil && (schema.Type == "integer" || schema.Type == "number") {
+			if _, err := strconv.ParseFloat(value, 64); err != nil {
+				problems = append(problems, containers.FieldError{Field: parameter.Name, Message: "has to be a number"})
+				continue
+			}
+			parsed = json.Number(value)
+		}
+		if schema != nil && schema.Type == "boolean" {
+			if b, err := strconv.ParseBool(value); err == nil {
+				parsed = b
+			}
+		}
+		problems = append(problems, v.validateValue(parameter.Name, parsed, schema)...)
+	}
+	return problems
+}
+
+func (v *requestValidator) validateBody(r *http.Request, operation *openAPIOperation) ([]containers.FieldError, error) {
+	if operation.RequestBody == nil {
+		return nil, nil
+	}
+	media, ok := operation.RequestBody.Content["application/json"]
+	if !ok {
+		return nil, nil
+	}
+
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	r.Body = io.NopCloser(bytes.NewReader(data))
+	if len(bytes.TrimSpace(data)) == 0 {
+		if operation.RequestBody.Required {
+			return []containers.FieldError{{Field: "body", Message: "is required"}}, nil
+		}
+		return nil, nil
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var body interface{}
+	if err := decoder.Decode(&body); err != nil {
+		return nil, err
+	}
+	return v.validateValue("", body, media.Schema), nil
+}
+
+func fieldName(prefix, name string) string {
+	if prefix == "" {
+		return name
+	}
+	return prefix + "." + name
+}
+
+func (v *requestValidator) validateValue(field string, value interface{}, schema *openAPISchema) []containers.FieldError {
+	schema = v.resolve(schema)
+	if schema == nil {
+		return nil
+	}
+	problem := func(format string, args ...interface{}) []containers.FieldError {
+		name := field
+		if name == "" {
+			name = "body"
+		}
+		return []containers.FieldError{{Field: name, Message: fmt.Sprintf(format, args...)}}
+	}
+
+	if value == nil {
+		if schema.Nullable || schema.Type == "" {
+			return nil
+		}
+		return problem("can not be null")
+	}
+	if len(schema.Enum) > 0 {
+		found := false
+		for _, e := range schema.Enum {
+			if fmt.Sprint(e) == fmt.Sprint(value) {
+				found = true
+			}
+		}
+		if !found {
+			return problem("has to be one of %v", schema.Enum)
+		}
+	}
+
+	switch schema.Type {
+	case "object":
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return problem("has to be an object")
+		}
+		return v.validateObject(field, object, schema)
+	case "array":
+		array, ok := value.([]interface{})
+		if !ok {
+			return problem("has to be an array")
+		}
+		problems := make([]containers.FieldError, 0)
+		for i, item := range array {
+			problems = append(problems, v.validateValue(fmt.Sprintf("%s[%d]", field, i), item, schema.Items)...)
+		}
+		return problems
+	case "string":
+		s, ok := value.(string)
+		if !ok {
+			return problem("has to be a string")
+		}
+		length := utf8.RuneCountInString(s)
+		if schema.MinLength != nil && length < *schema.MinLength {
+			if *schema.MinLength == 1 {
+				return problem("can not be empty")
+			}
+			return problem("has to be at least %d characters long", *schema.MinLength)
+		}
+		if schema.MaxLength != nil && length > *schema.MaxLength {
+			return problem("has to be at most %d characters long", *schema.MaxLength)
+		}
+	case "integer", "number":
+		number, ok := value.(json.Number)
+		if !ok {
+			return problem("has to be a number")
+		}
+		n, err := number.Float64()
+		if err != nil {
+			return problem("has to be a number")
+		}
+		if schema.Type == "integer" {
+			if _, err := number.Int64(); err != nil {
+				return problem("has to be a whole number")
+			}
+		}
+		if schema.Minimum != nil && n < *schema.Minimum {
+			return problem("has to be at least %v", *schema.Minimum)
+		}
+		if schema.Maximum != nil && n > *schema.Maximum {
+			return problem("has to be at most %v", *schema.Maximum)
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			return problem("has to be true or false")
+		}
+	}
+	return nil
+}
+
+// Property names are matched case-insensitively, the same way encoding/json
+// decodes them into the containers.
+func (v *requestValidator) validateObject(field string, object map[string]interface{}, schema *openAPISchema) []containers.FieldError {
+	problems := make([]containers.FieldError, 0)
+	lookup := func(name string) (string, bool) {
+		for key := range object {
+			if strings.EqualFold(key, name) {
+				return key, true
+			}
+		}
+		return "", false
+	}
+
+	for _, name := range schema.Required {
+		if _, ok := lookup(name); !ok {
+			problems = append(problems, containers.FieldError{Field: fieldName(field, name), Message: "is required"})
+		}
+	}
+	keys := make([]string, 0, len(object))
+	for key := range object {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		value := object[key]
+		var property *openAPISchema
+		name := key
+		for n, p := range schema.Properties {
+			if strings.EqualFold(n, key) {
+				property, name = p, n
+				break
+			}
+		}
+		if property == nil {
+			if schema.AdditionalProperties != nil && !*schema.AdditionalProperties {
+				problems = append(problems, containers.FieldError{Field: fieldName(field, key), Message: "is not a known field"})
+			}
+			continue
+		}
+		problems = append(problems, v.validateValue(fieldName(field, name), value, property)...)
+	}
+	return problems
+}
+
+func (s *Server) validateRequest(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := mux.CurrentRoute(r)
+		if route == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		path, err := route.GetPathTemplate()
+		if err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		operation, ok := s.validator.operation(path, r.Method)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		problems := s.validator.validateParameters(r, operation)
+		bodyProblems, err := s.validator.validateBody(r, operation)
+		if err != nil {
+			writeErrorf(w, http.StatusBadRequest, CodeBadJSON, "Bad json: %s.", err)
+			return
+		}
+		problems = append(problems, bodyProblems...)
+		if len(problems) > 0 {
+			writeError(w, http.StatusBadRequest, containers.Error{
+				Code:    CodeInvalidRequest,
+				Message: "The request does not match the API description.",
+				Fields:  problems,
+			})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) checkDocumented() {
+	s.Mux.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		path, err := route.GetPathTemplate()
+		if err != nil {
+			return nil
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			methods = []string{"GET"}
+		}
+		for _, method := range methods {
+			if _, ok := s.validator.operation(path, method); !ok {
+				slog.Warn("Route is missing from openapi.json", "method", method, "path", path)
+			}
+		}
+		return nil
+	})
+}
+
+func (s *Server) handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(openAPISpec)
+}
+
+func (s *Server) handleNotFound(w http.ResponseWriter, r *http.Request) {
+	writeErrorf(w, http.StatusNotFound, CodeNotFound, "No route for %s.", r.URL.Path)
+}
+
+func (s *Server) handleMethodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	writeErrorf(w, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "%s is not allowed on %s.", r.Method, r.URL.Path)
+}
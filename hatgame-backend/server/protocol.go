@@ -0,0 +1,228 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/bitterfly/go-chaos/hatgame/game"
+	"github.com/bitterfly/go-chaos/hatgame/server/containers"
+)
+
+const ProtocolVersion = 1
+
+type ErrorCode string
+
+const (
+	ErrorMalformed   ErrorCode = "malformed"
+	ErrorVersion     ErrorCode = "unsupported_version"
+	ErrorUnknownType ErrorCode = "unknown_type"
+	ErrorBadPayload  ErrorCode = "bad_payload"
+	ErrorGameEnded   ErrorCode = "game_ended"
+	ErrorRejected    ErrorCode = "rejected"
+	ErrorAuth        ErrorCode = "unauthorized"
+	ErrorRateLimited ErrorCode = "rate_limited"
+	ErrorInternal    ErrorCode = "internal"
+)
+
+type Message struct {
+	Version int    `json:",omitempty"`
+	ID      string `json:",omitempty"`
+	Type    game.EventType
+	Msg     interface{}
+	Code    ErrorCode `json:",omitempty"`
+}
+
+type ProtocolError struct {
+	ID      string
+	Code    ErrorCode
+	Message string
+}
+
+func (e *ProtocolError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+func (e *ProtocolError) Reply() *Message {
+	return &Message{ID: e.ID, Type: game.EventError, Msg: e.Message, Code: e.Code}
+}
+
+type AuthPayload string
+type AddWordPayload string
+type GuessPayload string
+type ShutdownPayload int64
+type PlayerPayload uint
+type EmptyPayload struct{}
+
+type payloadType struct {
+	Type    game.EventType
+	Payload interface{}
+}
+
+// Messages clients may send, with the type their Msg is decoded into.
+// A nil payload means Msg has to be absent or null.
+var clientMessages = []payloadType{
+	{game.EventAuth, AuthPayload("")},
+	{game.EventAddWord, AddWordPayload("")},
+	{game.EventGuess, GuessPayload("")},
+	{game.EventRequestToStart, nil},
+	{game.EventReadyStoryteller, nil},
+	{game.EventAbort, nil},
+}
+
+var serverMessages = []payloadType{
+	{game.EventGameInfo, game.Info{}},
+	{game.EventReadyToStart, nil},
+	{game.EventWordPhaseStart, nil},
+	{game.EventAddWord, AddWordPayload("")},
+	{game.EventTeam, PlayerPayload(0)},
+	{game.EventGuessPhaseStart, PlayerPayload(0)},
+	{game.EventStory, ""},
+	{game.EventTick, 0},
+	{game.EventEnd, []containers.Result{}},
+	{game.EventDisconnected, PlayerPayload(0)},
+	{game.EventReconnected, PlayerPayload(0)},
+	{game.EventAborted, PlayerPayload(0)},
+	{game.EventClosed, nil},
+	{game.EventServerShutdown, ShutdownPayload(0)},
+	{game.EventAck, nil},
+	{game.EventConnected, ""},
+	{game.EventError, ""},
+}
+
+func findPayload(types []payloadType, eventType game.EventType) (payloadType, bool) {
+	for _, t := range types {
+		if t.Type == eventType {
+			return t, true
+		}
+	}
+	return payloadType{}, false
+}
+
+type inbound struct {
+	Version int
+	ID      string
+	Type    game.EventType
+	Msg     json.RawMessage
+}
+
+func DecodeMessage(data []byte) (*Message, *ProtocolError) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	in := inbound{}
+	if err := decoder.Decode(&in); err != nil {
+		return nil, &ProtocolError{Code: ErrorMalformed, Message: err.Error()}
+	}
+	if _, err := decoder.Token(); !errors.Is(err, io.EOF) {
+		return nil, &ProtocolError{ID: in.ID, Code: ErrorMalformed, Message: "trailing data after message"}
+	}
+	if in.Version != 0 && in.Version != ProtocolVersion {
+		return nil, &ProtocolError{
+			ID:      in.ID,
+			Code:    ErrorVersion,
+			Message: fmt.Sprintf("protocol version %d is not supported, use %d", in.Version, ProtocolVersion),
+		}
+	}
+
+	t, ok := findPayload(clientMessages, in.Type)
+	if !ok {
+		return nil, &ProtocolError{ID: in.ID, Code: ErrorUnknownType, Message: fmt.Sprintf("unknown message type %q", in.Type)}
+	}
+	msg := &Message{Version: in.Version, ID: in.ID, Type: in.Type}
+
+	empty := len(in.Msg) == 0 || string(in.Msg) == "null"
+	if t.Payload == nil {
+		if !empty {
+			return nil, &ProtocolError{ID: in.ID, Code: ErrorBadPayload, Message: fmt.Sprintf("%q does not take a Msg", in.Type)}
+		}
+		return msg, nil
+	}
+
+	var payload string
+	if empty || json.Unmarshal(in.Msg, &payload) != nil || payload == "" {
+		return nil, &ProtocolError{ID: in.ID, Code: ErrorBadPayload, Message: fmt.Sprintf("%q needs a non-empty string Msg", in.Type)}
+	}
+	switch t.Payload.(type) {
+	case AuthPayload:
+		msg.Msg = AuthPayload(payload)
+	case AddWordPayload:
+		msg.Msg = AddWordPayload(payload)
+	case GuessPayload:
+		msg.Msg = GuessPayload(payload)
+	}
+	return msg, nil
+}
+
+func ProtocolSchema() map[string]interface{} {
+	reflector := newSchemaReflector()
+	variants := func(types []payloadType, client bool) []interface{} {
+		result := make([]interface{}, 0, len(types))
+		for _, t := range types {
+			properties := map[string]interface{}{
+				"Version": map[string]interface{}{"const": ProtocolVersion},
+				"ID":      map[string]interface{}{"type": "string"},
+				"Type":    map[string]interface{}{"const": t.Type},
+			}
+			required := []string{"Type"}
+			if t.Payload == nil {
+				properties["Msg"] = map[string]interface{}{"type": "null"}
+			} else {
+				payload := reflector.schema(t.Payload)
+				if client && payload["type"] == "string" {
+					payload["minLength"] = 1
+				}
+				properties["Msg"] = payload
+				required = append(required, "Msg")
+			}
+			if !client {
+				required = append(required, "Version")
+				if t.Type == game.EventError {
+					properties["Code"] = map[string]interface{}{"enum": []ErrorCode{
+						ErrorMalformed, ErrorVersion, ErrorUnknownType, ErrorBadPayload,
+						ErrorGameEnded, ErrorRejected, ErrorAuth, ErrorRateLimited, ErrorInternal,
+					}}
+					required = append(required, "Code")
+				}
+			}
+			result = append(result, map[string]interface{}{
+				"title":                string(t.Type),
+				"type":                 "object",
+				"properties":           properties,
+				"required":             required,
+				"additionalProperties": false,
+			})
+		}
+		return result
+	}
+
+	clients := variants(clientMessages, true)
+	servers := variants(serverMessages, false)
+	reflector.defs["ClientMessage"] = map[string]interface{}{
+		"description": "Sent by the client. Field names are matched case-insensitively, a missing Version means the current one.",
+		"oneOf":       clients,
+	}
+	reflector.defs["ServerMessage"] = map[string]interface{}{
+		"description": "Sent by the server. If a client message had an ID, the ack or error for it carries the same ID.",
+		"oneOf":       servers,
+	}
+	return map[string]interface{}{
+		"$schema": "https://json-schema.org/draft/2020-12/schema",
+		"title":   fmt.Sprintf("hatgame websocket protocol, version %d", ProtocolVersion),
+		"$defs":   reflector.defs,
+		"anyOf": []interface{}{
+			map[string]interface{}{"$ref": "#/$defs/ClientMessage"},
+			map[string]interface{}{"$ref": "#/$defs/ServerMessage"},
+		},
+	}
+}
+
+func (s *Server) handleProtocolSchema(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/schema+json")
+	w.WriteHeader(http.StatusOK)
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(ProtocolSchema())
+}
@@ -0,0 +1,407 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/bitterfly/go-chaos/hatgame/cluster"
+	"github.com/bitterfly/go-chaos/hatgame/game"
+	"github.com/bitterfly/go-chaos/hatgame/schema"
+)
+
+const (
+	relayInboxSize = 16
+	relayOpenWait  = 5 * time.Second
+)
+
+// Players connected to an instance that does not own their room are relayed
+// over the bus. The owner sees every relayed player as a client with a
+// busConn, the relaying instance forwards between the bus and the player's
+// own connection.
+type relayKind string
+
+const (
+	relayOpen    relayKind = "open"
+	relayMessage relayKind = "message"
+	relayPing    relayKind = "ping"
+	relayClose   relayKind = "close"
+	// relayCloseRoom asks the owner to close the whole room.
+	relayCloseRoom relayKind = "close_room"
+)
+
+type relayEnvelope struct {
+	Kind   relayKind
+	Relay  string
+	Player uint   `json:",omitempty"`
+	Data   string `json:",omitempty"`
+}
+
+func roomTopic(id uint) string {
+	return fmt.Sprintf("hatgame_room_%d", id)
+}
+
+func relayTopic(relay string) string {
+	return "hatgame_relay_" + relay
+}
+
+func publish(bus cluster.Bus, topic string, envelope relayEnvelope) error {
+	data, err := json.Marshal(envelope)
+	if err != nil {
+		return err
+	}
+	return bus.Publish(topic, data)
+}
+
+type busConn struct {
+	log    *slog.Logger
+	bus    cluster.Bus
+	topic  string
+	inbox  chan []byte
+	alive  chan struct{}
+	closed chan struct{}
+	once   *sync.Once
+}
+
+func newBusConn(bus cluster.Bus, relay string, logger *slog.Logger) *busConn {
+	return &busConn{
+		log:    logger,
+		bus:    bus,
+		topic:  relayTopic(relay),
+		inbox:  make(chan []byte, relayInboxSize),
+		alive:  make(chan struct{}, 1),
+		closed: make(chan struct{}),
+		once:   &sync.Once{},
+	}
+}
+
+func (c *busConn) deliver(msg []byte) {
+	select {
+	case c.inbox <- msg:
+	case <-c.closed:
+	default:
+		c.log.Info("Relayed player is sending too fast, disconnecting")
+		c.Close()
+	}
+}
+
+func (c *busConn) touch() {
+	select {
+	case c.alive <- struct{}{}:
+	default:
+	}
+}
+
+func (c *busConn) ReadMessage() ([]byte, error) {
+	timeout := time.NewTimer(pongWait)
+	defer timeout.Stop()
+	for {
+		select {
+		case msg := <-c.inbox:
+			return msg, nil
+		case <-c.alive:
+			if !timeout.Stop() {
+				<-timeout.C
+			}
+			timeout.Reset(pongWait)
+		case <-c.closed:
+			return nil, ErrConnClosed
+		case <-timeout.C:
+			return nil, errors.New("relay stopped answering")
+		}
+	}
+}
+
+func (c *busConn) WriteMessage(msg []byte) error {
+	return publish(c.bus, c.topic, relayEnvelope{Kind: relayMessage, Data: string(msg)})
+}
+
+func (c *busConn) Ping() error {
+	return publish(c.bus, c.topic, relayEnvelope{Kind: relayPing})
+}
+
+func (c *busConn) CloseGracefully() error {
+	return publish(c.bus, c.topic, relayEnvelope{Kind: relayClose})
+}
+
+func (c *busConn) Close() error {
+	c.once.Do(func() {
+		close(c.closed)
+		c.CloseGracefully()
+	})
+	return nil
+}
+
+// serveRelays accepts relayed players for a game this instance owns.
+func (s *Server) serveRelays(serverGame *Game, sub *cluster.Subscription) {
+	currentGame := serverGame.State
+	conns := make(map[string]*busConn)
+	closeAll := func() {
+		for relay, conn := range conns {
+			conn.Close()
+			delete(conns, relay)
+		}
+	}
+	defer func() {
+		sub.Close()
+		closeAll()
+	}()
+
+	for {
+		select {
+		case <-currentGame.Done():
+			return
+		case data, ok := <-sub.C:
+			if !ok {
+				serverGame.Log.Warn("Lost the relay subscription, dropping relayed players")
+				closeAll()
+				var err error
+				if sub, err = s.Bus.Subscribe(roomTopic(currentGame.ID)); err != nil {
+					serverGame.Log.Error("Could not subscribe again", "error", err)
+					return
+				}
+				continue
+			}
+
+			var envelope relayEnvelope
+			if err := json.Unmarshal(data, &envelope); err != nil {
+				serverGame.Log.Warn("Bad relay message", "error", err)
+				continue
+			}
+			conn, ok := conns[envelope.Relay]
+			switch envelope.Kind {
+			case relayOpen:
+				user, derr := s.Store.GetUserByID(envelope.Player)
+				if derr != nil {
+					serverGame.Log.Error("Could not get user", "user_id", envelope.Player, "error", derr)
+					publish(s.Bus, relayTopic(envelope.Relay), relayEnvelope{Kind: relayClose})
+					continue
+				}
+				logger := serverGame.Log.With("user_id", user.ID, "relay", envelope.Relay)
+				conn = newBusConn(s.Bus, envelope.Relay, logger)
+				conns[envelope.Relay] = conn
+				go s.join(serverGame, NewClient(user.ID, conn, logger), user)
+			case relayMessage:
+				if ok {
+					conn.deliver([]byte(envelope.Data))
+				}
+			case relayPing:
+				if ok {
+					conn.touch()
+				}
+			case relayClose:
+				if ok {
+					conn.Close()
+					delete(conns, envelope.Relay)
+				}
+			case relayCloseRoom:
+				serverGame.Log.Info("Closing room for another instance")
+				go func() {
+					if err := s.closeGame(serverGame); err != nil {
+						serverGame.Log.Error("Could not close room", "error", err)
+					}
+				}()
+			}
+		}
+	}
+}
+
+// relay connects a local player to a game owned by another instance and
+// returns when either side goes away.
+func (s *Server) relay(room cluster.Room, client *Client, user *schema.User) {
+	relay := cluster.NewID()
+	logger := client.Log.With("relay", relay, "instance", room.Owner)
+	sub, err := s.Bus.Subscribe(relayTopic(relay))
+	if err != nil {
+		logger.Error("Could not subscribe", "error", err)
+		client.SendMessage(&Message{Type: game.EventError, Msg: "Could not reach the game.", Code: ErrorInternal})
+		client.CloseAfterFlush()
+		return
+	}
+	defer sub.Close()
+
+	topic := roomTopic(room.ID)
+	send := func(envelope relayEnvelope) {
+		envelope.Relay = relay
+		if err := publish(s.Bus, topic, envelope); err != nil {
+			logger.Warn("Could not relay", "error", err)
+		}
+	}
+	defer send(relayEnvelope{Kind: relayClose})
+	send(relayEnvelope{Kind: relayOpen, Player: user.ID})
+
+	go func() {
+		for {
+			data, err := client.ReadMessage()
+			if err != nil {
+				client.Close()
+				return
+			}
+			send(relayEnvelope{Kind: relayMessage, Data: string(data)})
+		}
+	}()
+
+	ping := time.NewTicker(pingPeriod)
+	defer ping.Stop()
+	open := time.NewTimer(relayOpenWait)
+	defer open.Stop()
+	last := time.Now()
+	answered := false
+
+	for {
+		select {
+		case <-client.Done():
+			return
+		case <-open.C:
+			if !answered {
+				logger.Warn("Instance did not answer")
+				client.Close()
+				return
+			}
+		case <-ping.C:
+			if time.Since(last) > pongWait {
+				logger.Warn("Instance stopped answering")
+				client.Close()
+				return
+			}
+			send(relayEnvelope{Kind: relayPing})
+		case data, ok := <-sub.C:
+			if !ok {
+				client.Close()
+				return
+			}
+			var envelope relayEnvelope
+			if err := json.Unmarshal(data, &envelope); err != nil {
+				logger.Warn("Bad relay message", "error", err)
+				continue
+			}
+			last = time.Now()
+			answered = true
+			switch envelope.Kind {
+			case relayMessage:
+				if err := client.Send([]byte(envelope.Data)); err != nil {
+					logger.Warn("Could not send event", "error", err)
+				}
+			case relayClose:
+				client.CloseAfterFlush()
+				return
+			}
+		}
+	}
+}
+
+// locate finds the game with the given id, either running here or on the
+// instance that owns its room. Rooms whose owner stopped renewing the lease
+// are taken over.
+func (s *Server) locate(id uint) (*Game, *cluster.Room, bool) {
+	s.Mutex.RLock()
+	serverGame, ok := s.Games[id]
+	s.Mutex.RUnlock()
+	if ok {
+		return serverGame, nil, true
+	}
+
+	room, err := s.Registry.Lookup(id)
+	if err != nil {
+		if !errors.Is(err, cluster.ErrNoRoom) {
+			slog.Error("Could not look up room", "game_id", id, "error", err)
+		}
+		return nil, nil, false
+	}
+	if room.Expired(time.Now()) {
+		s.takeOver(room)
+		s.Mutex.RLock()
+		serverGame, ok := s.Games[id]
+		s.Mutex.RUnlock()
+		if ok {
+			return serverGame, nil, true
+		}
+	}
+	if room.Owner == s.Instance || room.Expired(time.Now()) {
+		return nil, nil, false
+	}
+	return nil, &room, true
+}
+
+// enter puts the player in a game found by locate.
+func (s *Server) enter(serverGame *Game, room *cluster.Room, client *Client, user *schema.User) {
+	if serverGame != nil {
+		s.join(serverGame, client, user)
+		return
+	}
+	s.relay(*room, client, user)
+}
+
+func (s *Server) takeOver(room cluster.Room) {
+	logger := slog.With("game_id", room.ID)
+	room.Owner = s.Instance
+	room.Expires = time.Now().Add(s.Config.Cluster.Lease.Duration)
+	if err := s.Registry.Claim(room); err != nil {
+		if !errors.Is(err, cluster.ErrRoomTaken) {
+			logger.Error("Could not claim room", "error", err)
+		}
+		return
+	}
+	s.Mutex.RLock()
+	_, running := s.Games[room.ID]
+	s.Mutex.RUnlock()
+	if running {
+		return
+	}
+
+	snapshots, derr := s.Store.GetSnapshots()
+	if derr != nil {
+		logger.Error("Could not get snapshots", "error", derr)
+		return
+	}
+	for _, snapshot := range snapshots {
+		if snapshot.ID == room.ID {
+			if err := s.restoreSnapshot(snapshot, room.Code); err != nil {
+				logger.Error("Could not restore game", "error", err)
+			}
+			return
+		}
+	}
+	logger.Warn("Game has no snapshot, removing its room")
+	if err := s.Registry.Release(room.ID, s.Instance); err != nil {
+		logger.Error("Could not release room", "error", err)
+	}
+}
+
+// keepRooms renews the leases of the rooms of this instance and takes over
+// the rooms of instances that are gone.
+func (s *Server) keepRooms() {
+	lease := s.Config.Cluster.Lease.Duration
+	ticker := time.NewTicker(lease / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := s.Registry.Renew(s.Instance, time.Now().Add(lease)); err != nil {
+			slog.Error("Could not renew the room leases", "error", err)
+			continue
+		}
+		s.Mutex.RLock()
+		draining := s.Draining
+		s.Mutex.RUnlock()
+		if draining {
+			continue
+		}
+		expired, err := s.Registry.Expired(time.Now())
+		if err != nil {
+			slog.Error("Could not look for expired rooms", "error", err)
+			continue
+		}
+		for _, room := range expired {
+			slog.Info("Taking over game", "game_id", room.ID, "instance", room.Owner)
+			s.takeOver(room)
+		}
+	}
+}
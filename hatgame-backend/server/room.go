@@ -0,0 +1,179 @@
+package server
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/bitterfly/go-chaos/hatgame/cluster"
+	"github.com/bitterfly/go-chaos/hatgame/game"
+	"github.com/bitterfly/go-chaos/hatgame/logging"
+	"github.com/bitterfly/go-chaos/hatgame/server/containers"
+	"github.com/gorilla/mux"
+)
+
+const (
+	roomCodeAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+	roomCodeLength   = 6
+)
+
+func newRoomCode() string {
+	max := big.NewInt(int64(len(roomCodeAlphabet)))
+	code := make([]byte, roomCodeLength)
+	for i := range code {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			panic(fmt.Sprintf("could not generate room code: %s", err))
+		}
+		code[i] = roomCodeAlphabet[n.Int64()]
+	}
+	return string(code)
+}
+
+// claimRoom registers the game as owned by this instance, keeping the code
+// of a room that is taken over.
+func (s *Server) claimRoom(serverGame *Game, code string) error {
+	currentGame := serverGame.State
+	room := cluster.Room{
+		ID:      currentGame.ID,
+		Code:    code,
+		Owner:   s.Instance,
+		Players: currentGame.NumPlayers,
+		Words:   currentGame.NumWords,
+		Timer:   currentGame.Timer,
+		Expires: time.Now().Add(s.Config.Cluster.Lease.Duration),
+	}
+	for {
+		if code == "" {
+			room.Code = newRoomCode()
+		}
+		err := s.Registry.Claim(room)
+		if errors.Is(err, cluster.ErrCodeTaken) && code == "" {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		serverGame.Code = room.Code
+		return nil
+	}
+}
+
+func (s *Server) checkGameSettings(settings containers.Host) []containers.FieldError {
+	limits := s.Config.Games
+	problems := make([]containers.FieldError, 0)
+	if settings.Players < 2 || settings.Players > limits.MaxPlayers || settings.Players%2 != 0 {
+		problems = append(problems, containers.FieldError{
+			Field:   "Players",
+			Message: fmt.Sprintf("has to be even and between 2 and %d", limits.MaxPlayers),
+		})
+	}
+	if settings.Words < 1 || settings.Words > limits.MaxWords {
+		problems = append(problems, containers.FieldError{
+			Field:   "Words",
+			Message: fmt.Sprintf("has to be between 1 and %d", limits.MaxWords),
+		})
+	}
+	if settings.Timer < limits.MinTimer || settings.Timer > limits.MaxTimer {
+		problems = append(problems, containers.FieldError{
+			Field:   "Timer",
+			Message: fmt.Sprintf("has to be between %d and %d seconds", limits.MinTimer, limits.MaxTimer),
+		})
+	}
+	return problems
+}
+
+func (s *Server) checkCapacity() (containers.Error, bool) {
+	s.Mutex.RLock()
+	draining := s.Draining
+	running := len(s.Games) + len(s.starting)
+	s.Mutex.RUnlock()
+	if draining {
+		return containers.Error{Code: CodeDraining, Message: "The server is shutting down, not accepting new games."}, false
+	}
+	if running >= s.Config.Games.MaxRunning {
+		return containers.Error{Code: CodeTooManyGames, Message: "Too many games are running, try again later."}, false
+	}
+	return containers.Error{}, true
+}
+
+func (s *Server) handleCreateRoom(w http.ResponseWriter, r *http.Request) {
+	logger := logging.FromContext(r.Context())
+	id, ok := r.Context().Value("id").(uint)
+	if !ok {
+		writeErrorf(w, http.StatusInternalServerError, CodeInternal, "Missing user in request context.")
+		return
+	}
+
+	settings, err := containers.ParseHost(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, containers.Error{Code: CodeBadJSON, Message: fmt.Sprintf("Bad room json: %s", err)})
+		return
+	}
+	if problems := s.checkGameSettings(*settings); len(problems) > 0 {
+		writeError(w, http.StatusBadRequest, containers.Error{Code: CodeInvalidSettings, Message: "Invalid game settings.", Fields: problems})
+		return
+	}
+	if e, ok := s.checkCapacity(); !ok {
+		logger.Warn(e.Message)
+		writeError(w, http.StatusServiceUnavailable, e)
+		return
+	}
+
+	user, derr := s.Store.GetUserByID(id)
+	if derr != nil {
+		logger.Error("Could not get user", "error", derr)
+		writeError(w, http.StatusInternalServerError, containers.Error{Code: CodeInternal, Message: "Could not fetch user."})
+		return
+	}
+
+	gameID, err := s.Registry.NextID()
+	if err != nil {
+		logger.Error("Could not get a game id", "error", err)
+		writeError(w, http.StatusInternalServerError, containers.Error{Code: CodeInternal, Message: "Could not create room."})
+		return
+	}
+	currentGame := game.NewGame(
+		s.ctx,
+		gameID,
+		containers.User{ID: user.ID, Email: user.Email, Username: user.Username},
+		settings.Players,
+		settings.Words,
+		settings.Timer,
+		game.NewSeed())
+	// The host is not connected until they open the websocket, joining then
+	// goes through the reconnect path.
+	currentGame.Players.Disconnected[user.ID] = struct{}{}
+	serverGame, err := s.startGame(currentGame, "")
+	if err != nil {
+		logger.Error("Could not start game", "game_id", gameID, "error", err)
+		writeError(w, http.StatusInternalServerError, containers.Error{Code: CodeInternal, Message: "Could not create room."})
+		return
+	}
+	time.AfterFunc(abandonTimeout, currentGame.AbandonIfEmpty)
+
+	writeJSON(w, http.StatusCreated, containers.Room{ID: currentGame.ID, Code: serverGame.Code, Host: *settings})
+}
+
+func (s *Server) handleRoomShow(w http.ResponseWriter, r *http.Request) {
+	code := strings.ToUpper(mux.Vars(r)["code"])
+
+	room, err := s.Registry.LookupCode(code)
+	if err != nil {
+		if !errors.Is(err, cluster.ErrNoRoom) {
+			logging.FromContext(r.Context()).Error("Could not look up room", "code", code, "error", err)
+		}
+		writeError(w, http.StatusNotFound, containers.Error{Code: CodeNotFound, Message: fmt.Sprintf("No room with code %s.", code)})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, containers.Room{
+		ID:   room.ID,
+		Code: room.Code,
+		Host: containers.Host{Players: room.Players, Words: room.Words, Timer: room.Timer},
+	})
+}
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"reflect"
+	"strings"
+	"time"
+)
+
+type schemaReflector struct {
+	defs map[string]interface{}
+}
+
+func newSchemaReflector() *schemaReflector {
+	return &schemaReflector{defs: make(map[string]interface{})}
+}
+
+func (r *schemaReflector) schema(value interface{}) map[string]interface{} {
+	return r.reflect(reflect.TypeOf(value))
+}
+
+func (r *schemaReflector) reflect(t reflect.Type) map[string]interface{} {
+	if t == reflect.TypeOf(time.Time{}) {
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		return map[string]interface{}{
+			"anyOf": []interface{}{r.reflect(t.Elem()), map[string]interface{}{"type": "null"}},
+		}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer", "minimum": 0}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "string", "contentEncoding": "base64"}
+		}
+		return map[string]interface{}{"type": "array", "items": r.reflect(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": r.reflect(t.Elem())}
+	case reflect.Struct:
+		return r.reflectStruct(t)
+	default:
+		return map[string]interface{}{}
+	}
+}
+
+func (r *schemaReflector) reflectStruct(t reflect.Type) map[string]interface{} {
+	name := t.Name()
+	ref := map[string]interface{}{"$ref": "#/$defs/" + name}
+	if name != "" {
+		if _, ok := r.defs[name]; ok {
+			return ref
+		}
+		// Placeholder so recursive types terminate.
+		r.defs[name] = map[string]interface{}{}
+	}
+
+	properties := make(map[string]interface{})
+	required := make([]string, 0)
+	r.addFields(t, properties, &required)
+	schema := map[string]interface{}{
+		"type":                 "object",
+		"properties":           properties,
+		"required":             required,
+		"additionalProperties": false,
+	}
+	if name == "" {
+		return schema
+	}
+	r.defs[name] = schema
+	return ref
+}
+
+func (r *schemaReflector) addFields(t reflect.Type, properties map[string]interface{}, required *[]string) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" && !field.Anonymous {
+			continue
+		}
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		parts := strings.SplitN(tag, ",", 2)
+		name, options := parts[0], ""
+		if len(parts) == 2 {
+			options = parts[1]
+		}
+		if field.Anonymous && name == "" && field.Type.Kind() == reflect.Struct {
+			r.addFields(field.Type, properties, required)
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		properties[name] = r.reflect(field.Type)
+		if !strings.Contains(options, "omitempty") {
+			*required = append(*required, name)
+		}
+	}
+}
@@ -3,16 +3,21 @@ package server
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
-	"os"
+	"net/url"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
+	"github.com/bitterfly/go-chaos/hatgame/cluster"
+	"github.com/bitterfly/go-chaos/hatgame/config"
 	"github.com/bitterfly/go-chaos/hatgame/database"
 	"github.com/bitterfly/go-chaos/hatgame/game"
+	"github.com/bitterfly/go-chaos/hatgame/logging"
 	"github.com/bitterfly/go-chaos/hatgame/schema"
 	"github.com/bitterfly/go-chaos/hatgame/server/containers"
 	"github.com/bitterfly/go-chaos/hatgame/utils"
@@ -20,156 +25,421 @@ import (
 	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
 	"golang.org/x/crypto/bcrypt"
-	"gorm.io/gorm"
 )
 
-type Message struct {
-	Type game.EventType
-	Msg  interface{}
-}
+const (
+	writeWait  = 10 * time.Second
+	pongWait   = 60 * time.Second
+	pingPeriod = (pongWait * 9) / 10
+
+	abandonTimeout = 10 * time.Minute
+)
 
 type Game struct {
-	Players map[uint]*websocket.Conn
+	Code    string
+	Players map[uint]*Client
 	State   *game.Game
+	Mutex   *sync.RWMutex
+	Log     *slog.Logger
+	Started time.Time
+	active  time.Time
+}
+
+func (g *Game) Client(id uint) (*Client, bool) {
+	g.Mutex.RLock()
+	defer g.Mutex.RUnlock()
+	client, ok := g.Players[id]
+	return client, ok
+}
+
+func (g *Game) Add(client *Client) {
+	g.Mutex.Lock()
+	defer g.Mutex.Unlock()
+	g.Players[client.ID] = client
+	g.active = time.Now()
+}
+
+// Touch marks that a player did something in the game.
+func (g *Game) Touch() {
+	g.Mutex.Lock()
+	defer g.Mutex.Unlock()
+	g.active = time.Now()
+}
+
+func (g *Game) LastActive() time.Time {
+	g.Mutex.RLock()
+	defer g.Mutex.RUnlock()
+	return g.active
+}
+
+func (g *Game) Remove(client *Client) bool {
+	g.Mutex.Lock()
+	defer g.Mutex.Unlock()
+	if current, ok := g.Players[client.ID]; !ok || current != client {
+		return false
+	}
+	delete(g.Players, client.ID)
+	return true
+}
+
+func (g *Game) Broadcast(message *Message) {
+	g.Mutex.RLock()
+	defer g.Mutex.RUnlock()
+	for _, client := range g.Players {
+		if err := client.SendMessage(message); err != nil {
+			client.Log.Warn("Could not send event", "type", message.Type, "error", err)
+		}
+	}
 }
 
 type Server struct {
-	Mux      *mux.Router
-	Server   *http.Server
-	DB       *gorm.DB
-	Token    Token
-	Games    map[uint]*Game
-	Mutex    *sync.RWMutex
-	Upgrader websocket.Upgrader
-}
-
-func New(db *gorm.DB) *Server {
-	return &Server{
-		DB:    db,
-		Mux:   mux.NewRouter(),
-		Token: NewToken(32),
-		Games: make(map[uint]*Game),
-		Mutex: &sync.RWMutex{},
-		Upgrader: websocket.Upgrader{
-			ReadBufferSize:  1024,
-			WriteBufferSize: 1024,
-			//TODO: Also fix this origin.
-			CheckOrigin: func(r *http.Request) bool {
-				return true
-			},
-		},
-	}
-}
-
-func (s *Server) getGameID() uint {
-	var m uint
-	for k := range s.Games {
-		if k > m {
-			m = k
+	Mux           *mux.Router
+	Server        *http.Server
+	Store         database.Store
+	Config        config.Config
+	Token         Token
+	Tickets       *Tickets
+	Registry      cluster.Registry
+	Bus           cluster.Bus
+	Instance      string
+	Streams       *Streams
+	Games         map[uint]*Game
+	starting      map[uint]struct{}
+	Mutex         *sync.RWMutex
+	Upgrader      websocket.Upgrader
+	Draining      bool
+	LoginLimit    *Limiter
+	RegisterLimit *Limiter
+	MessageLimit  *Limiter
+	Lockouts      *Lockouts
+	validator     *requestValidator
+	metricsServer *http.Server
+	ctx           context.Context
+	cancel        context.CancelFunc
+}
+
+func New(store database.Store, keys *KeySet, registry cluster.Registry, bus cluster.Bus, cfg config.Config) *Server {
+	validator, err := newRequestValidator(openAPISpec)
+	if err != nil {
+		panic(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &Server{
+		validator: validator,
+		ctx:       ctx,
+		cancel:    cancel,
+		Store:     store,
+		Config:    cfg,
+		Mux:       mux.NewRouter(),
+		Token:     NewToken(keys, cfg.TokenLifetime.Duration),
+		Tickets:   NewTickets(store),
+		Streams:   NewStreams(),
+		Games:     make(map[uint]*Game),
+		starting:  make(map[uint]struct{}),
+		Registry:  registry,
+		Bus:       bus,
+		Instance:  cfg.Cluster.Instance,
+		Mutex:     &sync.RWMutex{},
+
+		LoginLimit:    NewLimiter(cfg.Limits.Login),
+		RegisterLimit: NewLimiter(cfg.Limits.Register),
+		MessageLimit:  NewLimiter(cfg.Limits.Messages),
+		Lockouts:      NewLockouts(cfg.Limits),
+	}
+	if s.Instance == "" {
+		s.Instance = cluster.NewID()
+	}
+	setCurrentServer(s)
+	s.Upgrader = websocket.Upgrader{
+		ReadBufferSize:  1024,
+		WriteBufferSize: 1024,
+		CheckOrigin:     s.checkOrigin,
+	}
+	return s
+}
+
+func (s *Server) originAllowed(origin string) bool {
+	for _, allowed := range s.Config.AllowedOrigins {
+		if allowed == "*" || strings.EqualFold(strings.TrimSuffix(allowed, "/"), origin) {
+			return true
 		}
 	}
-	return m + 1
+	return false
+}
+
+func (s *Server) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err == nil && strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	return s.originAllowed(origin)
 }
 
 func (s *Server) Connect(address string) error {
 	authRouter := s.Mux.NewRoute().Subrouter()
-	authRouter.Use(s.authHandler)
+	authRouter.Use(s.authHandler, s.validateRequest)
 	authRouter.HandleFunc("/api/user/id/{id}", s.handleUserShow).Methods("GET")
 	authRouter.HandleFunc("/api/game/id/{id}", s.handleGameShow).Methods("POST")
+	authRouter.HandleFunc("/api/game/id/{id}/log", s.handleLiveGameLog).Methods("GET")
+	authRouter.HandleFunc("/api/game/log/{key}", s.handleGameLog).Methods("GET")
+	authRouter.HandleFunc("/api/game/log/{key}/replay", s.handleGameReplay).Methods("GET")
 	authRouter.HandleFunc("/api/user/change", s.handleUserChange).Methods("POST")
 	authRouter.HandleFunc("/api/user", s.handleUserGet).Methods("POST")
 	authRouter.HandleFunc("/api/stat", s.handleStat).Methods("GET")
 	authRouter.HandleFunc("/api/recommend", s.handleRecommend).Methods("POST")
+	authRouter.HandleFunc("/api/logout", s.handleLogout).Methods("POST")
+	authRouter.HandleFunc("/api/logout/all", s.handleLogoutAll).Methods("POST")
+	authRouter.HandleFunc("/api/ws/ticket", s.handleTicket).Methods("POST")
+	authRouter.HandleFunc("/api/room", s.handleCreateRoom).Methods("POST")
+	authRouter.HandleFunc("/api/room/{code}", s.handleRoomShow).Methods("GET")
+	authRouter.HandleFunc("/api/sse/{connection}", s.handleSSECommand).Methods("POST")
+	authRouter.HandleFunc("/api/flag", s.handleFlag).Methods("POST")
+
+	adminRouter := s.Mux.NewRoute().Subrouter()
+	adminRouter.Use(s.authHandler, s.adminHandler, s.validateRequest)
+	adminRouter.HandleFunc("/api/admin/rooms", s.handleAdminRooms).Methods("GET")
+	adminRouter.HandleFunc("/api/admin/rooms/{id}/close", s.handleAdminCloseRoom).Methods("POST")
+	adminRouter.HandleFunc("/api/admin/users", s.handleAdminUsers).Methods("GET")
+	adminRouter.HandleFunc("/api/admin/users/{id}/status", s.handleAdminUserStatus).Methods("POST")
+	adminRouter.HandleFunc("/api/admin/users/{id}/role", s.handleAdminUserRole).Methods("POST")
+	adminRouter.HandleFunc("/api/admin/users/{id}/username/reset", s.handleAdminResetUsername).Methods("POST")
+	adminRouter.HandleFunc("/api/admin/words/remove", s.handleAdminRemoveWord).Methods("POST")
+	adminRouter.HandleFunc("/api/admin/flags", s.handleAdminFlags).Methods("GET")
+	adminRouter.HandleFunc("/api/admin/flags/{id}/resolve", s.handleAdminResolveFlag).Methods("POST")
+	adminRouter.HandleFunc("/api/admin/audit", s.handleAdminAudit).Methods("GET")
+
+	publicRouter := s.Mux.NewRoute().Subrouter()
+	publicRouter.Use(s.validateRequest)
+	publicRouter.HandleFunc("/api/", s.handleMain)
+	publicRouter.HandleFunc("/healthz", s.handleHealth).Methods("GET")
+	publicRouter.HandleFunc("/readyz", s.handleReady).Methods("GET")
+	publicRouter.HandleFunc("/api/openapi.json", s.handleOpenAPI).Methods("GET")
+	publicRouter.HandleFunc("/api/login", s.handleUserLogin).Methods("POST")
+	publicRouter.HandleFunc("/api/register", s.handleUserRegister).Methods("POST")
+	publicRouter.HandleFunc("/api/token/refresh", s.handleRefresh).Methods("POST")
+	publicRouter.HandleFunc("/api/ws/schema", s.handleProtocolSchema).Methods("GET")
+	publicRouter.HandleFunc("/api/ws/host/{players}/{numWords}/{timer}", s.handleHost)
+	publicRouter.HandleFunc("/api/ws/join/{id}", s.handleJoin)
+	publicRouter.HandleFunc("/api/sse/join/{id}", s.handleSSEJoin).Methods("GET")
+	// Deprecated: these put the session token in the URL, use a ticket instead.
+	publicRouter.HandleFunc("/api/host/{sessionToken}/{players}/{numWords}/{timer}", s.handleHost)
+	publicRouter.HandleFunc("/api/join/{sessionToken}/{id}", s.handleJoin)
+	s.Mux.NotFoundHandler = http.HandlerFunc(s.handleNotFound)
+	s.Mux.MethodNotAllowedHandler = http.HandlerFunc(s.handleMethodNotAllowed)
+	s.checkDocumented()
+	s.Mux.Use(s.measureRequest, mux.CORSMethodMiddleware(s.Mux))
+	slog.Info("Starting server", "address", address, "instance", s.Instance)
+	go s.keepRooms()
+	if s.Config.MetricsListen != "" {
+		go s.serveMetrics(s.Config.MetricsListen)
+	}
 
-	s.Mux.HandleFunc("/api/", s.handleMain)
-	s.Mux.HandleFunc("/api/login", s.handleUserLogin).Methods("POST")
-	s.Mux.HandleFunc("/api/register", s.handleUserRegister).Methods("POST")
-	s.Mux.HandleFunc("/api/host/{sessionToken}/{players}/{numWords}/{timer}", s.handleHost)
-	s.Mux.HandleFunc("/api/join/{sessionToken}/{id}", s.handleJoin)
-	s.Mux.Use(mux.CORSMethodMiddleware(s.Mux))
-	log.Printf("Starting server on %s\n", address)
-
-	//TODO: fix the allowed origins
-	allowedOrigins := handlers.AllowedOrigins([]string{"*"})
+	allowedOrigins := handlers.AllowedOriginValidator(s.originAllowed)
 	allowedMethods := handlers.AllowedMethods([]string{"POST", "OPTIONS", "GET"})
 	allowedHeaders := handlers.AllowedHeaders([]string{"X-Requested-With", "Content-Type", "Authorization"})
 
-	if err := http.ListenAndServe(
-		address,
-		handlers.LoggingHandler(os.Stderr, handlers.CORS(
-			allowedOrigins,
-			allowedMethods,
-			allowedHeaders)(s.Mux))); err != nil {
+	handler := accessLog(handlers.CORS(
+		allowedOrigins,
+		allowedMethods,
+		allowedHeaders)(s.Mux))
+
+	httpServer := &http.Server{
+		Addr:    address,
+		Handler: handler,
+	}
+	s.Mutex.Lock()
+	s.Server = httpServer
+	s.Mutex.Unlock()
+
+	if err := httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 		return fmt.Errorf("error connecting to server %s: %w", address, err)
 	}
 	return nil
 }
 
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.Mutex.Lock()
+	s.Draining = true
+	httpServer := s.Server
+	metricsServer := s.metricsServer
+	games := make([]*Game, 0, len(s.Games))
+	for _, g := range s.Games {
+		games = append(games, g)
+	}
+	s.Mutex.Unlock()
+
+	var deadline int64
+	if d, ok := ctx.Deadline(); ok {
+		deadline = d.Unix()
+	}
+	for _, g := range games {
+		g.Broadcast(&Message{Type: game.EventServerShutdown, Msg: deadline})
+	}
+
+	var err error
+	if httpServer != nil {
+		err = httpServer.Shutdown(ctx)
+	}
+
+	slog.Info("Waiting for running games to finish", "games", len(games))
+	if !s.waitForGames(ctx) {
+		slog.Warn("Shutdown deadline reached, checkpointing the remaining games")
+	}
+	s.cancel()
+	if metricsServer != nil {
+		metricsServer.Close()
+	}
+
+	cleanupCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	s.waitForGames(cleanupCtx)
+	if rerr := s.Registry.Abandon(s.Instance); rerr != nil {
+		slog.Error("Could not hand over the rooms of this instance", "error", rerr)
+	}
+	return err
+}
+
+func (s *Server) waitForGames(ctx context.Context) bool {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		s.Mutex.RLock()
+		running := len(s.Games)
+		s.Mutex.RUnlock()
+		if running == 0 {
+			return true
+		}
+
+		select {
+		case <-ctx.Done():
+			return false
+		case <-ticker.C:
+		}
+	}
+}
+
 func (s *Server) authHandler(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		payload, err := s.Token.CheckTokenRequest(w, r)
 		if err != nil {
-			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if err := s.checkSession(payload); err != nil {
+			writeErrorf(w, http.StatusUnauthorized, CodeUnauthorized, "%s", err)
 			return
 		}
 
 		ctx := context.WithValue(r.Context(), "id", payload.ID)
+		ctx = context.WithValue(ctx, "session", payload.Session)
+		ctx = setRequestUser(ctx, payload.ID)
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
 
 func (s *Server) handleMain(w http.ResponseWriter, r *http.Request) {
-	//log.Printf("Main, lol :D\n")
+	//slog.Info("Main, lol :D")
 }
 
 func (s *Server) handleUserLogin(w http.ResponseWriter, r *http.Request) {
+	logger := logging.FromContext(r.Context())
+	ip := s.clientIP(r)
+	if ok, wait := s.LoginLimit.Allow(ip); !ok {
+		loginFailures.Inc("rate_limited")
+		writeTooManyRequests(w, wait, "Too many login attempts.")
+		return
+	}
+
 	user, err := containers.ParseLoginUser(r.Body)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("Bad user json."))
+		writeErrorf(w, http.StatusBadRequest, CodeBadJSON, "Bad user json.")
+		return
+	}
+	normalizeUser(user)
+
+	// Failures are counted for the address and for the account, whether it
+	// exists or not, so that neither guessing the password of one account
+	// nor trying one password on many accounts gets far.
+	ipKey := "ip:" + ip
+	accountKey := "email:" + user.Email
+	wait := max(s.Lockouts.Locked(ipKey), s.Lockouts.Locked(accountKey))
+	if wait > 0 {
+		loginFailures.Inc("locked_out")
+		writeTooManyRequests(w, wait, "Too many failed logins.")
 		return
 	}
-	dbUser, derr := database.GetUserByEmail(s.DB, user.Email)
+	fail := func(reason string) {
+		loginFailures.Inc(reason)
+		if lockout := max(s.Lockouts.Fail(ipKey), s.Lockouts.Fail(accountKey)); lockout > 0 {
+			logger.Warn("Locked out after failed logins", "ip", ip, "lockout", lockout)
+		}
+		writeErrorf(w, http.StatusUnauthorized, CodeWrongCredentials, "Wrong email or password.")
+	}
+
+	dbUser, derr := s.Store.GetUserByEmail(user.Email)
 	if derr != nil {
-		w.WriteHeader(http.StatusUnauthorized)
-		w.Write([]byte("Wrong email or password."))
+		fail("unknown_email")
 		return
 	}
 	if err := bcrypt.CompareHashAndPassword(dbUser.Password, []byte(user.Password)); err != nil {
-		log.Printf("%s\n", err.Error())
-		w.WriteHeader(http.StatusUnauthorized)
-		w.Write([]byte("Wrong email or password."))
+		logger.Info("Wrong password", "user_id", dbUser.ID)
+		fail("wrong_password")
+		return
+	}
+	s.Lockouts.Reset(accountKey)
+	switch dbUser.Status {
+	case schema.StatusDisabled:
+		loginFailures.Inc("disabled")
+		writeErrorf(w, http.StatusForbidden, CodeAccountDisabled, "The account is disabled.")
+		return
+	case schema.StatusBanned:
+		loginFailures.Inc("banned")
+		writeErrorf(w, http.StatusForbidden, CodeAccountBanned, "The account is banned.")
 		return
 	}
 
-	token, err := s.Token.CreateToken(dbUser.ID, 15)
+	token, refreshToken, err := s.startSession(dbUser.ID)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte("Could not create authentication token."))
+		logger.Error("Could not start session", "user_id", dbUser.ID, "error", err)
+		writeErrorf(w, http.StatusInternalServerError, CodeInternal, "Could not create authentication token.")
 		return
 	}
 
 	resp := map[string]interface{}{
 		"sessionToken": token,
+		"refreshToken": refreshToken,
 		"user":         dbUser,
 	}
 
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(resp)
+	writeJSON(w, http.StatusOK, resp)
 }
 
 func (s *Server) handleUserRegister(w http.ResponseWriter, r *http.Request) {
+	if ok, wait := s.RegisterLimit.Allow(s.clientIP(r)); !ok {
+		writeTooManyRequests(w, wait, "Too many new accounts from this address.")
+		return
+	}
+
 	user, err := containers.ParseLoginUser(r.Body)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("Bad user json."))
+		writeErrorf(w, http.StatusBadRequest, CodeBadJSON, "Bad user json.")
+		return
+	}
+	normalizeUser(user)
+	problems := append(checkEmail(user.Email), checkUsername(user.Username)...)
+	problems = append(problems, s.checkPassword(user.Password)...)
+	if len(problems) > 0 {
+		writeError(w, http.StatusBadRequest, containers.Error{Code: CodeInvalidRequest, Message: "Invalid user.", Fields: problems})
 		return
 	}
 
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(user.Password), bcrypt.DefaultCost)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte("Could not encode password"))
+		writeErrorf(w, http.StatusInternalServerError, CodeInternal, "Could not encode password")
 		return
 	}
 
@@ -177,103 +447,93 @@ func (s *Server) handleUserRegister(w http.ResponseWriter, r *http.Request) {
 		Email:    user.Email,
 		Password: hashedPassword,
 		Username: user.Username,
+		Role:     schema.RoleUser,
+		Status:   schema.StatusActive,
 	}
 
-	id, derr := database.AddUser(s.DB, schemaUser)
+	id, derr := s.Store.AddUser(schemaUser)
 	if derr != nil {
 		if derr.ErrorType == database.ConflictError {
-			w.WriteHeader(http.StatusConflict)
-			w.Write([]byte(derr.Error()))
+			writeError(w, http.StatusConflict, containers.Error{Code: CodeConflict, Message: "The user already exists.", Fields: conflictFields(derr)})
 			return
 		}
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(derr.Error()))
+		writeErrorf(w, http.StatusInternalServerError, CodeInternal, "%s", derr)
 		return
 	}
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(fmt.Sprintf("%d", id)))
+	writeJSON(w, http.StatusOK, map[string]interface{}{"ID": id})
 }
 
 func (s *Server) handleUserShow(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id, ok := vars["id"]
 	if !ok {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("Bad id."))
+		writeErrorf(w, http.StatusBadRequest, CodeInvalidRequest, "Bad id.")
 		return
 	}
 	idU, err := strconv.ParseUint(id, 10, 64)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("ID is not uint."))
+		writeErrorf(w, http.StatusBadRequest, CodeInvalidRequest, "ID is not uint.")
 		return
 	}
-	user, derr := database.GetUserByID(s.DB, uint(idU))
+	user, derr := s.Store.GetUserByID(uint(idU))
 	if derr != nil {
-		w.WriteHeader(http.StatusNotFound)
-		w.Write([]byte(fmt.Sprintf("No user with id: %d.", idU)))
+		writeErrorf(w, http.StatusNotFound, CodeNotFound, "No user with id: %d.", idU)
 		return
 	}
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(user)
+	writeJSON(w, http.StatusOK, user)
 }
 
 func (s *Server) handleStat(w http.ResponseWriter, r *http.Request) {
 	id, ok := r.Context().Value("id").(uint)
 	if !ok {
-		w.WriteHeader(http.StatusInternalServerError)
+		writeErrorf(w, http.StatusInternalServerError, CodeInternal, "Missing user in request context.")
 		return
 	}
 
-	stat, derr := database.GetUserStatistics(s.DB, id)
+	stat, derr := s.Store.GetUserStatistics(id)
 	if derr != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+		writeErrorf(w, http.StatusInternalServerError, CodeInternal, "Could not fetch statistics.")
 		return
 	}
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(stat)
+	writeJSON(w, http.StatusOK, stat)
 }
 
 func (s *Server) handleRecommend(w http.ResponseWriter, r *http.Request) {
 	id, ok := r.Context().Value("id").(uint)
 	if !ok {
-		w.WriteHeader(http.StatusInternalServerError)
+		writeErrorf(w, http.StatusInternalServerError, CodeInternal, "Missing user in request context.")
 		return
 	}
 
 	nStr := r.URL.Query().Get("n")
 	if nStr == "" {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("Missing required query param \"n\"."))
+		writeErrorf(w, http.StatusBadRequest, CodeInvalidRequest, "Missing required query param \"n\".")
 		return
 	}
 	n, err := strconv.Atoi(nStr)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("Could not parse query param \"n\" as integer."))
+		writeErrorf(w, http.StatusBadRequest, CodeInvalidRequest, "Could not parse query param \"n\" as integer.")
 		return
 	}
 
-	result, derr := database.RecommendWord(s.DB, n, id)
+	result, derr := s.Store.RecommendWord(n, id, uint64(game.NewSeed()))
 	if derr != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+		writeErrorf(w, http.StatusInternalServerError, CodeInternal, "Could not recommend words.")
 		return
 	}
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(result)
+	writeJSON(w, http.StatusOK, result)
 }
 
 func (s *Server) handleUserGet(w http.ResponseWriter, r *http.Request) {
 	id, ok := r.Context().Value("id").(uint)
 	if !ok {
-		w.WriteHeader(http.StatusInternalServerError)
+		writeErrorf(w, http.StatusInternalServerError, CodeInternal, "Missing user in request context.")
 		return
 	}
 
-	dbUser, derr := database.GetUserByID(s.DB, id)
+	dbUser, derr := s.Store.GetUserByID(id)
 	if derr != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte("Could not fetch from database."))
+		writeErrorf(w, http.StatusInternalServerError, CodeInternal, "Could not fetch from database.")
 		return
 	}
 
@@ -282,270 +542,541 @@ func (s *Server) handleUserGet(w http.ResponseWriter, r *http.Request) {
 		"user":         dbUser,
 	}
 
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(resp)
+	writeJSON(w, http.StatusOK, resp)
 }
 
 func (s *Server) handleGameShow(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id, ok := vars["id"]
 	if !ok {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("Bad id."))
+		writeErrorf(w, http.StatusBadRequest, CodeInvalidRequest, "Bad id.")
 		return
 	}
 
 	idU, err := strconv.ParseUint(id, 10, 64)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("ID is not uint."))
+		writeErrorf(w, http.StatusBadRequest, CodeInvalidRequest, "ID is not uint.")
 		return
 	}
 
 	s.Mutex.RLock()
-	defer s.Mutex.RUnlock()
-	if _, ok := s.Games[uint(idU)]; !ok {
-		w.WriteHeader(http.StatusBadRequest)
+	currentGame, ok := s.Games[uint(idU)]
+	s.Mutex.RUnlock()
+	if !ok {
+		writeErrorf(w, http.StatusBadRequest, CodeNotFound, "No game with id: %d.", idU)
 		return
 	}
 
+	writeJSON(w, http.StatusOK, currentGame.State.Info())
+}
+
+func (s *Server) handleLiveGameLog(w http.ResponseWriter, r *http.Request) {
+	gameID, err := utils.ParseUint(mux.Vars(r), "id")
+	if err != nil {
+		writeErrorf(w, http.StatusBadRequest, CodeInvalidRequest, "ID is not uint.")
+		return
+	}
+
+	s.Mutex.RLock()
+	currentGame, ok := s.Games[gameID]
+	s.Mutex.RUnlock()
+	if !ok {
+		writeErrorf(w, http.StatusNotFound, CodeNotFound, "No game with id: %d.", gameID)
+		return
+	}
+
+	s.writeGameLog(w, r, currentGame.State.Key)
+}
+
+func (s *Server) handleGameLog(w http.ResponseWriter, r *http.Request) {
+	s.writeGameLog(w, r, mux.Vars(r)["key"])
+}
+
+func (s *Server) writeGameLog(w http.ResponseWriter, r *http.Request, key string) {
+	entries, _, ok := s.loadGameLog(w, r, key)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"game-%s.jsonl\"", key))
 	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(s.Games[uint(idU)])
+	encoder := json.NewEncoder(w)
+	for _, entry := range entries {
+		if err := encoder.Encode(entry); err != nil {
+			logging.FromContext(r.Context()).Warn("Could not write game log", "key", key, "error", err)
+			return
+		}
+	}
+}
+
+func (s *Server) handleGameReplay(w http.ResponseWriter, r *http.Request) {
+	_, replayed, ok := s.loadGameLog(w, r, mux.Vars(r)["key"])
+	if !ok {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, replayed.Snapshot())
+}
+
+func (s *Server) loadGameLog(
+	w http.ResponseWriter,
+	r *http.Request,
+	key string,
+) ([]game.LogEntry, *game.Game, bool) {
+	id, ok := r.Context().Value("id").(uint)
+	if !ok {
+		writeErrorf(w, http.StatusInternalServerError, CodeInternal, "Missing user in request context.")
+		return nil, nil, false
+	}
+
+	entries, derr := s.Store.GetGameEvents(key)
+	if derr != nil {
+		writeErrorf(w, http.StatusInternalServerError, CodeInternal, "Could not fetch from database.")
+		return nil, nil, false
+	}
+	if len(entries) == 0 {
+		writeErrorf(w, http.StatusNotFound, CodeNotFound, "No log for game: %s.", key)
+		return nil, nil, false
+	}
+
+	replayed, err := game.Replay(entries)
+	if err != nil {
+		writeErrorf(w, http.StatusInternalServerError, CodeInternal, "Could not replay game: %s.", err)
+		return nil, nil, false
+	}
+	if _, ok := replayed.Players.IDs[id]; !ok {
+		writeErrorf(w, http.StatusForbidden, CodeForbidden, "Only players can see the log of a game.")
+		return nil, nil, false
+	}
+	return entries, replayed, true
 }
 
 func (s *Server) handleUserChange(w http.ResponseWriter, r *http.Request) {
 	id, ok := r.Context().Value("id").(uint)
 	if !ok {
-		w.WriteHeader(http.StatusInternalServerError)
+		writeErrorf(w, http.StatusInternalServerError, CodeInternal, "Missing user in request context.")
 		return
 	}
 
 	user, err := containers.ParseLoginUser(r.Body)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("Bad user json."))
+		writeErrorf(w, http.StatusBadRequest, CodeBadJSON, "Bad user json.")
+		return
+	}
+	normalizeUser(user)
+	// An empty password keeps the old one, any other is checked and stored
+	// as it is, the same as on registration.
+	problems := checkUsername(user.Username)
+	if user.Password != "" {
+		problems = append(problems, s.checkPassword(user.Password)...)
+	}
+	if len(problems) > 0 {
+		writeError(w, http.StatusBadRequest, containers.Error{Code: CodeInvalidRequest, Message: "Invalid user.", Fields: problems})
 		return
 	}
 
-	strippedPassword := strings.TrimSpace(user.Password)
-	if strippedPassword != "" {
-		newPassowrd, err := bcrypt.GenerateFromPassword([]byte(strippedPassword), bcrypt.DefaultCost)
+	var derr *database.DatabaseError
+	if user.Password != "" {
+		newPassowrd, err := bcrypt.GenerateFromPassword([]byte(user.Password), bcrypt.DefaultCost)
 		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte("Could not encrypt password."))
-			return
-		}
-		derr := database.UpdateUser(s.DB, id, newPassowrd, user.Username)
-		if derr != nil {
-			w.WriteHeader(http.StatusInternalServerError)
+			writeErrorf(w, http.StatusInternalServerError, CodeInternal, "Could not encrypt password.")
 			return
 		}
+		derr = s.Store.UpdateUser(id, newPassowrd, user.Username)
 	} else {
-		derr := database.UpdateUserUsername(s.DB, id, user.Username)
-		if derr != nil {
-			w.WriteHeader(http.StatusInternalServerError)
+		derr = s.Store.UpdateUserUsername(id, user.Username)
+	}
+	if derr != nil {
+		if derr.ErrorType == database.ConflictError {
+			writeError(w, http.StatusConflict, containers.Error{Code: CodeConflict, Message: "Could not update user.", Fields: conflictFields(derr)})
 			return
 		}
+		writeErrorf(w, http.StatusInternalServerError, CodeInternal, "Could not update user.")
+		return
 	}
 	w.WriteHeader(http.StatusOK)
 }
 
-func (s *Server) handleEvent(event game.Event) error {
-	game, ok := s.Games[event.GameID]
-	if !ok {
-		return fmt.Errorf("failed to handle event: game id %d not found", event.GameID)
+func (s *Server) handleEvent(serverGame *Game, event game.Event) error {
+	message := &Message{Version: ProtocolVersion, Type: event.Type, Msg: event.Msg}
+	if event.Type == game.EventError {
+		message.Code = ErrorRejected
+	}
+	msg, err := json.Marshal(message)
+	if err != nil {
+		return fmt.Errorf("failed to marshal event payload into JSON: %s", err)
 	}
+	serverGame.Log.Debug("Event", "type", event.Type, "receivers", len(event.Receivers))
 	for receiver := range event.Receivers {
-		ws, ok := game.Players[receiver]
+		client, ok := serverGame.Client(receiver)
 		if !ok {
-			log.Printf("failed to send event to receiver: receiver id %d not found", receiver)
-		}
-		msg, err := json.Marshal(&Message{Type: event.Type, Msg: event.Msg})
-		if err != nil {
-			return fmt.Errorf("failed to marshal event payload into JSON: %s", err)
+			serverGame.Log.Debug("Event receiver is not connected", "type", event.Type, "user_id", receiver)
+			continue
 		}
-		if err := ws.WriteMessage(websocket.TextMessage, msg); err != nil {
-			log.Printf("failed to send event to receiver: %s", err)
+		if err := client.Send(msg); err != nil {
+			client.Log.Warn("Could not send event", "type", event.Type, "error", err)
 		}
 	}
 	return nil
 }
 
 func (s *Server) handleHost(w http.ResponseWriter, r *http.Request) {
+	logger := logging.FromContext(r.Context())
 	vars := mux.Vars(r)
-	numPlayers, err := utils.ParseInt(vars, "players")
-	if err != nil {
-		log.Printf("[handleHost] Could not parse \"player\" var: %s", err.Error())
-		return
+	settings := containers.Host{}
+	problems := make([]containers.FieldError, 0)
+	for _, v := range []struct {
+		name  string
+		field string
+		value *int
+	}{
+		{"players", "Players", &settings.Players},
+		{"numWords", "Words", &settings.Words},
+		{"timer", "Timer", &settings.Timer},
+	} {
+		value, err := utils.ParseInt(vars, v.name)
+		if err != nil {
+			problems = append(problems, containers.FieldError{Field: v.field, Message: err.Error()})
+			continue
+		}
+		*v.value = value
 	}
-	numWords, err := utils.ParseInt(vars, "numWords")
-	if err != nil {
-		log.Printf("[handleHost] Could not parse \"numWords\" var: %s", err.Error())
+	if len(problems) == 0 {
+		problems = s.checkGameSettings(settings)
+	}
+	if len(problems) > 0 {
+		logger.Info("Bad game settings", "problems", problems)
+		writeError(w, http.StatusBadRequest, containers.Error{Code: CodeInvalidSettings, Message: "Invalid game settings.", Fields: problems})
 		return
 	}
-	timer, err := utils.ParseInt(vars, "timer")
-	if err != nil {
-		log.Printf("[handleHost] Could not parse \"timer\" var: %s", err.Error())
+	if e, ok := s.checkCapacity(); !ok {
+		logger.Warn(e.Message)
+		writeError(w, http.StatusServiceUnavailable, e)
 		return
 	}
-	payload, err := s.Token.CheckTokenVars(vars)
-	if err != nil {
-		log.Printf("[handleHost] Could not validate token: %s", err.Error())
+
+	ctx, payload, ws, ok := s.upgrade(w, r, "handleHost")
+	if !ok {
 		return
 	}
-	user, derr := database.GetUserByID(s.DB, payload.ID)
+	logger = logging.FromContext(ctx)
+	user, derr := s.Store.GetUserByID(payload.ID)
 	if derr != nil {
-		log.Printf("[handleHost] Could not get user info for user: %d\n", payload.ID)
+		logger.Error("Could not get user", "error", derr)
+		refuse(ws, ErrorInternal, "Could not fetch user.")
+		return
+	}
+	gameID, err := s.Registry.NextID()
+	if err != nil {
+		logger.Error("Could not get a game id", "error", err)
+		refuse(ws, ErrorInternal, "Could not create game.")
 		return
 	}
-
-	s.Mutex.Lock()
-	gameID := s.getGameID()
-	s.Mutex.Unlock()
-
 	currentGame := game.NewGame(
+		s.ctx,
 		gameID,
 		containers.User{ID: user.ID, Email: user.Email, Username: user.Username},
-		numPlayers,
-		numWords,
-		timer)
-
-	ws, err := s.Upgrader.Upgrade(w, r, nil)
+		settings.Players,
+		settings.Words,
+		settings.Timer,
+		game.NewSeed())
+	serverGame, err := s.startGame(currentGame, "")
 	if err != nil {
-		log.Printf("[handleHost] Could not upgrade to ws")
+		logger.Error("Could not start game", "game_id", gameID, "error", err)
+		refuse(ws, ErrorInternal, "Could not create game.")
 		return
 	}
 
-	players := make(map[uint]*websocket.Conn)
-	players[payload.ID] = ws
+	client := NewClient(payload.ID, newWSConn(ws), logger.With("game_id", gameID))
+	serverGame.Add(client)
+	currentGame.NotifyJoined(payload.ID)
+	s.listen(serverGame, client)
+}
+
+// startGame claims the room of the game and starts it. An empty code means a
+// new one is picked. The id is only reserved under s.Mutex, the registry and
+// the bus are called without holding it.
+func (s *Server) startGame(currentGame *game.Game, code string) (*Game, error) {
+	id := currentGame.ID
+	s.Mutex.Lock()
+	_, running := s.Games[id]
+	_, starting := s.starting[id]
+	if running || starting {
+		s.Mutex.Unlock()
+		return nil, fmt.Errorf("game %d is already running", id)
+	}
+	s.starting[id] = struct{}{}
+	s.Mutex.Unlock()
+
+	serverGame := &Game{
+		Players: make(map[uint]*Client),
+		State:   currentGame,
+		Mutex:   &sync.RWMutex{},
+		Log:     slog.With("game_id", id),
+		Started: time.Now(),
+		active:  time.Now(),
+	}
+	sub, err := s.claimAndSubscribe(serverGame, code)
 
 	s.Mutex.Lock()
-	s.Games[gameID] = &Game{Players: players, State: currentGame}
+	delete(s.starting, id)
+	if err == nil {
+		s.Games[id] = serverGame
+	}
 	s.Mutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	go s.serveRelays(serverGame, sub)
+
+	currentGame.Persist = func(snapshot game.Snapshot) {
+		if derr := s.Store.SaveSnapshot(snapshot); derr != nil {
+			serverGame.Log.Error("Could not save snapshot", "error", derr)
+		}
+	}
+	eventLog := NewEventLog(s.Store)
+	currentGame.Record = eventLog.Record
+	go currentGame.Run()
 
 	go func() {
 		for event := range currentGame.Events {
-			if err := s.handleEvent(event); err != nil {
-				log.Printf("[handleEvent] %s", err)
+			if err := s.handleEvent(serverGame, event); err != nil {
+				serverGame.Log.Error("Could not handle event", "error", err)
 			}
 		}
-		for _, ws := range s.Games[gameID].Players {
-			ws.Close()
+		serverGame.Mutex.RLock()
+		for _, client := range serverGame.Players {
+			client.CloseAfterFlush()
 		}
+		serverGame.Mutex.RUnlock()
+
+		eventLog.Close()
+		s.finishGame(serverGame)
 	}()
+	return serverGame, nil
+}
 
-	msg, err := json.Marshal(&Message{Type: game.EventGameInfo, Msg: currentGame})
+// claimAndSubscribe claims the room of the game and subscribes to its topic,
+// releasing the room again if the subscription fails.
+func (s *Server) claimAndSubscribe(serverGame *Game, code string) (*cluster.Subscription, error) {
+	if err := s.claimRoom(serverGame, code); err != nil {
+		return nil, err
+	}
+	sub, err := s.Bus.Subscribe(roomTopic(serverGame.State.ID))
 	if err != nil {
-		log.Printf("failed to marshal event payload into JSON: %s", err)
+		if rerr := s.Registry.Release(serverGame.State.ID, s.Instance); rerr != nil {
+			serverGame.Log.Error("Could not release room", "error", rerr)
+		}
+		return nil, err
+	}
+	return sub, nil
+}
+
+func (s *Server) finishGame(serverGame *Game) {
+	currentGame := serverGame.State
+	if currentGame.Process.Finished {
+		gamesCompleted.Inc("finished")
+		if derr := s.Store.AddGame(currentGame); derr != nil {
+			serverGame.Log.Error("Could not save game", "error", derr)
+		} else if derr := s.Store.DeleteSnapshot(currentGame.ID); derr != nil {
+			serverGame.Log.Error("Could not delete snapshot", "error", derr)
+		}
+	} else if currentGame.Process.Aborted {
+		gamesCompleted.Inc("aborted")
+		if derr := s.Store.DeleteSnapshot(currentGame.ID); derr != nil {
+			serverGame.Log.Error("Could not delete snapshot", "error", derr)
+		}
 	}
-	if err := ws.WriteMessage(websocket.TextMessage, msg); err != nil {
-		log.Printf("failed to send event to receiver: %s", err)
+
+	// A game stopped by a shutdown keeps its room, so that another instance
+	// can take it over.
+	if s.ctx.Err() == nil {
+		if err := s.Registry.Release(currentGame.ID, s.Instance); err != nil {
+			serverGame.Log.Error("Could not release room", "error", err)
+		}
 	}
 
-	s.listen(ws, currentGame, payload.ID)
 	s.Mutex.Lock()
-	defer s.Mutex.Unlock()
+	delete(s.Games, currentGame.ID)
+	s.Mutex.Unlock()
+}
 
-	derr = database.AddGame(s.DB, currentGame)
+func (s *Server) Restore() error {
+	snapshots, derr := s.Store.GetSnapshots()
 	if derr != nil {
-		log.Printf("Error when inserting game to database: %s", err.Error())
+		return derr
+	}
+
+	for _, snapshot := range snapshots {
+		var code string
+		room, err := s.Registry.Lookup(snapshot.ID)
+		if err == nil {
+			if room.Owner != s.Instance && !room.Expired(time.Now()) {
+				slog.Info("Game is running on another instance, not restoring it", "game_id", snapshot.ID, "instance", room.Owner)
+				continue
+			}
+			code = room.Code
+		} else if !errors.Is(err, cluster.ErrNoRoom) {
+			return err
+		}
+
+		if err := s.restoreSnapshot(snapshot, code); err != nil {
+			if errors.Is(err, cluster.ErrRoomTaken) {
+				slog.Info("Game was taken over by another instance", "game_id", snapshot.ID)
+				continue
+			}
+			return err
+		}
 	}
-	delete(s.Games, gameID)
+	return nil
+}
+
+func (s *Server) restoreSnapshot(snapshot game.Snapshot, code string) error {
+	restored := game.Restore(s.ctx, snapshot)
+	seq, derr := s.Store.GetLastGameEventSeq(snapshot.Key)
+	if derr != nil {
+		return derr
+	}
+	if seq > restored.Seq {
+		restored.Seq = seq
+	}
+	if snapshot.Finished {
+		restored.GetResults()
+		s.finishGame(&Game{State: restored})
+		return nil
+	}
+	if snapshot.Aborted {
+		s.finishGame(&Game{State: restored})
+		return nil
+	}
+	if _, err := s.startGame(restored, code); err != nil {
+		return err
+	}
+	time.AfterFunc(abandonTimeout, restored.AbandonIfEmpty)
+	slog.Info("Restored game", "game_id", snapshot.ID, "phase", snapshot.Phase)
+	return nil
 }
 
 func (s *Server) handleJoin(w http.ResponseWriter, r *http.Request) {
+	logger := logging.FromContext(r.Context())
 	vars := mux.Vars(r)
 
 	gameID, err := utils.ParseUint(vars, "id")
 	if err != nil {
-		log.Printf("[handleJoin] Could not parse \"gameID\" var: %s", err.Error())
+		logger.Info("Could not parse game id", "error", err)
+		writeError(w, http.StatusBadRequest, containers.Error{Code: CodeInvalidRequest, Message: err.Error()})
 		return
 	}
 
-	payload, err := s.Token.CheckTokenVars(vars)
-	if err != nil {
-		log.Printf("[handleJoin] Could not validate token: %s", err.Error())
-		return
-	}
-
-	user, derr := database.GetUserByID(s.DB, payload.ID)
-	if derr != nil {
-		log.Printf("[handleJoin] Could not get user info for user: %d\n", payload.ID)
-		return
-	}
-
-	s.Mutex.RLock()
-	currentGame, ok := s.Games[uint(gameID)]
-	s.Mutex.RUnlock()
+	currentGame, room, ok := s.locate(uint(gameID))
 	if !ok {
-		log.Printf("[handleJoin] No game with id: %d\n", gameID)
+		logger.Info("No such game", "game_id", gameID)
+		writeError(w, http.StatusNotFound, containers.Error{Code: CodeNotFound, Message: fmt.Sprintf("No game with id %d.", gameID)})
 		return
 	}
 
-	if ok := currentGame.State.AddPlayer(
-		containers.User{ID: user.ID, Email: user.Email, Username: user.Username}); !ok {
+	ctx, payload, ws, ok := s.upgrade(w, r, "handleJoin")
+	if !ok {
 		return
 	}
-
-	ws, err := s.Upgrader.Upgrade(w, r, nil)
-	if err != nil {
-		log.Printf("[handleJoin] Could not upgrade to ws: %s", err.Error())
+	logger = logging.FromContext(ctx)
+	user, derr := s.Store.GetUserByID(payload.ID)
+	if derr != nil {
+		logger.Error("Could not get user", "error", derr)
+		refuse(ws, ErrorInternal, "Could not fetch user.")
 		return
 	}
 
-	currentGame.Players[user.ID] = ws
-	msg, err := json.Marshal(
-		&Message{Type: game.EventGameInfo, Msg: currentGame.State})
-	if err != nil {
-		log.Printf("failed to marshal event payload into JSON: %s", err)
-	}
-	for _, ws := range currentGame.Players {
-		if err := ws.WriteMessage(websocket.TextMessage, msg); err != nil {
-			log.Printf("failed to send event to receiver: %s", err)
-		}
-	}
-	if currentGame.State.NumPlayers == len(currentGame.Players) {
-		msg, err := json.Marshal(
-			&Message{Type: game.EventReadyToStart})
-		if err != nil {
-			log.Printf("failed to marshal event payload into JSON: %s", err)
-		}
+	logger = logger.With("game_id", gameID)
+	s.enter(currentGame, room, NewClient(user.ID, newWSConn(ws), logger), user)
+}
 
-		ws, ok := currentGame.Players[currentGame.State.Host]
-		if !ok {
-			log.Printf("failed to obtain host ws: %s", err)
-		}
-		if err := ws.WriteMessage(websocket.TextMessage, msg); err != nil {
-			log.Printf("failed to send event to receiver: %s", err)
+func (s *Server) join(serverGame *Game, client *Client, user *schema.User) {
+	if err := serverGame.State.AddPlayer(
+		containers.User{ID: user.ID, Email: user.Email, Username: user.Username}); err != nil {
+		client.Log.Info("Could not join", "error", err)
+		if err := client.SendMessage(&Message{Type: game.EventError, Msg: err.Error(), Code: ErrorRejected}); err != nil {
+			client.Log.Warn("Could not send event", "error", err)
 		}
+		client.CloseAfterFlush()
+		return
 	}
 
-	s.listen(ws, currentGame.State, payload.ID)
+	serverGame.Add(client)
+	serverGame.State.NotifyJoined(user.ID)
+	s.listen(serverGame, client)
 }
 
-func (s *Server) listen(ws *websocket.Conn, game *game.Game, id uint) {
-	msg := &Message{}
+func (s *Server) listen(serverGame *Game, client *Client) {
+	currentGame := serverGame.State
+
 	message := make(chan *Message, 1)
-	defer close(message)
+	disconnected := make(chan struct{})
+	done := make(chan struct{})
+	defer close(done)
 
-	go func(ws *websocket.Conn) {
+	go func() {
+		defer close(disconnected)
 		for {
-			err := ws.ReadJSON(&msg)
+			data, err := client.ReadMessage()
 			if err != nil {
+				client.Log.Info("Player went away", "error", err)
+				return
+			}
+			msg, perr := DecodeMessage(data)
+			if ok, wait := s.MessageLimit.Allow(strconv.FormatUint(uint64(client.ID), 10)); !ok {
+				limited := &ProtocolError{
+					Code:    ErrorRateLimited,
+					Message: fmt.Sprintf("Too many messages, try again in %d seconds.", retryAfter(wait)),
+				}
+				if msg != nil {
+					limited.ID = msg.ID
+				} else {
+					limited.ID = perr.ID
+				}
+				perr = limited
+			}
+			if perr != nil {
+				client.Log.Info("Bad message", "code", perr.Code, "error", perr.Message)
+				if err := client.SendMessage(perr.Reply()); err != nil {
+					client.Log.Warn("Could not send event", "error", err)
+				}
+				continue
+			}
+			select {
+			case message <- msg:
+			case <-done:
 				return
 			}
-			message <- msg
 		}
-	}(ws)
+	}()
 
 	for {
 		select {
-		case _, ok := <-game.Process.GameEnd:
-			if !ok {
-				return
+		case <-currentGame.Done():
+			return
+		case <-disconnected:
+			client.Close()
+			if serverGame.Remove(client) {
+				currentGame.DisconnectPlayer(client.ID)
 			}
+			return
 		case msg := <-message:
-			go HandleMessage(game, id, msg)
+			serverGame.Touch()
+			reply := &Message{ID: msg.ID, Type: game.EventAck}
+			start := time.Now()
+			perr := HandleMessage(currentGame, client.ID, msg)
+			messageDuration.Since(start, string(msg.Type))
+			if perr != nil {
+				client.Log.Info("Could not handle message", "type", msg.Type, "code", perr.Code, "error", perr.Message)
+				reply = perr.Reply()
+			} else if msg.ID == "" {
+				continue
+			}
+			if err := client.SendMessage(reply); err != nil {
+				client.Log.Warn("Could not send event", "error", err)
+			}
 		}
 	}
 }
@@ -554,20 +1085,27 @@ func HandleMessage(
 	g *game.Game,
 	id uint,
 	msg *Message,
-) {
-	switch msg.Type {
-	case game.EventAddWord:
-		word := fmt.Sprintf("%s", msg.Msg)
-		g.AddWord(id, word)
-	case game.EventReadyStoryteller:
-		g.MakeTurn(id)
-	case game.EventGuess:
-		word := fmt.Sprintf("%s", msg.Msg)
-		g.GuessWord(word)
-		g.GetNextWord()
-	case game.EventRequestToStart:
-		g.StartWordPhase()
+) *ProtocolError {
+	var err error
+	switch payload := msg.Msg.(type) {
+	case AddWordPayload:
+		err = g.AddWord(id, string(payload))
+	case GuessPayload:
+		err = g.GuessWord(id, string(payload))
 	default:
-		log.Printf("can't decode message: %s", msg)
+		switch msg.Type {
+		case game.EventReadyStoryteller:
+			err = g.MakeTurn(id)
+		case game.EventRequestToStart:
+			err = g.StartWordPhase(id)
+		case game.EventAbort:
+			err = g.Abort(id)
+		default:
+			return &ProtocolError{ID: msg.ID, Code: ErrorUnknownType, Message: fmt.Sprintf("%q can not be sent during a game", msg.Type)}
+		}
 	}
+	if err != nil {
+		return &ProtocolError{ID: msg.ID, Code: ErrorGameEnded, Message: err.Error()}
+	}
+	return nil
 }
@@ -0,0 +1,156 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/bitterfly/go-chaos/hatgame/logging"
+	"github.com/bitterfly/go-chaos/hatgame/schema"
+	"github.com/bitterfly/go-chaos/hatgame/server/containers"
+)
+
+const refreshTokenSize = 32
+
+var ErrRevokedToken = errors.New("session has been revoked")
+
+func newRefreshToken() (string, string, error) {
+	token := make([]byte, refreshTokenSize)
+	if _, err := rand.Read(token); err != nil {
+		return "", "", err
+	}
+	refreshToken := base64.RawURLEncoding.EncodeToString(token)
+	return refreshToken, hashRefreshToken(refreshToken), nil
+}
+
+func hashRefreshToken(refreshToken string) string {
+	sum := sha256.Sum256([]byte(refreshToken))
+	return hex.EncodeToString(sum[:])
+}
+
+func (s *Server) startSession(userID uint) (string, string, error) {
+	refreshToken, hash, err := newRefreshToken()
+	if err != nil {
+		return "", "", err
+	}
+	session := &schema.Session{
+		UserID:      userID,
+		RefreshHash: hash,
+		ExpiresAt:   time.Now().Add(s.Config.RefreshLifetime.Duration),
+	}
+	sessionID, derr := s.Store.AddSession(session)
+	if derr != nil {
+		return "", "", derr
+	}
+
+	token, err := s.Token.CreateToken(userID, sessionID)
+	if err != nil {
+		return "", "", err
+	}
+	return token, refreshToken, nil
+}
+
+func (s *Server) checkSession(payload *Payload) error {
+	session, derr := s.Store.GetSession(payload.Session)
+	if derr != nil {
+		return ErrRevokedToken
+	}
+	if session.UserID != payload.ID || session.RevokedAt != nil || time.Now().After(session.ExpiresAt) {
+		return ErrRevokedToken
+	}
+	return nil
+}
+
+func (s *Server) verifyVars(vars map[string]string) (*Payload, error) {
+	payload, err := s.Token.CheckTokenVars(vars)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.checkSession(payload); err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
+
+func (s *Server) handleRefresh(w http.ResponseWriter, r *http.Request) {
+	refresh, err := containers.ParseRefresh(r.Body)
+	if err != nil || refresh.RefreshToken == "" {
+		writeErrorf(w, http.StatusBadRequest, CodeBadJSON, "Bad refresh json.")
+		return
+	}
+
+	hash := hashRefreshToken(refresh.RefreshToken)
+	session, derr := s.Store.FindSessionByRefreshHash(hash)
+	if derr != nil {
+		writeErrorf(w, http.StatusUnauthorized, CodeUnauthorized, "Unknown refresh token.")
+		return
+	}
+	if session.PreviousHash == hash {
+		logger := logging.FromContext(r.Context()).With("user_id", session.UserID, "session_id", session.ID)
+		logger.Warn("Refresh token was used twice, revoking the session")
+		if derr := s.Store.RevokeSession(session.ID); derr != nil {
+			logger.Error("Could not revoke session", "error", derr)
+		}
+		writeErrorf(w, http.StatusUnauthorized, CodeRefreshReused, "Refresh token has already been used.")
+		return
+	}
+	if session.RevokedAt != nil || time.Now().After(session.ExpiresAt) {
+		writeErrorf(w, http.StatusUnauthorized, CodeSessionExpired, "Session has expired.")
+		return
+	}
+
+	refreshToken, newHash, err := newRefreshToken()
+	if err != nil {
+		writeErrorf(w, http.StatusInternalServerError, CodeInternal, "Could not create refresh token.")
+		return
+	}
+	expiresAt := time.Now().Add(s.Config.RefreshLifetime.Duration)
+	if derr := s.Store.RotateSession(session.ID, hash, newHash, expiresAt); derr != nil {
+		writeErrorf(w, http.StatusUnauthorized, CodeRefreshReused, "Refresh token has already been used.")
+		return
+	}
+
+	token, err := s.Token.CreateToken(session.UserID, session.ID)
+	if err != nil {
+		writeErrorf(w, http.StatusInternalServerError, CodeInternal, "Could not create authentication token.")
+		return
+	}
+
+	resp := map[string]interface{}{
+		"sessionToken": token,
+		"refreshToken": refreshToken,
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (s *Server) handleLogout(w http.ResponseWriter, r *http.Request) {
+	sessionID, ok := r.Context().Value("session").(uint)
+	if !ok {
+		writeErrorf(w, http.StatusInternalServerError, CodeInternal, "Missing session in request context.")
+		return
+	}
+	if derr := s.Store.RevokeSession(sessionID); derr != nil {
+		logging.FromContext(r.Context()).Error("Could not revoke session", "session_id", sessionID, "error", derr)
+		writeErrorf(w, http.StatusInternalServerError, CodeInternal, "Could not revoke session.")
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) handleLogoutAll(w http.ResponseWriter, r *http.Request) {
+	id, ok := r.Context().Value("id").(uint)
+	if !ok {
+		writeErrorf(w, http.StatusInternalServerError, CodeInternal, "Missing user in request context.")
+		return
+	}
+	if derr := s.Store.RevokeUserSessions(id); derr != nil {
+		logging.FromContext(r.Context()).Error("Could not revoke sessions", "error", derr)
+		writeErrorf(w, http.StatusInternalServerError, CodeInternal, "Could not revoke sessions.")
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,113 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bitterfly/go-chaos/hatgame/config"
+	"github.com/bitterfly/go-chaos/hatgame/database"
+)
+
+func newSessionServer(t *testing.T) *Server {
+	t.Helper()
+	return &Server{
+		Store:  database.NewMemory(),
+		Config: config.Default(),
+		Token:  NewToken(NewStaticKeySet("0123456789abcdef0123456789abcdef"), time.Minute),
+	}
+}
+
+// refresh posts the refresh token and returns the status, the error code and
+// the new refresh token.
+func refresh(t *testing.T, s *Server, refreshToken string) (int, string, string) {
+	t.Helper()
+	body := fmt.Sprintf(`{"RefreshToken": %q}`, refreshToken)
+	r := httptest.NewRequest("POST", "/api/token/refresh", strings.NewReader(body))
+	w := httptest.NewRecorder()
+	s.handleRefresh(w, r)
+
+	var resp struct {
+		Code         string
+		RefreshToken string `json:"refreshToken"`
+		SessionToken string `json:"sessionToken"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("could not decode the answer: %s", err)
+	}
+	if w.Code == http.StatusOK && (resp.RefreshToken == "" || resp.SessionToken == "") {
+		t.Fatalf("missing tokens in %+v", resp)
+	}
+	return w.Code, resp.Code, resp.RefreshToken
+}
+
+func TestRefreshRotates(t *testing.T) {
+	s := newSessionServer(t)
+	_, first, err := s.startSession(1)
+	if err != nil {
+		t.Fatalf("could not start session: %s", err)
+	}
+
+	status, _, second := refresh(t, s, first)
+	if status != http.StatusOK {
+		t.Fatalf("first refresh: %d", status)
+	}
+	if second == first {
+		t.Fatal("the refresh token was not rotated")
+	}
+	status, _, third := refresh(t, s, second)
+	if status != http.StatusOK {
+		t.Fatalf("refresh with the rotated token: %d", status)
+	}
+
+	session, derr := s.Store.FindSessionByRefreshHash(hashRefreshToken(third))
+	if derr != nil {
+		t.Fatalf("could not find the session: %s", derr)
+	}
+	if session.RevokedAt != nil {
+		t.Error("the session was revoked")
+	}
+	if err := s.checkSession(&Payload{ID: 1, Session: session.ID}); err != nil {
+		t.Errorf("the session does not work: %s", err)
+	}
+}
+
+func TestRefreshReuseRevokes(t *testing.T) {
+	s := newSessionServer(t)
+	_, first, err := s.startSession(1)
+	if err != nil {
+		t.Fatalf("could not start session: %s", err)
+	}
+	session, derr := s.Store.FindSessionByRefreshHash(hashRefreshToken(first))
+	if derr != nil {
+		t.Fatalf("could not find the session: %s", derr)
+	}
+
+	status, _, second := refresh(t, s, first)
+	if status != http.StatusOK {
+		t.Fatalf("first refresh: %d", status)
+	}
+	// Someone who stole the first token uses it after the owner did.
+	if status, code, _ := refresh(t, s, first); status != http.StatusUnauthorized || code != CodeRefreshReused {
+		t.Fatalf("reusing the old token: %d %s, want %d %s", status, code, http.StatusUnauthorized, CodeRefreshReused)
+	}
+
+	if err := s.checkSession(&Payload{ID: 1, Session: session.ID}); err != ErrRevokedToken {
+		t.Errorf("the session still works after the reuse: %v", err)
+	}
+	// The token the owner got is no good any more either.
+	if status, code, _ := refresh(t, s, second); status != http.StatusUnauthorized || code != CodeSessionExpired {
+		t.Errorf("refresh after the reuse: %d %s, want %d %s", status, code, http.StatusUnauthorized, CodeSessionExpired)
+	}
+}
+
+func TestRefreshUnknown(t *testing.T) {
+	s := newSessionServer(t)
+	if status, code, _ := refresh(t, s, "not-a-token"); status != http.StatusUnauthorized || code != CodeUnauthorized {
+		t.Errorf("unknown token: %d %s, want %d %s", status, code, http.StatusUnauthorized, CodeUnauthorized)
+	}
+}
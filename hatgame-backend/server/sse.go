@@ -0,0 +1,386 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/bitterfly/go-chaos/hatgame/cluster"
+	"github.com/bitterfly/go-chaos/hatgame/game"
+	"github.com/bitterfly/go-chaos/hatgame/logging"
+	"github.com/bitterfly/go-chaos/hatgame/server/containers"
+	"github.com/bitterfly/go-chaos/hatgame/utils"
+	"github.com/gorilla/mux"
+)
+
+const (
+	streamIDSize  = 16
+	sseInboxSize  = 16
+	maxSSECommand = 4096
+	// How long a forwarded command waits for the instance with the stream.
+	commandReplyWait = 2 * time.Second
+)
+
+var ErrConnClosed = errors.New("connection is closed")
+
+// A command can be posted to any instance. If the stream is open on another
+// one, the command goes over the bus to the stream's topic and the instance
+// with the stream answers on the Reply topic whether it took it.
+type streamCommand struct {
+	User  uint
+	Data  string
+	Reply string
+}
+
+type streamReply struct {
+	Delivered bool
+}
+
+func streamTopic(id string) string {
+	return "hatgame_stream_" + id
+}
+
+func replyTopic(id string) string {
+	return "hatgame_reply_" + id
+}
+
+type sseConn struct {
+	ID      string
+	UserID  uint
+	w       io.Writer
+	flusher http.Flusher
+	inbox   chan []byte
+	closed  chan struct{}
+	ctx     context.Context
+	mutex   *sync.Mutex
+	once    *sync.Once
+}
+
+func newSSEConn(id string, userID uint, w http.ResponseWriter, flusher http.Flusher, ctx context.Context) *sseConn {
+	return &sseConn{
+		ID:      id,
+		UserID:  userID,
+		w:       w,
+		flusher: flusher,
+		inbox:   make(chan []byte, sseInboxSize),
+		closed:  make(chan struct{}),
+		ctx:     ctx,
+		mutex:   &sync.Mutex{},
+		once:    &sync.Once{},
+	}
+}
+
+func (c *sseConn) write(format string, args ...interface{}) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	select {
+	case <-c.closed:
+		return ErrConnClosed
+	default:
+	}
+	if _, err := fmt.Fprintf(c.w, format, args...); err != nil {
+		return err
+	}
+	c.flusher.Flush()
+	return nil
+}
+
+func (c *sseConn) ReadMessage() ([]byte, error) {
+	select {
+	case msg := <-c.inbox:
+		return msg, nil
+	case <-c.closed:
+		return nil, ErrConnClosed
+	case <-c.ctx.Done():
+		return nil, c.ctx.Err()
+	}
+}
+
+func (c *sseConn) WriteMessage(msg []byte) error {
+	return c.write("data: %s\n\n", msg)
+}
+
+func (c *sseConn) Ping() error {
+	return c.write(": ping\n\n")
+}
+
+func (c *sseConn) CloseGracefully() error {
+	return c.write("event: close\ndata: {}\n\n")
+}
+
+func (c *sseConn) Close() error {
+	c.once.Do(func() {
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+		close(c.closed)
+	})
+	return nil
+}
+
+func (c *sseConn) Deliver(ctx context.Context, msg []byte) error {
+	select {
+	case c.inbox <- msg:
+		return nil
+	case <-c.closed:
+		return ErrConnClosed
+	case <-c.ctx.Done():
+		return ErrConnClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+type Streams struct {
+	streams map[string]*sseConn
+	mutex   *sync.Mutex
+}
+
+func NewStreams() *Streams {
+	return &Streams{
+		streams: make(map[string]*sseConn),
+		mutex:   &sync.Mutex{},
+	}
+}
+
+func (s *Streams) Open(userID uint, w http.ResponseWriter, flusher http.Flusher, ctx context.Context) (*sseConn, error) {
+	value := make([]byte, streamIDSize)
+	if _, err := rand.Read(value); err != nil {
+		return nil, err
+	}
+	conn := newSSEConn(base64.RawURLEncoding.EncodeToString(value), userID, w, flusher, ctx)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.streams[conn.ID] = conn
+	return conn, nil
+}
+
+func (s *Streams) Get(id string) (*sseConn, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	conn, ok := s.streams[id]
+	return conn, ok
+}
+
+func (s *Streams) Remove(conn *sseConn) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.streams, conn.ID)
+}
+
+func (s *Server) authenticateStream(r *http.Request) (*Payload, error) {
+	if key := r.URL.Query().Get("ticket"); key != "" {
+		return s.redeemTicket(key)
+	}
+	payload, err := s.Token.VerifyToken(ExtractToken(r))
+	if err != nil {
+		return nil, err
+	}
+	if err := s.checkSession(payload); err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
+
+func (s *Server) handleSSEJoin(w http.ResponseWriter, r *http.Request) {
+	logger := logging.FromContext(r.Context())
+	vars := mux.Vars(r)
+
+	gameID, err := utils.ParseUint(vars, "id")
+	if err != nil {
+		logger.Info("Could not parse game id", "error", err)
+		writeError(w, http.StatusBadRequest, containers.Error{Code: CodeInvalidRequest, Message: err.Error()})
+		return
+	}
+
+	currentGame, room, ok := s.locate(uint(gameID))
+	if !ok {
+		logger.Info("No such game", "game_id", gameID)
+		writeError(w, http.StatusNotFound, containers.Error{Code: CodeNotFound, Message: fmt.Sprintf("No game with id %d.", gameID)})
+		return
+	}
+
+	payload, err := s.authenticateStream(r)
+	if err != nil {
+		logger.Info("Could not validate token", "error", err)
+		writeErrorf(w, http.StatusUnauthorized, CodeUnauthorized, "%s", err)
+		return
+	}
+	r = r.WithContext(setRequestUser(r.Context(), payload.ID))
+	logger = logging.FromContext(r.Context())
+	user, derr := s.Store.GetUserByID(payload.ID)
+	if derr != nil {
+		logger.Error("Could not get user", "error", derr)
+		writeErrorf(w, http.StatusInternalServerError, CodeInternal, "Could not fetch user.")
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		logger.Error("Response writer does not support flushing")
+		writeErrorf(w, http.StatusInternalServerError, CodeInternal, "Streaming is not supported.")
+		return
+	}
+	conn, err := s.Streams.Open(user.ID, w, flusher, r.Context())
+	if err != nil {
+		writeErrorf(w, http.StatusInternalServerError, CodeInternal, "Could not open stream.")
+		return
+	}
+	defer s.Streams.Remove(conn)
+	sub, err := s.Bus.Subscribe(streamTopic(conn.ID))
+	if err != nil {
+		logger.Error("Could not subscribe to the stream", "error", err)
+		writeErrorf(w, http.StatusInternalServerError, CodeInternal, "Could not open stream.")
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	logger = logger.With("game_id", gameID)
+	client := NewClient(user.ID, conn, logger)
+	go s.receiveCommands(conn, sub, logger)
+	if err := client.SendMessage(&Message{Type: game.EventConnected, Msg: conn.ID}); err != nil {
+		logger.Warn("Could not send event", "error", err)
+	}
+	s.enter(currentGame, room, client, user)
+
+	// The handler owns the response, so it has to outlive the writes.
+	select {
+	case <-client.Done():
+	case <-r.Context().Done():
+	case <-time.After(writeWait):
+	}
+	client.Close()
+}
+
+// receiveCommands delivers the commands posted to other instances for the
+// stream until it closes. Losing the subscription closes the stream, so that
+// the client connects again instead of missing commands.
+func (s *Server) receiveCommands(conn *sseConn, sub *cluster.Subscription, logger *slog.Logger) {
+	defer sub.Close()
+	for {
+		select {
+		case <-conn.closed:
+			return
+		case <-conn.ctx.Done():
+			return
+		case data, ok := <-sub.C:
+			if !ok {
+				logger.Warn("Lost the stream subscription, closing the stream")
+				conn.Close()
+				return
+			}
+			var command streamCommand
+			if err := json.Unmarshal(data, &command); err != nil {
+				logger.Warn("Bad stream command", "error", err)
+				continue
+			}
+			delivered := false
+			if command.User == conn.UserID {
+				ctx, cancel := context.WithTimeout(s.ctx, commandReplyWait)
+				delivered = conn.Deliver(ctx, []byte(command.Data)) == nil
+				cancel()
+			}
+			reply, _ := json.Marshal(streamReply{Delivered: delivered})
+			if err := s.Bus.Publish(replyTopic(command.Reply), reply); err != nil {
+				logger.Warn("Could not answer stream command", "error", err)
+			}
+		}
+	}
+}
+
+// forwardCommand hands the command to the instance that has the stream and
+// reports whether it was delivered.
+func (s *Server) forwardCommand(ctx context.Context, connection string, userID uint, data []byte) (bool, error) {
+	reply := cluster.NewID()
+	sub, err := s.Bus.Subscribe(replyTopic(reply))
+	if err != nil {
+		return false, err
+	}
+	defer sub.Close()
+
+	command, err := json.Marshal(streamCommand{User: userID, Data: string(data), Reply: reply})
+	if err != nil {
+		return false, err
+	}
+	if err := s.Bus.Publish(streamTopic(connection), command); err != nil {
+		return false, err
+	}
+
+	timeout := time.NewTimer(commandReplyWait)
+	defer timeout.Stop()
+	select {
+	case data, ok := <-sub.C:
+		if !ok {
+			return false, errors.New("lost the reply subscription")
+		}
+		var answer streamReply
+		if err := json.Unmarshal(data, &answer); err != nil {
+			return false, err
+		}
+		return answer.Delivered, nil
+	case <-timeout.C:
+		// Nobody has the stream.
+		return false, nil
+	case <-ctx.Done():
+		return false, ctx.Err()
+	}
+}
+
+func (s *Server) handleSSECommand(w http.ResponseWriter, r *http.Request) {
+	logger := logging.FromContext(r.Context())
+	id, ok := r.Context().Value("id").(uint)
+	if !ok {
+		writeErrorf(w, http.StatusInternalServerError, CodeInternal, "Missing user in request context.")
+		return
+	}
+	connection := mux.Vars(r)["connection"]
+
+	data, err := io.ReadAll(io.LimitReader(r.Body, maxSSECommand+1))
+	if err != nil || len(data) > maxSSECommand {
+		writeErrorf(w, http.StatusBadRequest, CodeInvalidRequest, "Could not read the message.")
+		return
+	}
+	if _, perr := DecodeMessage(data); perr != nil {
+		writeError(w, http.StatusBadRequest, containers.Error{Code: string(perr.Code), Message: perr.Message})
+		return
+	}
+
+	conn, ok := s.Streams.Get(connection)
+	if !ok {
+		delivered, err := s.forwardCommand(r.Context(), connection, id, data)
+		if err != nil {
+			logger.Error("Could not forward message", "connection", connection, "error", err)
+			writeErrorf(w, http.StatusInternalServerError, CodeInternal, "Could not forward the message.")
+			return
+		}
+		if !delivered {
+			writeErrorf(w, http.StatusNotFound, CodeNotFound, "No such connection.")
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+	if conn.UserID != id {
+		writeErrorf(w, http.StatusNotFound, CodeNotFound, "No such connection.")
+		return
+	}
+
+	if err := conn.Deliver(r.Context(), data); err != nil {
+		logger.Info("Could not deliver message", "connection", conn.ID, "error", err)
+		writeErrorf(w, http.StatusGone, CodeNotFound, "The connection is closed.")
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
@@ -0,0 +1,192 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/bitterfly/go-chaos/hatgame/database"
+	"github.com/bitterfly/go-chaos/hatgame/game"
+	"github.com/bitterfly/go-chaos/hatgame/logging"
+	"github.com/bitterfly/go-chaos/hatgame/schema"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	"gorm.io/gorm"
+)
+
+const (
+	ticketSize     = 32
+	ticketLifetime = 30 * time.Second
+	authWait       = 10 * time.Second
+)
+
+var ErrInvalidTicket = errors.New("ticket is invalid or has already been used")
+
+// Tickets are kept in the store, so that a ticket issued by one instance can
+// be redeemed on any other. Only the hash of a ticket is stored.
+type Tickets struct {
+	store database.Store
+}
+
+func NewTickets(store database.Store) *Tickets {
+	return &Tickets{store: store}
+}
+
+func hashTicket(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func (t *Tickets) Issue(payload Payload) (string, error) {
+	value := make([]byte, ticketSize)
+	if _, err := rand.Read(value); err != nil {
+		return "", err
+	}
+	key := base64.RawURLEncoding.EncodeToString(value)
+
+	derr := t.store.AddTicket(&schema.Ticket{
+		Hash:      hashTicket(key),
+		UserID:    payload.ID,
+		SessionID: payload.Session,
+		ExpiresAt: time.Now().Add(ticketLifetime),
+	})
+	if derr != nil {
+		return "", derr
+	}
+	return key, nil
+}
+
+func (t *Tickets) Redeem(key string) (*Payload, error) {
+	issued, derr := t.store.RedeemTicket(hashTicket(key))
+	if derr != nil {
+		if !errors.Is(derr, gorm.ErrRecordNotFound) {
+			slog.Error("Could not redeem ticket", "error", derr)
+		}
+		return nil, ErrInvalidTicket
+	}
+	return &Payload{ID: issued.UserID, Session: issued.SessionID}, nil
+}
+
+func (s *Server) handleTicket(w http.ResponseWriter, r *http.Request) {
+	id, ok := r.Context().Value("id").(uint)
+	if !ok {
+		writeErrorf(w, http.StatusInternalServerError, CodeInternal, "Missing user in request context.")
+		return
+	}
+	session, ok := r.Context().Value("session").(uint)
+	if !ok {
+		writeErrorf(w, http.StatusInternalServerError, CodeInternal, "Missing session in request context.")
+		return
+	}
+
+	value, err := s.Tickets.Issue(Payload{ID: id, Session: session})
+	if err != nil {
+		writeErrorf(w, http.StatusInternalServerError, CodeInternal, "Could not create ticket.")
+		return
+	}
+
+	resp := map[string]interface{}{
+		"ticket":  value,
+		"expires": int(ticketLifetime.Seconds()),
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (s *Server) redeemTicket(key string) (*Payload, error) {
+	payload, err := s.Tickets.Redeem(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.checkSession(payload); err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
+
+func (s *Server) authenticateFirstFrame(ws *websocket.Conn) (*Payload, error) {
+	ws.SetReadDeadline(time.Now().Add(authWait))
+	defer ws.SetReadDeadline(time.Time{})
+
+	_, data, err := ws.ReadMessage()
+	if err != nil {
+		return nil, fmt.Errorf("could not read auth message: %w", err)
+	}
+	msg, perr := DecodeMessage(data)
+	if perr != nil {
+		return nil, perr
+	}
+	auth, ok := msg.Msg.(AuthPayload)
+	if !ok {
+		return nil, fmt.Errorf("the first message has to be %q with a ticket or a session token", game.EventAuth)
+	}
+	token := string(auth)
+
+	if payload, err := s.redeemTicket(token); err == nil {
+		return payload, nil
+	}
+	payload, err := s.Token.VerifyToken(token)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.checkSession(payload); err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
+
+func refuse(ws *websocket.Conn, code ErrorCode, reason string) {
+	deadline := time.Now().Add(writeWait)
+	ws.SetWriteDeadline(deadline)
+	ws.WriteJSON(&Message{Version: ProtocolVersion, Type: game.EventError, Msg: reason, Code: code})
+	ws.WriteControl(
+		websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.ClosePolicyViolation, ""),
+		deadline)
+	ws.Close()
+}
+
+// upgrade authenticates the request and upgrades it to a websocket. The
+// returned context carries the user for the access log and the logger.
+func (s *Server) upgrade(w http.ResponseWriter, r *http.Request, name string) (context.Context, *Payload, *websocket.Conn, bool) {
+	logger := logging.FromContext(r.Context()).With("handler", name)
+	vars := mux.Vars(r)
+	header := http.Header{}
+
+	var payload *Payload
+	var err error
+	if _, ok := vars["sessionToken"]; ok {
+		logger.Warn("Session token in the path is deprecated, use a ticket from /api/ws/ticket")
+		header.Set("Deprecation", "true")
+		payload, err = s.verifyVars(vars)
+	} else if key := r.URL.Query().Get("ticket"); key != "" {
+		payload, err = s.redeemTicket(key)
+	}
+	if err != nil {
+		logger.Info("Could not validate token", "error", err)
+		writeErrorf(w, http.StatusUnauthorized, CodeUnauthorized, "%s", err)
+		return nil, nil, nil, false
+	}
+
+	ws, err := s.Upgrader.Upgrade(w, r, header)
+	if err != nil {
+		logger.Info("Could not upgrade to ws", "error", err)
+		return nil, nil, nil, false
+	}
+
+	if payload == nil {
+		payload, err = s.authenticateFirstFrame(ws)
+		if err != nil {
+			logger.Info("Could not authenticate", "error", err)
+			refuse(ws, ErrorAuth, err.Error())
+			return nil, nil, nil, false
+		}
+	}
+	return setRequestUser(r.Context(), payload.ID), payload, ws, true
+}
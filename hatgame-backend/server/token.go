@@ -3,7 +3,6 @@ package server
 import (
 	"errors"
 	"fmt"
-	"math/rand"
 	"net/http"
 	"strings"
 	"time"
@@ -18,6 +17,7 @@ var (
 
 type Payload struct {
 	ID      uint
+	Session uint
 	Expires int64
 }
 
@@ -29,23 +29,20 @@ func (payload *Payload) Valid() error {
 }
 
 type Token struct {
-	secretKey string
+	Keys     *KeySet
+	lifetime time.Duration
 }
 
-func NewToken(n int) Token {
-	var letters = []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789")
-
-	s := make([]rune, n)
-	for i := range s {
-		s[i] = letters[rand.Intn(len(letters))]
-	}
-	return Token{secretKey: string(s)}
+func NewToken(keys *KeySet, lifetime time.Duration) Token {
+	return Token{Keys: keys, lifetime: lifetime}
 }
 
-func (t *Token) CreateToken(id uint, duration time.Duration) (string, error) {
-	payload := Payload{ID: id, Expires: time.Now().Add(time.Minute * 15).Unix()}
+func (t *Token) CreateToken(id uint, session uint) (string, error) {
+	key := t.Keys.Current()
+	payload := Payload{ID: id, Session: session, Expires: time.Now().Add(t.lifetime).Unix()}
 	jwtToken := jwt.NewWithClaims(jwt.SigningMethodHS256, &payload)
-	signedToken, err := jwtToken.SignedString([]byte(t.secretKey))
+	jwtToken.Header["kid"] = key.ID
+	signedToken, err := jwtToken.SignedString(key.Secret)
 	if err != nil {
 		return "", err
 	}
@@ -56,8 +53,7 @@ func (t *Token) CheckTokenRequest(w http.ResponseWriter, r *http.Request) (*Payl
 	token := ExtractToken(r)
 	payload, err := t.VerifyToken(token)
 	if err != nil {
-		w.WriteHeader(http.StatusUnauthorized)
-		w.Write([]byte(fmt.Sprintf("%s", err)))
+		writeErrorf(w, http.StatusUnauthorized, CodeUnauthorized, "%s", err)
 		return nil, err
 	}
 	return payload, nil
@@ -78,7 +74,15 @@ func (t *Token) VerifyToken(token string) (*Payload, error) {
 		if !ok {
 			return nil, ErrInvalidToken
 		}
-		return []byte(t.secretKey), nil
+		id, ok := token.Header["kid"].(string)
+		if !ok {
+			return nil, ErrInvalidToken
+		}
+		key, ok := t.Keys.Find(id)
+		if !ok {
+			return nil, ErrInvalidToken
+		}
+		return key.Secret, nil
 	}
 
 	jwtToken, err := jwt.ParseWithClaims(token, &Payload{}, keyFunc)
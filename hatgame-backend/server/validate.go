@@ -0,0 +1,109 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/mail"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/bitterfly/go-chaos/hatgame/config"
+	"github.com/bitterfly/go-chaos/hatgame/database"
+	"github.com/bitterfly/go-chaos/hatgame/server/containers"
+)
+
+const (
+	maxEmailLength    = 254
+	minUsernameLength = 3
+	maxUsernameLength = 20
+)
+
+// Letters, digits, _, - and ., with single spaces between words.
+var usernamePattern = regexp.MustCompile(`^[\p{L}\p{N}_.-]+( [\p{L}\p{N}_.-]+)*$`)
+
+func checkEmail(email string) []containers.FieldError {
+	if email == "" {
+		return []containers.FieldError{{Field: "Email", Message: "can not be empty"}}
+	}
+	address, err := mail.ParseAddress(email)
+	if err != nil || address.Address != email || len(email) > maxEmailLength {
+		return []containers.FieldError{{Field: "Email", Message: "is not an email address"}}
+	}
+	return nil
+}
+
+func checkUsername(username string) []containers.FieldError {
+	length := utf8.RuneCountInString(username)
+	if length < minUsernameLength || length > maxUsernameLength {
+		return []containers.FieldError{{
+			Field:   "Username",
+			Message: fmt.Sprintf("has to be between %d and %d characters long", minUsernameLength, maxUsernameLength),
+		}}
+	}
+	if !usernamePattern.MatchString(username) {
+		return []containers.FieldError{{
+			Field:   "Username",
+			Message: "can only have letters, digits, _, - and . and single spaces between them",
+		}}
+	}
+	return nil
+}
+
+func (s *Server) checkPassword(password string) []containers.FieldError {
+	policy := s.Config.Passwords
+	problems := make([]containers.FieldError, 0)
+	if utf8.RuneCountInString(password) < policy.MinLength {
+		problems = append(problems, containers.FieldError{
+			Field:   "Password",
+			Message: fmt.Sprintf("has to be at least %d characters long", policy.MinLength),
+		})
+	}
+	if len(password) > config.MaxPasswordLength {
+		problems = append(problems, containers.FieldError{
+			Field:   "Password",
+			Message: fmt.Sprintf("can be at most %d bytes long", config.MaxPasswordLength),
+		})
+	}
+
+	var letter, digit, symbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsLetter(r):
+			letter = true
+		case unicode.IsDigit(r):
+			digit = true
+		default:
+			symbol = true
+		}
+	}
+	if policy.RequireLetter && !letter {
+		problems = append(problems, containers.FieldError{Field: "Password", Message: "has to contain a letter"})
+	}
+	if policy.RequireDigit && !digit {
+		problems = append(problems, containers.FieldError{Field: "Password", Message: "has to contain a digit"})
+	}
+	if policy.RequireSymbol && !symbol {
+		problems = append(problems, containers.FieldError{Field: "Password", Message: "has to contain a character that is not a letter or a digit"})
+	}
+	return problems
+}
+
+// normalizeUser trims the spaces around the email and the username and
+// lowercases the email, the password is kept as it is.
+func normalizeUser(user *containers.LoginUser) {
+	user.Email = strings.ToLower(strings.TrimSpace(user.Email))
+	user.Username = strings.TrimSpace(user.Username)
+}
+
+// conflictFields names the field a ConflictError of the store is about.
+func conflictFields(derr *database.DatabaseError) []containers.FieldError {
+	switch {
+	case errors.Is(derr, database.ErrEmailTaken):
+		return []containers.FieldError{{Field: "Email", Message: "is already taken"}}
+	case errors.Is(derr, database.ErrUsernameTaken):
+		return []containers.FieldError{{Field: "Username", Message: "is already taken"}}
+	}
+	return nil
+}
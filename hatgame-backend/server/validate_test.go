@@ -0,0 +1,122 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/bitterfly/go-chaos/hatgame/config"
+	"github.com/bitterfly/go-chaos/hatgame/server/containers"
+)
+
+// fields lists the fields of the problems, in order.
+func fields(problems []containers.FieldError) string {
+	names := make([]string, 0, len(problems))
+	for _, problem := range problems {
+		names = append(names, problem.Field)
+	}
+	return strings.Join(names, ",")
+}
+
+func TestCheckEmail(t *testing.T) {
+	for _, test := range []struct {
+		email string
+		want  string
+	}{
+		{"name@example.com", ""},
+		{"first.last+tag@sub.example.org", ""},
+		{"", "Email"},
+		{"name", "Email"},
+		{"name@", "Email"},
+		{"Name <name@example.com>", "Email"},
+		{"name@example.com, other@example.com", "Email"},
+		{strings.Repeat("a", 243) + "@example.com", "Email"},
+	} {
+		if got := fields(checkEmail(test.email)); got != test.want {
+			t.Errorf("%q: got problems with %q, want %q", test.email, got, test.want)
+		}
+	}
+}
+
+func TestCheckUsername(t *testing.T) {
+	for _, test := range []struct {
+		username string
+		want     string
+	}{
+		{"bob", ""},
+		{"Anna-Maria_1.5", ""},
+		{"two words", ""},
+		{"Иван Петров", ""},
+		{strings.Repeat("я", maxUsernameLength), ""},
+		{"ab", "Username"},
+		{strings.Repeat("a", maxUsernameLength+1), "Username"},
+		{"two  spaces", "Username"},
+		{" leading", "Username"},
+		{"trailing ", "Username"},
+		{"semi;colon", "Username"},
+		{"<script>", "Username"},
+	} {
+		if got := fields(checkUsername(test.username)); got != test.want {
+			t.Errorf("%q: got problems with %q, want %q", test.username, got, test.want)
+		}
+	}
+}
+
+func TestCheckPassword(t *testing.T) {
+	lenient := config.Passwords{MinLength: 8}
+	strict := config.Passwords{MinLength: 8, RequireLetter: true, RequireDigit: true, RequireSymbol: true}
+	for _, test := range []struct {
+		policy   config.Passwords
+		password string
+		want     string
+	}{
+		{lenient, "password", ""},
+		{lenient, "        ", ""},
+		{lenient, "pass", "Password"},
+		{lenient, "пароль12", ""},
+		{lenient, strings.Repeat("a", config.MaxPasswordLength), ""},
+		{lenient, strings.Repeat("a", config.MaxPasswordLength+1), "Password"},
+		// 36 two byte letters are 72 bytes, 37 are too many.
+		{lenient, strings.Repeat("я", 37), "Password"},
+		{strict, "passw0rd!", ""},
+		{strict, "password", "Password,Password"},
+		{strict, "12345678", "Password,Password"},
+		{strict, "pass 1234", ""},
+		{strict, "p1!", "Password"},
+	} {
+		s := &Server{Config: config.Config{Passwords: test.policy}}
+		if got := fields(s.checkPassword(test.password)); got != test.want {
+			t.Errorf("%+v %q: got problems with %q, want %q", test.policy, test.password, got, test.want)
+		}
+	}
+}
+
+func TestNormalizeUser(t *testing.T) {
+	for _, test := range []struct {
+		user containers.LoginUser
+		want containers.LoginUser
+	}{
+		{
+			user: containers.LoginUser{Email: "name@example.com", Username: "bob", Password: "secret"},
+			want: containers.LoginUser{Email: "name@example.com", Username: "bob", Password: "secret"},
+		},
+		{
+			user: containers.LoginUser{Email: "  Name@Example.COM\t", Username: " Bob ", Password: " secret "},
+			want: containers.LoginUser{Email: "name@example.com", Username: "Bob", Password: " secret "},
+		},
+		{
+			user: containers.LoginUser{Email: "ÄNNE@EXAMPLE.COM", Username: "two words"},
+			want: containers.LoginUser{Email: "änne@example.com", Username: "two words"},
+		},
+		{
+			user: containers.LoginUser{Email: "   ", Username: "   "},
+			want: containers.LoginUser{},
+		},
+	} {
+		user := test.user
+		normalizeUser(&user)
+		if fmt.Sprintf("%+v", user) != fmt.Sprintf("%+v", test.want) {
+			t.Errorf("%+v: got %+v, want %+v", test.user, user, test.want)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package server
+
+import (
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+type wsConn struct {
+	ws *websocket.Conn
+}
+
+func newWSConn(ws *websocket.Conn) *wsConn {
+	// Commands are limited to the same size as over SSE.
+	ws.SetReadLimit(maxSSECommand)
+	ws.SetReadDeadline(time.Now().Add(pongWait))
+	ws.SetPongHandler(func(string) error {
+		return ws.SetReadDeadline(time.Now().Add(pongWait))
+	})
+	return &wsConn{ws: ws}
+}
+
+func (c *wsConn) ReadMessage() ([]byte, error) {
+	_, msg, err := c.ws.ReadMessage()
+	return msg, err
+}
+
+func (c *wsConn) WriteMessage(msg []byte) error {
+	c.ws.SetWriteDeadline(time.Now().Add(writeWait))
+	return c.ws.WriteMessage(websocket.TextMessage, msg)
+}
+
+func (c *wsConn) Ping() error {
+	c.ws.SetWriteDeadline(time.Now().Add(writeWait))
+	return c.ws.WriteMessage(websocket.PingMessage, nil)
+}
+
+func (c *wsConn) CloseGracefully() error {
+	return c.ws.WriteControl(
+		websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+		time.Now().Add(writeWait))
+}
+
+func (c *wsConn) Close() error {
+	return c.ws.Close()
+}